@@ -0,0 +1,197 @@
+package proxybench
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/getlantern/ops"
+)
+
+const (
+	// anomalyLatencyAlpha is the weight given to the newest sample in the
+	// rolling latency mean and variance
+	anomalyLatencyAlpha = 0.1
+
+	// anomalyLongAlpha and anomalyShortAlpha are the weights given to the
+	// newest result in the long-term and recent success rates
+	anomalyLongAlpha  = 0.05
+	anomalyShortAlpha = 0.3
+
+	defaultAnomalySuccessDrop = 0.2
+	defaultAnomalyMinSamples  = 10
+
+	// maxAnomalyBaselines bounds the number of proxy/protocol/URL baselines
+	// that we track.
+	maxAnomalyBaselines = 10000
+)
+
+// Anomaly describes a regression detected with Opts.AnomalyThreshold.
+type Anomaly struct {
+	// Kind is "latency" or "success_rate".
+	Kind       string
+	URL        string
+	Proxy      string
+	Protocol   string
+	Provider   string
+	DataCenter string
+
+	// Value is the latency in seconds of the anomalous request, or the recent
+	// success rate.
+	Value float64
+
+	// Baseline is the rolling mean latency in seconds, or the long-term
+	// success rate.
+	Baseline float64
+
+	// StdDev is the standard deviation of the latency in seconds, only for
+	// latency anomalies.
+	StdDev float64
+
+	Time time.Time
+}
+
+// SetAnomalyHandler sets a function that's called with every anomaly detected
+// with Opts.AnomalyThreshold, in addition to it being reported.
+func (r *Runner) SetAnomalyHandler(handler func(Anomaly)) {
+	r.onAnomaly.Store(handler)
+}
+
+// anomalyDetector keeps rolling statistics per proxy, protocol and URL.
+type anomalyDetector struct {
+	baselines map[string]*anomalyBaseline
+	mx        sync.Mutex
+}
+
+type anomalyBaseline struct {
+	latencySamples int
+	latencyMean    float64
+	latencyVar     float64
+	latencyFlagged bool
+
+	results        int
+	successLong    float64
+	successShort   float64
+	successFlagged bool
+}
+
+// check updates the baseline for key with a result, returning any anomalies
+// that the result starts.
+func (ad *anomalyDetector) check(key string, opts *Opts, timing time.Duration, err error) []Anomaly {
+	ad.mx.Lock()
+	defer ad.mx.Unlock()
+	if ad.baselines == nil {
+		ad.baselines = make(map[string]*anomalyBaseline)
+	}
+	b := ad.baselines[key]
+	if b == nil {
+		if len(ad.baselines) >= maxAnomalyBaselines {
+			// Start over rather than grow without bound
+			ad.baselines = make(map[string]*anomalyBaseline)
+		}
+		b = &anomalyBaseline{}
+		ad.baselines[key] = b
+	}
+	minSamples := opts.anomalyMinSamples()
+	var anomalies []Anomaly
+
+	success := 0.0
+	if err == nil {
+		success = 1
+	}
+	if b.results == 0 {
+		b.successLong, b.successShort = success, success
+	} else {
+		b.successLong = anomalyLongAlpha*success + (1-anomalyLongAlpha)*b.successLong
+		b.successShort = anomalyShortAlpha*success + (1-anomalyShortAlpha)*b.successShort
+	}
+	b.results++
+	drop := b.successLong - b.successShort
+	maxDrop := opts.anomalySuccessDrop()
+	if b.results >= minSamples && drop > maxDrop {
+		if !b.successFlagged {
+			b.successFlagged = true
+			anomalies = append(anomalies, Anomaly{Kind: "success_rate", Value: b.successShort, Baseline: b.successLong})
+		}
+	} else if drop <= maxDrop/2 {
+		// Only clear once well recovered so that we don't flap
+		b.successFlagged = false
+	}
+
+	if err != nil || timing <= 0 {
+		return anomalies
+	}
+	latency := timing.Seconds()
+	if b.latencySamples >= minSamples {
+		stdDev := math.Sqrt(b.latencyVar)
+		if stdDev > 0 && latency > b.latencyMean+opts.AnomalyThreshold*stdDev {
+			if !b.latencyFlagged {
+				b.latencyFlagged = true
+				anomalies = append(anomalies, Anomaly{Kind: "latency", Value: latency, Baseline: b.latencyMean, StdDev: stdDev})
+			}
+		} else {
+			b.latencyFlagged = false
+		}
+	}
+	if b.latencySamples == 0 {
+		b.latencyMean = latency
+	} else {
+		diff := latency - b.latencyMean
+		incr := anomalyLatencyAlpha * diff
+		b.latencyMean += incr
+		b.latencyVar = (1 - anomalyLatencyAlpha) * (b.latencyVar + diff*incr)
+	}
+	b.latencySamples++
+	return anomalies
+}
+
+// detectAnomalies checks the result of a request for anomalies, reporting
+// them and passing them to the anomaly handler.
+func (rn *run) detectAnomalies(origin string, proxy *proxy, timing time.Duration, err error) {
+	if rn.opts.AnomalyThreshold <= 0 {
+		return
+	}
+	key := statsKey(proxy.key(), proxy.protocol) + "|" + origin
+	anomalies := rn.anomalies.check(key, rn.opts, timing, err)
+	if len(anomalies) == 0 {
+		return
+	}
+	handler, _ := rn.onAnomaly.Load().(func(Anomaly))
+	report := rn.reporter()
+	for _, anomaly := range anomalies {
+		anomaly.URL = origin
+		anomaly.Proxy = proxy.key()
+		anomaly.Protocol = proxy.protocol
+		anomaly.Provider = proxy.Provider
+		anomaly.DataCenter = proxy.DataCenter
+		anomaly.Time = time.Now()
+		log.Debugf("Detected %v anomaly for %v via %v: %v against a baseline of %v", anomaly.Kind, origin, proxy.addr, anomaly.Value, anomaly.Baseline)
+
+		op := beginOp(rn.opts, origin, proxy).
+			Set("anomaly", anomaly.Kind).
+			Set("anomaly_value", anomaly.Value).
+			Set("anomaly_baseline", anomaly.Baseline)
+		if anomaly.Kind == "latency" {
+			op.Set("anomaly_stddev", anomaly.StdDev)
+		}
+		report(0, ops.AsMap(op, true))
+		op.End()
+		if handler != nil {
+			handler(anomaly)
+		}
+	}
+}
+
+func (opts *Opts) anomalySuccessDrop() float64 {
+	if opts.AnomalySuccessDrop > 0 {
+		return opts.AnomalySuccessDrop
+	}
+	return defaultAnomalySuccessDrop
+}
+
+func (opts *Opts) anomalyMinSamples() int {
+	if opts.AnomalyMinSamples > 0 {
+		return opts.AnomalyMinSamples
+	}
+	return defaultAnomalyMinSamples
+}
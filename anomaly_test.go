@@ -0,0 +1,82 @@
+package proxybench
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyAnomaly(t *testing.T) {
+	ad := &anomalyDetector{}
+	opts := &Opts{AnomalyThreshold: 3}
+	for i := 0; i < 20; i++ {
+		// Alternate between 90 and 110ms
+		timing := 90*time.Millisecond + time.Duration(i%2)*20*time.Millisecond
+		assert.Empty(t, ad.check("a", opts, timing, nil), "normal latencies shouldn't be flagged")
+	}
+	anomalies := ad.check("a", opts, time.Second, nil)
+	if assert.Len(t, anomalies, 1) {
+		assert.Equal(t, "latency", anomalies[0].Kind)
+		assert.Equal(t, 1.0, anomalies[0].Value)
+		assert.InDelta(t, 0.1, anomalies[0].Baseline, 0.01)
+		assert.True(t, anomalies[0].StdDev > 0)
+	}
+	assert.Empty(t, ad.check("a", opts, time.Second, nil), "ongoing anomaly should only be flagged once")
+	assert.Empty(t, ad.check("b", opts, time.Second, nil), "baselines should be separate per key")
+}
+
+func TestSuccessRateAnomaly(t *testing.T) {
+	ad := &anomalyDetector{}
+	opts := &Opts{AnomalyThreshold: 3}
+	for i := 0; i < 20; i++ {
+		assert.Empty(t, ad.check("a", opts, 100*time.Millisecond, nil))
+	}
+	var anomalies []Anomaly
+	for i := 0; i < 3; i++ {
+		anomalies = append(anomalies, ad.check("a", opts, 0, errors.New("failed"))...)
+	}
+	if assert.Len(t, anomalies, 1, "consecutive failures should be flagged once") {
+		assert.Equal(t, "success_rate", anomalies[0].Kind)
+		assert.True(t, anomalies[0].Value < anomalies[0].Baseline-0.2)
+	}
+}
+
+func TestAnomalyMinSamples(t *testing.T) {
+	ad := &anomalyDetector{}
+	opts := &Opts{AnomalyThreshold: 1, AnomalyMinSamples: 5}
+	ad.check("a", opts, 100*time.Millisecond, nil)
+	ad.check("a", opts, 110*time.Millisecond, nil)
+	assert.Empty(t, ad.check("a", opts, time.Second, nil), "shouldn't flag before the baseline is established")
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	var reported []map[string]interface{}
+	r := newRunner(context.Background(), &Opts{}, ReportFN(func(timing time.Duration, ctx map[string]interface{}) {
+		reported = append(reported, ctx)
+	}))
+	var handled []Anomaly
+	r.SetAnomalyHandler(func(anomaly Anomaly) {
+		handled = append(handled, anomaly)
+	})
+	rn := r.newRun(&Opts{AnomalyThreshold: 3, AnomalyMinSamples: 2}, false)
+	p := (&Proxy{Addrs: map[string]string{"https": "1.2.3.4:443"}, Provider: "do"}).withProtocol("https")
+	rn.record("https://a.com", p, 100*time.Millisecond, nil)
+	rn.record("https://a.com", p, 110*time.Millisecond, nil)
+	rn.record("https://a.com", p, 5*time.Second, nil)
+
+	if assert.Len(t, handled, 1) {
+		assert.Equal(t, "latency", handled[0].Kind)
+		assert.Equal(t, "https://a.com", handled[0].URL)
+		assert.Equal(t, "https", handled[0].Protocol)
+		assert.Equal(t, "do", handled[0].Provider)
+	}
+	if assert.Len(t, reported, 1) {
+		assert.Equal(t, "latency", reported[0]["anomaly"])
+		assert.Equal(t, 5.0, reported[0]["anomaly_value"])
+		assert.Equal(t, "1.2.3.4", reported[0]["proxy_host"])
+	}
+	assert.Len(t, r.Stats(), 1, "results should still be recorded in stats")
+}
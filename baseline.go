@@ -0,0 +1,109 @@
+package proxybench
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/getlantern/ops"
+)
+
+// benchDirect fetches origin without going through any proxy in order to
+// establish a baseline from the client's own network. It returns the timing
+// and whether the baseline looks like it was intercepted by a transparent
+// proxy, in which case it shouldn't be used as a baseline.
+func (rn *run) benchDirect(origin string) (time.Duration, bool, error) {
+	rn.pacer.wait(rn.ctx, rn.opts, origin)
+	op := ops.Begin("proxybench").
+		Set("url", origin).
+		Set("proxy_type", "direct")
+	defer op.End()
+
+	client := &http.Client{
+		Timeout: rn.opts.requestTimeout(),
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+		},
+	}
+	start := time.Now()
+	req, err := rn.opts.target(origin).newRequest(origin)
+	if err != nil {
+		log.Debugf("Unable to build request for %v: %v", origin, err)
+		return 0, false, err
+	}
+	req = req.WithContext(rn.ctx)
+	op.Set("origin", req.URL.Host).Set("origin_host", req.URL.Host)
+	resp, err := client.Do(req)
+	if err != nil {
+		if reason := interceptedByError(err); reason != "" {
+			op.Set("baseline_intercepted", true).Set("baseline_interception_reason", reason)
+			rn.reporter()(0, ops.AsMap(op, true))
+		}
+		log.Debugf("Error fetching %v directly: %v", origin, err)
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 403 || resp.StatusCode == 500 {
+		log.Debugf("Unexpected status %v fetching %v directly", resp.Status, origin)
+		return 0, false, fmt.Errorf("Unexpected status %v", resp.Status)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	if err := rn.ctx.Err(); err != nil {
+		return 0, false, err
+	}
+	delta := time.Since(start)
+	op.Set("proxybench_success", true)
+	if reason := interceptedResponse(rn.opts, req.URL, resp); reason != "" {
+		log.Debugf("Baseline request to %v appears to have been intercepted: %v", origin, reason)
+		op.Set("baseline_intercepted", true).Set("baseline_interception_reason", reason)
+		rn.reporter()(delta, ops.AsMap(op, true))
+		return delta, true, nil
+	}
+	rn.reporter()(delta, ops.AsMap(op, true))
+	return delta, false, nil
+}
+
+// interceptedByError checks whether a failed direct request failed in a way
+// that suggests interception, like a certificate that doesn't chain to a
+// trusted root.
+func interceptedByError(err error) string {
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+	switch err.(type) {
+	case x509.UnknownAuthorityError:
+		return "untrusted certificate"
+	case x509.HostnameError:
+		return "certificate hostname mismatch"
+	}
+	return ""
+}
+
+// interceptedResponse checks a successful direct response for signs that it
+// was served by a transparent proxy rather than the origin itself.
+func interceptedResponse(opts *Opts, u *url.URL, resp *http.Response) string {
+	if via := resp.Header.Get("Via"); via != "" {
+		return "unexpected Via header: " + via
+	}
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	expected := opts.BaselineIssuers[u.Hostname()]
+	if len(expected) == 0 {
+		return ""
+	}
+	issuer := resp.TLS.PeerCertificates[0].Issuer
+	for _, org := range issuer.Organization {
+		for _, candidate := range expected {
+			if strings.EqualFold(org, candidate) {
+				return ""
+			}
+		}
+	}
+	return "unexpected certificate issuer: " + issuer.String()
+}
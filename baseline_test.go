@@ -0,0 +1,32 @@
+package proxybench
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterceptedResponse(t *testing.T) {
+	u, _ := url.Parse("https://www.google.com/humans.txt")
+	opts := &Opts{BaselineIssuers: map[string][]string{"www.google.com": []string{"Google Trust Services"}}}
+	withIssuer := func(org string) *http.Response {
+		return &http.Response{
+			Header: make(http.Header),
+			TLS: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+				&x509.Certificate{Issuer: pkix.Name{Organization: []string{org}}},
+			}},
+		}
+	}
+
+	assert.Empty(t, interceptedResponse(opts, u, withIssuer("Google Trust Services")))
+	assert.Contains(t, interceptedResponse(opts, u, withIssuer("Corporate Firewall CA")), "unexpected certificate issuer")
+
+	resp := withIssuer("Google Trust Services")
+	resp.Header.Set("Via", "1.1 squid")
+	assert.Contains(t, interceptedResponse(opts, u, resp), "unexpected Via header")
+}
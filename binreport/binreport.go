@@ -0,0 +1,443 @@
+// Package binreport encodes proxybench reports in a compact binary format for
+// clients on expensive or slow uplinks, and decodes them again for collectors.
+//
+// A stream starts with the 3 byte magic "PBR" followed by a single version
+// byte (currently 1). Each report that follows is encoded as:
+//
+//	uvarint  length of the rest of the report in bytes
+//	varint   timing in nanoseconds
+//	uvarint  number of fields
+//	fields   each encoded as:
+//	  uvarint  field ID from Fields, or 0 for a field that isn't listed
+//	  [uvarint length, bytes] field name, only if the field ID is 0
+//	  byte     value type
+//	  value    depending on the type:
+//	    typeBool (1):   1 byte, 0 or 1
+//	    typeInt (2):    zig-zag varint
+//	    typeFloat (3):  8 byte little endian IEEE 754 float64
+//	    typeString (4): uvarint length followed by UTF-8 bytes
+//
+// Values of any other Go type are encoded as strings. Integers of all sizes
+// decode as int64.
+//
+// Field IDs are the 1-based positions of names in Fields. New fields are only
+// ever appended, so that older collectors can still decode newer streams
+// (they'll see unknown IDs, which they can skip). Incompatible changes to the
+// layout will bump the version.
+package binreport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxybench"
+)
+
+const (
+	// Version is the version of the format written by Reporter
+	Version = 1
+
+	typeBool   = 1
+	typeInt    = 2
+	typeFloat  = 3
+	typeString = 4
+
+	// maxReportSize bounds the size of a single report when decoding
+	maxReportSize = 1024 * 1024
+)
+
+var (
+	log = golog.LoggerFor("proxybench.binreport")
+
+	magic = []byte("PBR")
+
+	// Fields are the well-known report fields, whose IDs are their 1-based
+	// positions in this list. Only ever append to it.
+	Fields = []string{
+		"url",
+		"origin",
+		"origin_host",
+		"proxy_type",
+		"proxy_protocol",
+		"proxy_provider",
+		"proxy_datacenter",
+		"proxy_host",
+		"proxy_port",
+		"proxybench_success",
+		"newly_added",
+		"clock_anomaly",
+		"clock_drift",
+		"simulated_bandwidth_bps",
+		"tcp_rtt_us",
+		"tcp_retransmits",
+		"proxy_fully_down",
+		"proxy_protocols_tried",
+		"proxy_errors",
+		"protocol_comparison",
+		"https_latency",
+		"obfs4_latency",
+		"latency_delta",
+		"latency_ratio",
+		"baseline_intercepted",
+		"baseline_interception_reason",
+		"obfs4_iat_mode",
+		"queue_wait_time",
+		"request_type",
+		"ws_upgrade_success",
+		"ws_upgrade_status",
+		"ws_upgrade_time",
+		"ws_ping_rtt",
+		"run_id",
+		"run_verdict",
+		"run_healthy",
+		"critical_targets",
+		"critical_failures",
+		"system_proxy_direct",
+		"run_cancelled",
+		"endpoints_completed",
+		"endpoints_skipped",
+		"alpn",
+		"failure_phase",
+		"front_domain",
+		"retry_budget_exhausted",
+		"doh_query_name",
+		"doh_resolve_time",
+		"doh_answers",
+		"local_relay_addr",
+		"content_type",
+		"content_type_mismatch",
+		"failure_reason",
+		"captive_portal_detected",
+		"captive_portal_status",
+		"http_proto",
+		"http_version_mismatch",
+		"slow",
+		"attempted_ips",
+		"connected_ip",
+		"cross_run_reuse",
+		"stats_snapshot",
+		"stats_proxy",
+		"stats_successes",
+		"stats_failures",
+		"stats_latency_ema",
+		"stats_failure_ema",
+		"http_status",
+		"failure_time",
+		"failure_error",
+		"dns_time",
+		"connect_time",
+		"tls_handshake_time",
+		"ttfb",
+		"transfer_time",
+		"response_bytes",
+		"throughput_bps",
+		"quic_handshake_time",
+		"snowflake_rendezvous_time",
+		"cert_verification_failed",
+		"tls_fingerprint",
+		"tls_full_handshake_time",
+		"tls_resumed_handshake_time",
+		"tls_session_resumed",
+		"baseline_latency",
+		"proxy_overhead",
+		"sample_aggregate",
+		"samples",
+		"samples_succeeded",
+		"latency_min",
+		"latency_max",
+		"latency_mean",
+		"latency_p50",
+		"latency_p95",
+		"latency_p99",
+		"request_timeout",
+		"request_timeout_hit",
+		"request_method",
+		"request_bytes",
+		"expected_bytes",
+		"response_truncated",
+		"upload_bytes",
+		"upload_time",
+		"upload_throughput_bps",
+		"keepalive_index",
+		"conn_reused",
+		"keepalive_requests",
+		"keepalive_first_latency",
+		"keepalive_subsequent_latency",
+		"keepalive_setup_overhead",
+		"h2_stream_index",
+		"h2_streams",
+		"h2_streams_succeeded",
+		"h2_total_time",
+		"h2_stream_latency_mean",
+		"h2_stream_latency_max",
+		"h2_multiplexed",
+		"anomaly",
+		"anomaly_value",
+		"anomaly_baseline",
+		"anomaly_stddev",
+	}
+
+	fieldIDs = make(map[string]uint64, len(Fields))
+)
+
+func init() {
+	for i, field := range Fields {
+		fieldIDs[field] = uint64(i + 1)
+	}
+}
+
+// Reporter writes reports in the binary format to an io.Writer.
+type Reporter struct {
+	w           io.Writer
+	wroteHeader bool
+	mx          sync.Mutex
+}
+
+// NewReporter creates a Reporter that writes to w.
+func NewReporter(w io.Writer) *Reporter {
+	return &Reporter{w: w}
+}
+
+// Report writes a single report. It implements proxybench.Reporter. Errors
+// writing are logged.
+func (r *Reporter) Report(result proxybench.Result) {
+	if err := r.Write(result.Timing, result.Fields); err != nil {
+		log.Errorf("Unable to write report: %v", err)
+	}
+}
+
+// Write writes a single report, returning any error.
+func (r *Reporter) Write(timing time.Duration, ctx map[string]interface{}) error {
+	b := Encode(timing, ctx)
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if !r.wroteHeader {
+		if _, err := r.w.Write(append(append([]byte(nil), magic...), Version)); err != nil {
+			return err
+		}
+		r.wroteHeader = true
+	}
+	_, err := r.w.Write(b)
+	return err
+}
+
+// Flush flushes the underlying writer if it's buffered, like a bufio.Writer.
+func (r *Reporter) Flush() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if flusher, ok := r.w.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+// Close flushes the underlying writer. It doesn't close it, since the
+// Reporter didn't open it.
+func (r *Reporter) Close() error {
+	return r.Flush()
+}
+
+// Encode encodes a single length-prefixed report, without the stream header.
+func Encode(timing time.Duration, ctx map[string]interface{}) []byte {
+	var body []byte
+	body = appendVarint(body, int64(timing))
+	body = appendUvarint(body, uint64(len(ctx)))
+	for key, value := range ctx {
+		id := fieldIDs[key]
+		body = appendUvarint(body, id)
+		if id == 0 {
+			body = appendString(body, key)
+		}
+		body = appendValue(body, value)
+	}
+	b := appendUvarint(make([]byte, 0, len(body)+binary.MaxVarintLen64), uint64(len(body)))
+	return append(b, body...)
+}
+
+func appendValue(b []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return append(b, typeBool, 1)
+		}
+		return append(b, typeBool, 0)
+	case int:
+		return appendVarint(append(b, typeInt), int64(v))
+	case int32:
+		return appendVarint(append(b, typeInt), int64(v))
+	case int64:
+		return appendVarint(append(b, typeInt), v)
+	case uint32:
+		return appendVarint(append(b, typeInt), int64(v))
+	case float32:
+		return appendFloat64(append(b, typeFloat), float64(v))
+	case float64:
+		return appendFloat64(append(b, typeFloat), v)
+	case string:
+		return appendString(append(b, typeString), v)
+	default:
+		return appendString(append(b, typeString), fmt.Sprint(v))
+	}
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func appendFloat64(b []byte, v float64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	return append(b, buf[:]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// Decoder reads reports written by a Reporter.
+type Decoder struct {
+	r          *bufio.Reader
+	readHeader bool
+}
+
+// NewDecoder creates a Decoder that reads from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next report. It returns io.EOF once there are no more
+// reports. Fields with IDs that this version doesn't know are named
+// "field_<id>".
+func (d *Decoder) Decode() (time.Duration, map[string]interface{}, error) {
+	if !d.readHeader {
+		header := make([]byte, len(magic)+1)
+		if _, err := io.ReadFull(d.r, header); err != nil {
+			return 0, nil, err
+		}
+		if !bytes.Equal(header[:len(magic)], magic) {
+			return 0, nil, fmt.Errorf("Not a binary report stream")
+		}
+		if header[len(magic)] != Version {
+			return 0, nil, fmt.Errorf("Unsupported version %d", header[len(magic)])
+		}
+		d.readHeader = true
+	}
+	size, err := binary.ReadUvarint(d.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if size > maxReportSize {
+		return 0, nil, fmt.Errorf("Report too large: %d bytes", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(d.r, body); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	return decodeBody(bytes.NewReader(body))
+}
+
+func decodeBody(r *bytes.Reader) (time.Duration, map[string]interface{}, error) {
+	timing, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if count > uint64(r.Len()) {
+		return 0, nil, fmt.Errorf("Invalid field count %d", count)
+	}
+	ctx := make(map[string]interface{}, count)
+	for i := uint64(0); i < count; i++ {
+		id, err := binary.ReadUvarint(r)
+		if err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+		var key string
+		switch {
+		case id == 0:
+			key, err = readString(r)
+			if err != nil {
+				return 0, nil, err
+			}
+		case id <= uint64(len(Fields)):
+			key = Fields[id-1]
+		default:
+			key = fmt.Sprintf("field_%d", id)
+		}
+		value, err := readValue(r)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Unable to decode value of %v: %v", key, err)
+		}
+		ctx[key] = value
+	}
+	return time.Duration(timing), ctx, nil
+}
+
+func readValue(r *bytes.Reader) (interface{}, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	switch typ {
+	case typeBool:
+		v, err := r.ReadByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return v != 0, nil
+	case typeInt:
+		v, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return v, nil
+	case typeFloat:
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case typeString:
+		return readString(r)
+	default:
+		return nil, fmt.Errorf("Unknown value type %d", typ)
+	}
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", unexpectedEOF(err)
+	}
+	if size > uint64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	b := make([]byte, size)
+	r.Read(b)
+	return string(b), nil
+}
+
+// unexpectedEOF converts io.EOF in the middle of a report into
+// io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package binreport
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewReporter(&buf)
+	r.Report(proxybench.NewResult(5*time.Second, map[string]interface{}{
+		"url":                "https://example.com",
+		"proxybench_success": true,
+		"tcp_rtt_us":         uint32(1500),
+		"queue_wait_time":    0.25,
+		"custom_field":       "custom",
+		"other":              time.Second,
+	}))
+	r.Report(proxybench.NewResult(0, map[string]interface{}{"run_healthy": false}))
+
+	d := NewDecoder(&buf)
+	timing, ctx, err := d.Decode()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 5*time.Second, timing)
+	assert.Equal(t, map[string]interface{}{
+		"url":                "https://example.com",
+		"proxybench_success": true,
+		"tcp_rtt_us":         int64(1500),
+		"queue_wait_time":    0.25,
+		"custom_field":       "custom",
+		"other":              "1s",
+	}, ctx)
+
+	timing, ctx, err = d.Decode()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, time.Duration(0), timing)
+	assert.Equal(t, map[string]interface{}{"run_healthy": false}, ctx)
+
+	_, _, err = d.Decode()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	_, _, err := NewDecoder(bytes.NewReader([]byte("JSON{}"))).Decode()
+	assert.Error(t, err, "should reject stream without magic")
+
+	_, _, err = NewDecoder(bytes.NewReader([]byte("PBR\x09"))).Decode()
+	assert.Error(t, err, "should reject unknown version")
+
+	b := append([]byte("PBR\x01"), Encode(time.Second, map[string]interface{}{"url": "https://example.com"})...)
+	_, _, err = NewDecoder(bytes.NewReader(b[:len(b)-3])).Decode()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestCompact(t *testing.T) {
+	ctx := map[string]interface{}{
+		"url":                "https://example.com",
+		"proxy_type":         "chained",
+		"proxy_protocol":     "https",
+		"proxybench_success": true,
+	}
+	js, _ := json.Marshal(ctx)
+	assert.True(t, len(Encode(time.Second, ctx)) < len(js)/2, "should be much smaller than JSON")
+}
@@ -0,0 +1,136 @@
+// Package bordareporter submits proxybench results to borda.
+package bordareporter
+
+import (
+	borda "github.com/getlantern/borda/client"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxybench"
+)
+
+const (
+	// DefaultName is the name under which measurements are submitted if no
+	// name is specified.
+	DefaultName = "proxybench"
+
+	// DefaultMaxBufferSize is the number of distinct dimension combinations
+	// buffered between batches if no maximum is specified.
+	DefaultMaxBufferSize = 1000
+)
+
+var (
+	log = golog.LoggerFor("proxybench.bordareporter")
+
+	// DefaultDimensions are the report fields submitted as dimensions if none
+	// are specified.
+	DefaultDimensions = []string{
+		"op",
+		"url",
+		"proxy_type",
+		"proxy_protocol",
+		"proxy_provider",
+		"proxy_datacenter",
+		"proxy_host",
+		"request_type",
+		"failure_reason",
+	}
+)
+
+// Opts configures a Reporter.
+type Opts struct {
+	// Client is the borda client used to submit measurements.
+	Client *borda.Client
+
+	// Name is the name under which measurements are submitted.
+	Name string
+
+	// Dimensions are the report fields submitted as dimensions. Fields that
+	// are missing from a report are omitted.
+	Dimensions []string
+
+	// ExtraDimensions are added to every measurement, for example to identify
+	// the application or its version.
+	ExtraDimensions map[string]interface{}
+
+	// MaxBufferSize is the number of distinct dimension combinations buffered
+	// between batches.
+	MaxBufferSize int
+}
+
+// Reporter submits each result to borda with the values success_count,
+// error_count and, for successes, response_time (in seconds). Summary
+// reports, which aren't results of individual requests, are skipped.
+type Reporter struct {
+	client          *borda.Client
+	submit          borda.Submitter
+	dimensions      []string
+	extraDimensions map[string]interface{}
+}
+
+// New creates a Reporter that submits to borda as configured by opts.
+func New(opts *Opts) *Reporter {
+	name := opts.Name
+	if name == "" {
+		name = DefaultName
+	}
+	maxBufferSize := opts.MaxBufferSize
+	if maxBufferSize <= 0 {
+		maxBufferSize = DefaultMaxBufferSize
+	}
+	r := newReporter(opts, opts.Client.ReducingSubmitter(name, maxBufferSize))
+	r.client = opts.Client
+	return r
+}
+
+func newReporter(opts *Opts, submit borda.Submitter) *Reporter {
+	dimensions := opts.Dimensions
+	if len(dimensions) == 0 {
+		dimensions = DefaultDimensions
+	}
+	return &Reporter{
+		submit:          submit,
+		dimensions:      dimensions,
+		extraDimensions: opts.ExtraDimensions,
+	}
+}
+
+// Report submits a result. It implements proxybench.Reporter.
+func (r *Reporter) Report(result proxybench.Result) {
+	if !result.IsRequest {
+		return
+	}
+	values := make(map[string]borda.Val, 3)
+	if result.Success {
+		values["success_count"] = borda.Sum(1)
+		values["error_count"] = borda.Sum(0)
+		values["response_time"] = borda.Avg(result.Timing.Seconds())
+	} else {
+		values["success_count"] = borda.Sum(0)
+		values["error_count"] = borda.Sum(1)
+	}
+	dims := make(map[string]interface{}, len(r.dimensions)+len(r.extraDimensions))
+	for key, value := range r.extraDimensions {
+		dims[key] = value
+	}
+	for _, key := range r.dimensions {
+		if value, found := result.Fields[key]; found {
+			dims[key] = value
+		}
+	}
+	if err := r.submit(values, dims); err != nil {
+		log.Debugf("Unable to submit result to borda: %v", err)
+	}
+}
+
+// Flush submits the measurements buffered by the borda client.
+func (r *Reporter) Flush() error {
+	if r.client != nil {
+		r.client.Flush()
+	}
+	return nil
+}
+
+// Close flushes the borda client. The client itself isn't closed, since it may
+// be shared with other users.
+func (r *Reporter) Close() error {
+	return r.Flush()
+}
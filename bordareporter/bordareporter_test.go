@@ -0,0 +1,51 @@
+package bordareporter
+
+import (
+	"testing"
+	"time"
+
+	borda "github.com/getlantern/borda/client"
+	"github.com/getlantern/proxybench"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter(t *testing.T) {
+	var values []map[string]borda.Val
+	var dims []map[string]interface{}
+	r := newReporter(&Opts{
+		Dimensions:      []string{"url", "proxy_host", "failure_reason"},
+		ExtraDimensions: map[string]interface{}{"app_version": "1.0"},
+	}, func(v map[string]borda.Val, d map[string]interface{}) error {
+		values = append(values, v)
+		dims = append(dims, d)
+		return nil
+	})
+
+	r.Report(proxybench.NewResult(time.Second, map[string]interface{}{
+		"url":                "https://a.com",
+		"proxy_host":         "1.2.3.4",
+		"proxy_provider":     "do",
+		"proxybench_success": true,
+	}))
+	r.Report(proxybench.NewResult(0, map[string]interface{}{
+		"url":                "https://a.com",
+		"proxybench_success": false,
+		"failure_reason":     "dial",
+	}))
+	r.Report(proxybench.NewResult(0, map[string]interface{}{"run_verdict": "healthy"}))
+
+	if !assert.Len(t, values, 2, "summary reports should be skipped") {
+		return
+	}
+	assert.Contains(t, values[0], "response_time")
+	assert.Contains(t, values[0], "success_count")
+	assert.NotContains(t, values[1], "response_time", "failures shouldn't skew response times")
+	assert.Contains(t, values[1], "error_count")
+	assert.Equal(t, map[string]interface{}{"url": "https://a.com", "proxy_host": "1.2.3.4", "app_version": "1.0"}, dims[0])
+	assert.Equal(t, map[string]interface{}{"url": "https://a.com", "failure_reason": "dial", "app_version": "1.0"}, dims[1])
+}
+
+func TestDefaultDimensions(t *testing.T) {
+	r := newReporter(&Opts{}, nil)
+	assert.Equal(t, DefaultDimensions, r.dimensions)
+}
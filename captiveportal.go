@@ -0,0 +1,55 @@
+package proxybench
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/ops"
+)
+
+const defaultCaptivePortalURL = "http://connectivitycheck.gstatic.com/generate_204"
+
+// detectCaptivePortal fetches opts.CaptivePortalURL directly and reports
+// whether it looks like we're behind a captive portal, meaning that we got
+// something other than the expected 204 No Content. If the check itself fails,
+// we can't tell, so it's not considered a captive portal.
+func (rn *run) detectCaptivePortal() bool {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// Portals typically redirect to their login page, which is what we
+			// want to see.
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest("GET", rn.opts.CaptivePortalURL, nil)
+	if err != nil {
+		log.Errorf("Unable to build captive portal check request: %v", err)
+		return false
+	}
+	resp, err := client.Do(req.WithContext(rn.ctx))
+	if err != nil {
+		log.Debugf("Unable to check for captive portal: %v", err)
+		return false
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode == http.StatusNoContent {
+		return false
+	}
+
+	log.Debugf("Captive portal detected, got %v from %v", resp.Status, rn.opts.CaptivePortalURL)
+	op := ops.Begin("proxybench").
+		Set("url", rn.opts.CaptivePortalURL).
+		Set("proxy_type", "direct").
+		Set("captive_portal_detected", true).
+		Set("captive_portal_status", resp.StatusCode)
+	rn.reporter()(0, ops.AsMap(op, true))
+	op.End()
+	return true
+}
@@ -0,0 +1,41 @@
+package proxybench
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectCaptivePortal(t *testing.T) {
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if status == http.StatusFound {
+			http.Redirect(resp, req, "/login", status)
+			return
+		}
+		resp.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	var reported map[string]interface{}
+	r := &Runner{ctx: context.Background()}
+	r.SetReporter(func(timing time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	})
+	rn := r.newRun(&Opts{CaptivePortalURL: srv.URL}, false)
+
+	assert.False(t, rn.detectCaptivePortal())
+	assert.Nil(t, reported)
+
+	status = http.StatusFound
+	assert.True(t, rn.detectCaptivePortal(), "redirect to login page should be detected")
+	assert.Equal(t, true, reported["captive_portal_detected"])
+	assert.Equal(t, http.StatusFound, reported["captive_portal_status"])
+
+	srv.Close()
+	assert.False(t, rn.detectCaptivePortal(), "failed check shouldn't be considered a captive portal")
+}
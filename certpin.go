@@ -0,0 +1,61 @@
+package proxybench
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+)
+
+// verifyPeerCertificate checks the certificate presented by the proxy against
+// its configured Cert or CertPin, if any, for use as
+// tls.Config.VerifyPeerCertificate. The usual chain verification is skipped,
+// since proxies typically use self-signed certificates.
+func (p *proxy) verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if p.Cert == "" && p.CertPin == "" {
+		return nil
+	}
+	if len(rawCerts) > 0 && (p.certMatches(rawCerts[0]) || p.pinMatches(rawCerts[0])) {
+		return nil
+	}
+	p.mx.Lock()
+	p.certRejected = true
+	p.mx.Unlock()
+	return fmt.Errorf("Certificate presented by %v doesn't match the expected certificate", p.addr)
+}
+
+func (p *proxy) certMatches(leaf []byte) bool {
+	if p.Cert == "" {
+		return false
+	}
+	block, _ := pem.Decode([]byte(p.Cert))
+	return block != nil && bytes.Equal(block.Bytes, leaf)
+}
+
+func (p *proxy) pinMatches(leaf []byte) bool {
+	if p.CertPin == "" {
+		return false
+	}
+	cert, err := x509.ParseCertificate(leaf)
+	if err != nil {
+		return false
+	}
+	return certPin(cert) == p.CertPin
+}
+
+// certPin returns the base64-encoded SHA-256 hash of the certificate's
+// SubjectPublicKeyInfo.
+func certPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// certVerificationFailed returns whether the proxy presented a certificate
+// that didn't match the expected one.
+func (p *proxy) certVerificationFailed() bool {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.certRejected
+}
@@ -0,0 +1,39 @@
+package proxybench
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertPinning(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	cert := srv.Certificate()
+	addr := srv.Listener.Addr().String()
+
+	dial := func(p *Proxy) (*proxy, error) {
+		proxy := p.withProtocol("https")
+		conn, err := proxy.dial(context.Background(), &Opts{})
+		if err == nil {
+			conn.Close()
+		}
+		return proxy, err
+	}
+
+	proxy, err := dial(&Proxy{Addrs: map[string]string{"https": addr}, CertPin: certPin(cert)})
+	assert.NoError(t, err, "matching pin should be accepted")
+	assert.False(t, proxy.certVerificationFailed())
+
+	_, err = dial(&Proxy{Addrs: map[string]string{"https": addr}, Cert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))})
+	assert.NoError(t, err, "matching certificate should be accepted")
+
+	proxy, err = dial(&Proxy{Addrs: map[string]string{"https": addr}, CertPin: "bm90IHRoZSByaWdodCBwaW4="})
+	assert.Error(t, err, "mismatched pin should be rejected")
+	assert.True(t, proxy.certVerificationFailed())
+	assert.Equal(t, failurePhaseHandshake, proxy.dialFailurePhase())
+}
@@ -0,0 +1,183 @@
+// Command proxybench runs the proxybench benchmarking loop and writes the
+// results to stdout or a file.
+//
+// Usage:
+//
+//	proxybench -config proxybench.json -format csv -output results.csv
+//
+// The config file contains Opts as JSON, YAML or TOML (see
+// proxybench.LoadOpts). Without one, Opts are fetched from the -update-url (or
+// the default UpdateURL). Benchmarks run until interrupted.
+//
+// With -once, every proxy is benchmarked against every URL exactly once and a
+// table of the results, ranked from fastest to slowest with failures last, is
+// printed to stdout.
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxybench"
+	"github.com/getlantern/proxybench/csvreporter"
+	"github.com/getlantern/proxybench/jsonlreporter"
+)
+
+var (
+	config     = flag.String("config", "", "JSON, YAML or TOML file containing the proxybench Opts")
+	updateURL  = flag.String("update-url", "", "URL from which to fetch (updated) Opts, overriding the one in the config")
+	updateKey  = flag.String("update-key", "", "Base64 Ed25519 public key with which fetched Opts must be signed")
+	format     = flag.String("format", "jsonl", "Format of the results, jsonl or csv")
+	output     = flag.String("output", "-", "File to which to append results, - for stdout")
+	statusAddr = flag.String("status", "", "Address (like 127.0.0.1:7070) on which to serve status")
+	dashboard  = flag.Bool("dashboard", false, "Serve a web dashboard on the status address")
+	once       = flag.Bool("once", false, "Benchmark each proxy and URL once and print a ranked table of the results")
+
+	updateHeaders headerFlag
+
+	log = golog.LoggerFor("proxybench.cmd")
+)
+
+func init() {
+	flag.Var(&updateHeaders, "update-header", "Header (like \"Authorization: Bearer token\") to send when fetching Opts, may be repeated")
+}
+
+func main() {
+	flag.Parse()
+	// Keep logs out of the results on stdout
+	golog.SetOutputs(os.Stderr, os.Stderr)
+
+	opts, err := loadOpts()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *once {
+		os.Exit(runOnce(opts))
+	}
+	rep, err := newReporter()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Debugf("Stopping on %v", sig)
+		cancel()
+	}()
+
+	r := proxybench.StartWithReporter(ctx, opts, rep)
+	<-ctx.Done()
+	// Stop closes the reporter
+	r.Stop()
+}
+
+// loadOpts loads the Opts from the -config file, if any, and applies the
+// flags.
+func loadOpts() (*proxybench.Opts, error) {
+	opts := &proxybench.Opts{}
+	if *config != "" {
+		var err error
+		if opts, err = proxybench.LoadOpts(*config); err != nil {
+			return nil, err
+		}
+	}
+	if *updateURL != "" {
+		opts.UpdateURL = *updateURL
+	}
+	if *updateKey != "" {
+		key, err := base64.StdEncoding.DecodeString(*updateKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("Invalid update key %v", *updateKey)
+		}
+		opts.UpdatePublicKey = ed25519.PublicKey(key)
+	}
+	if len(updateHeaders) > 0 {
+		opts.UpdateHeader = http.Header(updateHeaders)
+	}
+	// Unlike when embedded, benchmark every period by default, including
+	// after fetching updated Opts
+	opts.DefaultSampleRate = 1
+	opts.StatusAddr = *statusAddr
+	opts.StatusDashboard = *dashboard
+	return opts, nil
+}
+
+// headerFlag collects repeated "Name: value" flags into headers.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var headers []string
+	for key, values := range h {
+		for _, value := range values {
+			headers = append(headers, key+": "+value)
+		}
+	}
+	return strings.Join(headers, ", ")
+}
+
+func (h *headerFlag) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("Invalid header %v, expected Name: value", value)
+	}
+	if *h == nil {
+		*h = make(headerFlag)
+	}
+	http.Header(*h).Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
+
+// newReporter creates the Reporter for the -format and -output.
+func newReporter() (proxybench.Reporter, error) {
+	switch *format {
+	case "jsonl":
+		if *output == "-" {
+			return newStdoutReporter(), nil
+		}
+		return jsonlreporter.New(&jsonlreporter.Opts{Path: *output})
+	case "csv":
+		if *output == "-" {
+			return csvreporter.New(os.Stdout)
+		}
+		return csvreporter.Open(*output)
+	default:
+		return nil, fmt.Errorf("Unknown format %v", *format)
+	}
+}
+
+// newStdoutReporter writes results to stdout as JSON lines in the same format
+// as jsonlreporter.
+func newStdoutReporter() proxybench.Reporter {
+	var mx sync.Mutex
+	enc := json.NewEncoder(os.Stdout)
+	return proxybench.ReportFN(func(timing time.Duration, ctx map[string]interface{}) {
+		entry := make(map[string]interface{}, len(ctx)+2)
+		for key, value := range ctx {
+			entry[key] = value
+		}
+		entry["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
+		entry["timing"] = timing.Seconds()
+		mx.Lock()
+		defer mx.Unlock()
+		if err := enc.Encode(entry); err != nil {
+			log.Errorf("Unable to write result: %v", err)
+		}
+	})
+}
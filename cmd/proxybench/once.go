@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/getlantern/proxybench"
+)
+
+// maxStatusLength bounds the length of errors shown in the table.
+const maxStatusLength = 80
+
+// runOnce benchmarks every proxy once, prints the ranked results and returns
+// the exit code: 0 if any request succeeded, 1 otherwise.
+func runOnce(opts *proxybench.Opts) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if len(opts.Proxies) == 0 {
+		// RunOnce doesn't fetch updated Opts itself
+		fetched, err := opts.FetchUpdate(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		opts = fetched
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	results, err := proxybench.RunOnceContext(ctx, opts)
+	if err != nil && len(results) == 0 {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	printTable(os.Stdout, results)
+	for _, result := range results {
+		if result.Error == nil {
+			return 0
+		}
+	}
+	return 1
+}
+
+// printTable writes the results as a table ranked from fastest to slowest,
+// with failures last.
+func printTable(w io.Writer, results []proxybench.Result) {
+	sorted := append([]proxybench.Result(nil), results...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if (a.Error == nil) != (b.Error == nil) {
+			return a.Error == nil
+		}
+		if a.Timing != b.Timing {
+			return a.Timing < b.Timing
+		}
+		return proxyName(a) < proxyName(b)
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RANK\tPROXY\tPROTOCOL\tURL\tLATENCY\tSTATUS")
+	for i, result := range sorted {
+		latency := "-"
+		if result.Timing > 0 {
+			latency = result.Timing.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(tw, "%d\t%v\t%v\t%v\t%v\t%v\n", i+1, proxyName(result), result.Protocol, result.URL, latency, status(result))
+	}
+	tw.Flush()
+}
+
+func proxyName(result proxybench.Result) string {
+	if result.Proxy == nil {
+		return ""
+	}
+	return result.Proxy.Addrs[result.Protocol]
+}
+
+func status(result proxybench.Result) string {
+	if result.Error == nil {
+		return "ok"
+	}
+	msg := strings.Replace(result.Error.Error(), "\n", " ", -1)
+	if len(msg) > maxStatusLength {
+		msg = msg[:maxStatusLength-3] + "..."
+	}
+	return "error: " + msg
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintTable(t *testing.T) {
+	proxy := func(addr string) *proxybench.Proxy {
+		return &proxybench.Proxy{Addrs: map[string]string{"https": addr}}
+	}
+	var buf bytes.Buffer
+	printTable(&buf, []proxybench.Result{
+		{URL: "https://a.com", Proxy: proxy("1.1.1.1:443"), Protocol: "https", Error: errors.New("dial tcp: connection refused")},
+		{URL: "https://a.com", Proxy: proxy("2.2.2.2:443"), Protocol: "https", Timing: 300 * time.Millisecond},
+		{URL: "https://a.com", Proxy: proxy("4.4.4.4:443"), Protocol: "https", Timing: 120 * time.Millisecond},
+	})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 4) {
+		assert.Regexp(t, `^RANK\s+PROXY\s+PROTOCOL\s+URL\s+LATENCY\s+STATUS$`, lines[0])
+		assert.Regexp(t, `^1\s+4\.4\.4\.4:443\s+https\s+https://a\.com\s+120ms\s+ok$`, lines[1])
+		assert.Regexp(t, `^2\s+2\.2\.2\.2:443\s+.*300ms\s+ok$`, lines[2])
+		assert.Regexp(t, `^3\s+1\.1\.1\.1:443\s+.*error: dial tcp: connection refused$`, lines[3])
+	}
+}
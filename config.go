@@ -0,0 +1,62 @@
+package proxybench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// LoadOpts loads Opts from a local config file. The format is determined by
+// the file's extension: .json, .yaml (or .yml) or .toml. Whatever the format,
+// the keys are the same as in JSON, for example:
+//
+//	sampleRate: 1
+//	period: 1h
+//	proxies:
+//	  - addrs:
+//	      https: 1.2.3.4:443
+//
+// Durations must be strings like "30s" or "1h", not bare numbers, even in YAML
+// and TOML. Defaults are applied when the Opts are used, like with Opts fetched
+// from the UpdateURL.
+func LoadOpts(path string) (*Opts, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read config %v: %v", path, err)
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".json" {
+		// Convert to JSON so that the JSON field names (and custom parsing)
+		// apply regardless of format.
+		var generic map[string]interface{}
+		switch ext {
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(b, &generic)
+		case ".toml":
+			err = toml.Unmarshal(b, &generic)
+		default:
+			return nil, fmt.Errorf("Unknown config format %v, expected .json, .yaml or .toml", ext)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse config %v: %v", path, err)
+		}
+		if b, err = json.Marshal(generic); err != nil {
+			return nil, fmt.Errorf("Unable to convert config %v: %v", path, err)
+		}
+	}
+	opts := &Opts{}
+	if err := json.Unmarshal(b, opts); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok && typeErr.Type.Kind() == reflect.String && strings.HasPrefix(typeErr.Value, "number") {
+			// Most likely a duration without a unit
+			return nil, fmt.Errorf("Unable to parse config %v: %v must be a string, like \"30s\" for durations", path, typeErr.Field)
+		}
+		return nil, fmt.Errorf("Unable to parse config %v: %v", path, err)
+	}
+	return opts, nil
+}
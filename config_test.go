@@ -0,0 +1,79 @@
+package proxybench
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadOpts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxybench")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	configs := map[string]string{
+		"opts.json": `{
+  "sampleRate": 0.5,
+  "period": "2h",
+  "urls": ["https://a.com"],
+  "proxies": [{"addrs": {"https": "1.2.3.4:443"}, "provider": "do"}]
+}`,
+		"opts.yaml": `
+# Comments are what makes this easier to maintain
+sampleRate: 0.5
+period: 2h
+urls:
+  - https://a.com
+proxies:
+  - addrs:
+      https: 1.2.3.4:443
+    provider: do
+`,
+		"opts.toml": `
+# Comments are what makes this easier to maintain
+sampleRate = 0.5
+period = "2h"
+urls = ["https://a.com"]
+
+[[proxies]]
+provider = "do"
+[proxies.addrs]
+https = "1.2.3.4:443"
+`,
+	}
+	for name, config := range configs {
+		path := filepath.Join(dir, name)
+		if !assert.NoError(t, ioutil.WriteFile(path, []byte(config), 0644)) {
+			continue
+		}
+		opts, err := LoadOpts(path)
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		assert.Equal(t, 0.5, opts.SampleRate, name)
+		assert.Equal(t, "2h", opts.PeriodString, name)
+		assert.Equal(t, []string{"https://a.com"}, opts.URLs, name)
+		if assert.Len(t, opts.Proxies, 1, name) {
+			assert.Equal(t, "1.2.3.4:443", opts.Proxies[0].Addrs["https"], name)
+			assert.Equal(t, "do", opts.Proxies[0].Provider, name)
+		}
+	}
+
+	_, err = LoadOpts(filepath.Join(dir, "opts.ini"))
+	assert.Error(t, err)
+	path := filepath.Join(dir, "bad.yaml")
+	ioutil.WriteFile(path, []byte("sampleRate: ["), 0644)
+	_, err = LoadOpts(path)
+	assert.Error(t, err)
+
+	ioutil.WriteFile(path, []byte("period: 30"), 0644)
+	_, err = LoadOpts(path)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `period must be a string, like "30s" for durations`)
+	}
+}
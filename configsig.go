@@ -0,0 +1,44 @@
+package proxybench
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+)
+
+// updateSignatureSuffix is appended to the UpdateURL to get the URL of the
+// signature of the Opts.
+const updateSignatureSuffix = ".sig"
+
+// maxUpdateSignatureSize is the largest signature that we're willing to fetch,
+// with plenty of room for a base64 encoded Ed25519 signature.
+const maxUpdateSignatureSize = 1024
+
+// verifyUpdate verifies that body, fetched from the UpdateURL, is signed with
+// the UpdatePublicKey.
+func (opts *Opts) verifyUpdate(ctx context.Context, body []byte) error {
+	if len(opts.UpdatePublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("Invalid update public key of %d bytes", len(opts.UpdatePublicKey))
+	}
+	encoded, _, err := opts.fetch(ctx, opts.UpdateURL+updateSignatureSuffix, updateValidators{}, maxUpdateSignatureSize)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch signature of updated Opts: %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(encoded)))
+	if err != nil {
+		return fmt.Errorf("Unable to decode signature of updated Opts: %v", err)
+	}
+	if !ed25519.Verify(opts.UpdatePublicKey, body, sig) {
+		return fmt.Errorf("Updated Opts from %v are not correctly signed", opts.UpdateURL)
+	}
+	return nil
+}
+
+// SignOpts signs the JSON serialization of Opts with the given Ed25519
+// private key, returning the signature in the form expected at the UpdateURL
+// with ".sig" appended. See Opts.UpdatePublicKey.
+func SignOpts(optsJSON []byte, privateKey ed25519.PrivateKey) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, optsJSON)))
+}
@@ -0,0 +1,95 @@
+package proxybench
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignedUpdate(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var mx sync.Mutex
+	var body, sig []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		switch req.URL.Path {
+		case "/opts.json":
+			resp.Write(body)
+		case "/opts.json.sig":
+			if sig == nil {
+				http.NotFound(resp, req)
+				return
+			}
+			resp.Write(sig)
+		default:
+			http.NotFound(resp, req)
+		}
+	}))
+	defer srv.Close()
+	updateURL := srv.URL + "/opts.json"
+	body = []byte(`{"period": "2h", "updateURL": "` + updateURL + `"}`)
+	sig = SignOpts(body, privateKey)
+
+	opts := &Opts{UpdateURL: updateURL, UpdatePublicKey: publicKey}
+	opts.applyDefaults()
+	r := &Runner{ctx: context.Background(), stats: newStats(), opts: opts}
+	changed, err := r.RefreshConfig()
+	assert.NoError(t, err)
+	assert.True(t, changed, "correctly signed config should be applied")
+	assert.Equal(t, 2*time.Hour, r.currentOpts().Period)
+	assert.Equal(t, publicKey, r.currentOpts().UpdatePublicKey, "public key should be carried over")
+
+	mx.Lock()
+	body = []byte(`{"period": "3h", "updateURL": "` + updateURL + `", "urls": ["https://attacker.com"]}`)
+	mx.Unlock()
+	changed, err = r.RefreshConfig()
+	assert.Error(t, err)
+	assert.False(t, changed, "tampered config should be rejected")
+	assert.Equal(t, 2*time.Hour, r.currentOpts().Period)
+
+	mx.Lock()
+	sig = nil
+	mx.Unlock()
+	changed, err = r.RefreshConfig()
+	assert.Error(t, err)
+	assert.False(t, changed, "unsigned config should be rejected")
+
+	mx.Lock()
+	sig = SignOpts(body, privateKey)
+	mx.Unlock()
+	changed, err = r.RefreshConfig()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, 3*time.Hour, r.currentOpts().Period)
+
+	mx.Lock()
+	body = []byte(`{"period": "4h", "updateURL": "` + updateURL + `"}`)
+	// A valid signature padded with whitespace beyond the size limit
+	sig = append(SignOpts(body, privateKey), bytes.Repeat([]byte(" "), maxUpdateSignatureSize)...)
+	mx.Unlock()
+	changed, err = r.RefreshConfig()
+	assert.Error(t, err, "oversized signature should be rejected")
+	assert.False(t, changed)
+
+	mx.Lock()
+	body = append(body, bytes.Repeat([]byte(" "), maxUpdateSize)...)
+	sig = SignOpts(body, privateKey)
+	mx.Unlock()
+	changed, err = r.RefreshConfig()
+	assert.Error(t, err, "oversized config should be rejected")
+	assert.False(t, changed)
+	assert.Equal(t, 3*time.Hour, r.currentOpts().Period)
+}
@@ -0,0 +1,135 @@
+// Package csvreporter writes proxybench results as CSV for post-processing in
+// spreadsheets or tools like pandas.
+package csvreporter
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxybench"
+)
+
+var (
+	log = golog.LoggerFor("proxybench.csvreporter")
+
+	// Columns are the columns of every row, in order. Columns are only ever
+	// appended so that existing consumers keep working.
+	Columns = []string{"timestamp", "proxy", "protocol", "provider", "datacenter", "url", "duration", "error"}
+)
+
+// Reporter writes one row per result with the columns listed in Columns. The
+// timestamp is in RFC 3339 format, the duration is in seconds and is 0 for
+// failures, and the error is empty for successes. Summary reports, which
+// aren't results of individual requests, are skipped.
+type Reporter struct {
+	w      *csv.Writer
+	closer io.Closer
+	mx     sync.Mutex
+}
+
+// New creates a Reporter that writes a header row followed by results to w.
+func New(w io.Writer) (*Reporter, error) {
+	r := &Reporter{w: csv.NewWriter(w)}
+	if err := r.writeRow(Columns); err != nil {
+		return nil, fmt.Errorf("Unable to write header: %v", err)
+	}
+	return r, nil
+}
+
+// Open creates a Reporter that appends results to the file at path, creating
+// it if necessary. The header row is only written if the file is empty.
+func Open(path string) (*Reporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %v: %v", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to stat %v: %v", path, err)
+	}
+	r := &Reporter{w: csv.NewWriter(file), closer: file}
+	if info.Size() == 0 {
+		if err := r.writeRow(Columns); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Unable to write header to %v: %v", path, err)
+		}
+	}
+	return r, nil
+}
+
+// Report writes a result as a row. It implements proxybench.Reporter.
+func (r *Reporter) Report(result proxybench.Result) {
+	if !result.IsRequest {
+		return
+	}
+	ctx := result.Fields
+	var errorText string
+	if !result.Success {
+		errorText = field(ctx, "failure_error")
+		if errorText == "" {
+			errorText = field(ctx, "failure_reason")
+		}
+	}
+	proxy := field(ctx, "proxy_host")
+	if port := field(ctx, "proxy_port"); proxy != "" && port != "" {
+		proxy = net.JoinHostPort(proxy, port)
+	}
+	row := []string{
+		result.Time.UTC().Format(time.RFC3339Nano),
+		proxy,
+		field(ctx, "proxy_protocol"),
+		field(ctx, "proxy_provider"),
+		field(ctx, "proxy_datacenter"),
+		field(ctx, "url"),
+		strconv.FormatFloat(result.Timing.Seconds(), 'f', -1, 64),
+		errorText,
+	}
+	if err := r.writeRow(row); err != nil {
+		log.Errorf("Unable to write result: %v", err)
+	}
+}
+
+// Flush implements proxybench.Reporter. Every row is flushed as it's written,
+// so there's nothing left to flush.
+func (r *Reporter) Flush() error {
+	return nil
+}
+
+// Close closes the underlying file if the Reporter was created with Open.
+func (r *Reporter) Close() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.closer == nil {
+		return nil
+	}
+	err := r.closer.Close()
+	r.closer = nil
+	return err
+}
+
+func (r *Reporter) writeRow(row []string) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if err := r.w.Write(row); err != nil {
+		return err
+	}
+	// Flush every row so that results are available even if the process dies
+	r.w.Flush()
+	return r.w.Error()
+}
+
+func field(ctx map[string]interface{}, key string) string {
+	value, found := ctx[key]
+	if !found || value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,79 @@
+package csvreporter
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter(t *testing.T) {
+	var buf bytes.Buffer
+	r, err := New(&buf)
+	if !assert.NoError(t, err) {
+		return
+	}
+	r.Report(proxybench.NewResult(250*time.Millisecond, map[string]interface{}{
+		"url":                "https://a.com",
+		"proxy_host":         "1.2.3.4",
+		"proxy_port":         "443",
+		"proxy_protocol":     "https",
+		"proxy_provider":     "do",
+		"proxy_datacenter":   "ams3",
+		"proxybench_success": true,
+	}))
+	r.Report(proxybench.NewResult(0, map[string]interface{}{
+		"url":                "https://b.com",
+		"proxy_host":         "1.2.3.4",
+		"proxy_port":         "443",
+		"proxybench_success": false,
+		"failure_reason":     "timeout",
+		"failure_error":      "i/o timeout, giving up",
+	}))
+	r.Report(proxybench.NewResult(0, map[string]interface{}{"run_verdict": "healthy"}))
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if !assert.NoError(t, err) || !assert.Len(t, rows, 3, "summary reports should be skipped") {
+		return
+	}
+	assert.Equal(t, Columns, rows[0])
+	_, err = time.Parse(time.RFC3339Nano, rows[1][0])
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1.2.3.4:443", "https", "do", "ams3", "https://a.com", "0.25", ""}, rows[1][1:])
+	assert.Equal(t, []string{"1.2.3.4:443", "", "", "", "https://b.com", "0", "i/o timeout, giving up"}, rows[2][1:])
+}
+
+func TestOpenWritesHeaderOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csvreporter")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "results.csv")
+
+	for i := 0; i < 2; i++ {
+		r, err := Open(path)
+		if !assert.NoError(t, err) {
+			return
+		}
+		r.Report(proxybench.NewResult(time.Second, map[string]interface{}{"url": "https://a.com", "proxybench_success": true}))
+		assert.NoError(t, r.Close())
+	}
+
+	f, err := os.Open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if assert.NoError(t, err) && assert.Len(t, rows, 3) {
+		assert.Equal(t, Columns, rows[0])
+		assert.Equal(t, "https://a.com", rows[2][5])
+	}
+}
@@ -0,0 +1,129 @@
+package proxybench
+
+// dashboardHTML is the single-page dashboard served with
+// Opts.StatusDashboard. It polls /proxybench/status and /proxybench/history
+// and has no external dependencies, so that it works offline.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>proxybench</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+th, td { padding: 4px 8px; border-bottom: 1px solid #ddd; text-align: left; white-space: nowrap; }
+th { cursor: pointer; user-select: none; background: #f4f4f4; }
+th.asc:after { content: " \25B2"; }
+th.desc:after { content: " \25BC"; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+tr.failing td { background: #fdecea; }
+#summary { margin-bottom: 1em; color: #555; }
+svg polyline { fill: none; stroke: #3366cc; stroke-width: 1.5; }
+svg circle { fill: #cc3333; }
+</style>
+</head>
+<body>
+<h1>proxybench</h1>
+<div id="summary">Loading...</div>
+<table>
+<thead><tr>
+<th data-key="proxy">Proxy</th>
+<th data-key="protocol">Protocol</th>
+<th data-key="provider">Provider</th>
+<th data-key="dataCenter">Data center</th>
+<th data-key="lastLatency" class="num">Last latency (ms)</th>
+<th data-key="latencyEMA" class="num">Latency EMA (ms)</th>
+<th data-key="successes" class="num">Successes</th>
+<th data-key="failures" class="num">Failures</th>
+<th data-key="successRate" class="num">Success rate</th>
+<th>History</th>
+</tr></thead>
+<tbody id="rows"></tbody>
+</table>
+<script>
+var sortKey = "proxy", sortAsc = true, rows = [], histories = {};
+
+function ms(seconds) { return seconds ? (seconds * 1000).toFixed(0) : ""; }
+
+function esc(s) {
+  return String(s).replace(/[&<>"]/g, function(c) {
+    return {"&": "&amp;", "<": "&lt;", ">": "&gt;", "\"": "&quot;"}[c];
+  });
+}
+
+function sparkline(points) {
+  var w = 120, h = 24;
+  if (!points || !points.length) { return ""; }
+  var max = 0;
+  points.forEach(function(p) { if (p.latency > max) { max = p.latency; } });
+  var step = points.length > 1 ? w / (points.length - 1) : 0;
+  var line = [], fails = "";
+  points.forEach(function(p, i) {
+    var x = (i * step).toFixed(1);
+    if (p.success) {
+      var y = max ? (h - 2 - (p.latency / max) * (h - 4)).toFixed(1) : h / 2;
+      line.push(x + "," + y);
+    } else {
+      fails += "<circle cx=\"" + x + "\" cy=\"" + (h - 2) + "\" r=\"2\"></circle>";
+    }
+  });
+  return "<svg width=\"" + w + "\" height=\"" + h + "\"><polyline points=\"" + line.join(" ") + "\"></polyline>" + fails + "</svg>";
+}
+
+function render() {
+  rows.sort(function(a, b) {
+    var x = a[sortKey], y = b[sortKey];
+    var c = x < y ? -1 : x > y ? 1 : 0;
+    return sortAsc ? c : -c;
+  });
+  var html = "";
+  rows.forEach(function(r) {
+    html += "<tr" + (r.successRate < 0.5 ? " class=\"failing\"" : "") + ">" +
+      "<td>" + esc(r.proxy) + "</td><td>" + esc(r.protocol) + "</td>" +
+      "<td>" + esc(r.provider) + "</td><td>" + esc(r.dataCenter) + "</td>" +
+      "<td class=\"num\">" + ms(r.lastLatency) + "</td><td class=\"num\">" + ms(r.latencyEMA) + "</td>" +
+      "<td class=\"num\">" + r.successes + "</td><td class=\"num\">" + r.failures + "</td>" +
+      "<td class=\"num\">" + (r.successRate * 100).toFixed(1) + "%</td>" +
+      "<td>" + sparkline(histories[r.proxy + "|" + r.protocol]) + "</td></tr>";
+  });
+  document.getElementById("rows").innerHTML = html;
+  document.querySelectorAll("th[data-key]").forEach(function(th) {
+    th.classList.remove("asc", "desc");
+    if (th.dataset.key === sortKey) { th.classList.add(sortAsc ? "asc" : "desc"); }
+  });
+}
+
+function refresh() {
+  Promise.all([
+    fetch("status").then(function(resp) { return resp.json(); }),
+    fetch("history").then(function(resp) { return resp.json(); })
+  ]).then(function(results) {
+    var status = results[0];
+    histories = {};
+    results[1].forEach(function(h) { histories[h.proxy + "|" + h.protocol] = h.points; });
+    rows = (status.proxies || []).map(function(e) {
+      var total = e.successes + e.failures;
+      e.successRate = total ? e.successes / total : 0;
+      return e;
+    });
+    document.getElementById("summary").textContent = status.lastRunFinished ?
+      "Last run " + status.lastRunID + " finished " + new Date(status.lastRunFinished).toLocaleString() +
+      (status.lastRunCancelled ? " (cancelled)" : "") : "No completed runs yet";
+    render();
+  }).catch(function(err) {
+    document.getElementById("summary").textContent = "Unable to load status: " + err;
+  });
+}
+
+document.querySelectorAll("th[data-key]").forEach(function(th) {
+  th.addEventListener("click", function() {
+    if (sortKey === th.dataset.key) { sortAsc = !sortAsc; } else { sortKey = th.dataset.key; sortAsc = true; }
+    render();
+  });
+});
+refresh();
+setInterval(refresh, 10000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,110 @@
+package proxybench
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/getlantern/netx"
+	"github.com/getlantern/ops"
+)
+
+// perIPDialTimeout bounds each connection attempt when a proxy host resolves
+// to multiple IPs, so that one unreachable IP doesn't stop us from trying the
+// rest.
+const perIPDialTimeout = 10 * time.Second
+
+// dialAttempt records an attempt to connect to one of a proxy's IPs.
+type dialAttempt struct {
+	ip      string
+	elapsed time.Duration
+	err     error
+}
+
+// dialEachIP resolves the host in addr and tries to connect to each of its IPs
+// in turn until one succeeds, recording every attempt.
+func (p *proxy) dialEachIP(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := resolveIPs(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range ips {
+		ipAddr := net.JoinHostPort(ip, port)
+		start := time.Now()
+		dialCtx := ctx
+		if len(ips) > 1 {
+			var cancel context.CancelFunc
+			dialCtx, cancel = context.WithTimeout(ctx, perIPDialTimeout)
+			defer cancel()
+		}
+		conn, err := netx.DialContext(dialCtx, network, ipAddr)
+		attempt := dialAttempt{ip: ip, elapsed: time.Since(start), err: err}
+		p.mx.Lock()
+		p.dialAttempts = append(p.dialAttempts, attempt)
+		p.mx.Unlock()
+		if err == nil {
+			return conn, nil
+		}
+		log.Debugf("Unable to connect to %v at %v after %v: %v", addr, attempt.ip, attempt.elapsed, err)
+		lastErr = err
+		if ctx.Err() != nil {
+			// No point trying the rest
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// resolveIPs returns the IPs to try for the host in addr. The first is the one
+// netx resolves it to, like for any other dial, so that a resolver configured
+// with netx takes precedence. Any other IPs of the host follow.
+func resolveIPs(ctx context.Context, network, addr string) ([]string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	resolved, err := netx.Resolve(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	ips := []string{resolved.IP.String()}
+	others, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		log.Debugf("Unable to look up other IPs of %v: %v", host, err)
+		return ips, nil
+	}
+	for _, other := range others {
+		if ip := other.IP.String(); ip != ips[0] {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// setDialAttempts summarizes the attempts to connect to the proxy's IPs on
+// the given op.
+func (p *proxy) setDialAttempts(op ops.Op) {
+	p.mx.Lock()
+	attempts := p.dialAttempts
+	p.mx.Unlock()
+	if len(attempts) == 0 {
+		return
+	}
+	ips := make([]string, 0, len(attempts))
+	for _, attempt := range attempts {
+		ips = append(ips, attempt.ip)
+		if attempt.err == nil {
+			op.Set("connected_ip", attempt.ip)
+		}
+	}
+	op.Set("attempted_ips", strings.Join(ips, ","))
+}
@@ -0,0 +1,63 @@
+package proxybench
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/getlantern/netx"
+	"github.com/getlantern/ops"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialAttempts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	p := (&Proxy{Addrs: map[string]string{"https": l.Addr().String()}}).withProtocol("https")
+	conn, err := p.dialTCP(context.Background(), "tcp", p.addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Close()
+
+	op := ops.Begin("test")
+	defer op.End()
+	p.setDialAttempts(op)
+	ctx := ops.AsMap(op, false)
+	assert.Equal(t, "127.0.0.1", ctx["attempted_ips"])
+	assert.Equal(t, "127.0.0.1", ctx["connected_ip"])
+}
+
+func TestDialAttemptsCancelled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p := (&Proxy{Addrs: map[string]string{"https": "localhost:" + port}}).withProtocol("https")
+	_, err = p.dialTCP(ctx, "tcp", p.addr)
+	assert.Error(t, err, "dialing should stop once the context is done")
+}
+
+func TestResolveIPs(t *testing.T) {
+	resolved, err := netx.Resolve("tcp", "localhost:80")
+	if !assert.NoError(t, err) {
+		return
+	}
+	ips, err := resolveIPs(context.Background(), "tcp", "localhost:80")
+	if assert.NoError(t, err) && assert.NotEmpty(t, ips) {
+		assert.Equal(t, resolved.IP.String(), ips[0], "netx resolution should come first")
+	}
+
+	ips, err = resolveIPs(context.Background(), "tcp", "127.0.0.2:80")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.2"}, ips)
+}
@@ -0,0 +1,119 @@
+package proxybench
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/getlantern/ops"
+)
+
+const (
+	defaultDoHURL       = "https://cloudflare-dns.com/dns-query"
+	defaultDoHQueryName = "example.com"
+
+	dnsMessageType = "application/dns-message"
+	maxDNSResponse = 65535
+)
+
+// benchDoH resolves opts.DoHQueryName using DNS-over-HTTPS against
+// opts.DoHURL through the given proxy, reporting (and returning) how long
+// resolution took.
+func (rn *run) benchDoH(proxy *proxy) (time.Duration, error) {
+	opts := rn.opts
+	rn.pacer.wait(rn.ctx, opts, opts.DoHURL)
+	proxyFN, done, err := proxyFunc(rn.ctx, opts, rn.reporter(), opts.DoHURL, proxy)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	op := beginOp(opts, opts.DoHURL, proxy).
+		Set("request_type", "doh").
+		Set("doh_query_name", opts.DoHQueryName)
+	defer op.End()
+
+	client := &http.Client{
+		Timeout: proxy.requestTimeout(opts),
+		Transport: &http.Transport{
+			Proxy:              proxyFN,
+			ProxyConnectHeader: proxy.proxyHeader(),
+			DisableKeepAlives:  true,
+		},
+	}
+	query, err := dnsQuery(opts.DoHQueryName)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", opts.DoHURL, bytes.NewReader(query))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(rn.ctx)
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Debugf("Error resolving %v via DoH through %v: %v", opts.DoHQueryName, proxy, err)
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Debugf("Unexpected status %v resolving via DoH through %v", resp.Status, proxy)
+		return 0, fmt.Errorf("Unexpected status %v", resp.Status)
+	}
+	answer, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDNSResponse))
+	if err != nil {
+		return 0, err
+	}
+	delta := time.Since(start)
+	answers, err := dnsAnswerCount(answer)
+	if err != nil {
+		log.Debugf("Bad DoH response through %v: %v", proxy, err)
+		return 0, err
+	}
+	op.Set("doh_resolve_time", delta.Seconds()).
+		Set("doh_answers", answers).
+		Set("proxybench_success", true)
+	rn.reporter()(delta, ops.AsMap(op, true))
+	return delta, nil
+}
+
+// dnsQuery builds a DNS query message for the A records of name.
+func dnsQuery(name string) ([]byte, error) {
+	// ID 0 as recommended by RFC 8484 for caching, recursion desired, one
+	// question.
+	msg := []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("Invalid DNS name %v", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	// Root label, type A, class IN
+	return append(msg, 0, 0, 1, 0, 1), nil
+}
+
+// dnsAnswerCount checks that msg is a successful DNS response and returns the
+// number of answers in it.
+func dnsAnswerCount(msg []byte) (int, error) {
+	if len(msg) < 12 {
+		return 0, fmt.Errorf("DNS response too short")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 == 0 {
+		return 0, fmt.Errorf("DNS message isn't a response")
+	}
+	if rcode := flags & 0xf; rcode != 0 {
+		return 0, fmt.Errorf("DNS response code %d", rcode)
+	}
+	return int(binary.BigEndian.Uint16(msg[6:])), nil
+}
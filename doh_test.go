@@ -0,0 +1,37 @@
+package proxybench
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDNSQuery(t *testing.T) {
+	query, err := dnsQuery("example.com.")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []byte{
+		0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+		7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+		0, 1, 0, 1,
+	}, query)
+
+	_, err = dnsQuery("bad..name")
+	assert.Error(t, err)
+}
+
+func TestDNSAnswerCount(t *testing.T) {
+	answers, err := dnsAnswerCount([]byte{0, 0, 0x81, 0x80, 0, 1, 0, 2, 0, 0, 0, 0})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, answers)
+
+	_, err = dnsAnswerCount([]byte{0, 0, 0x81, 0x83, 0, 1, 0, 0, 0, 0, 0, 0})
+	assert.Error(t, err, "NXDOMAIN should fail")
+
+	_, err = dnsAnswerCount([]byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	assert.Error(t, err, "query isn't a response")
+
+	_, err = dnsAnswerCount([]byte{0, 0})
+	assert.Error(t, err)
+}
@@ -0,0 +1,109 @@
+package proxybench
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const envPrefix = "PROXYBENCH_"
+
+// applyEnv overrides settings with the environment variables found by lookup,
+// as described on Opts. Invalid values are logged and ignored.
+func (opts *Opts) applyEnv(lookup func(string) (string, bool)) {
+	v := reflect.ValueOf(opts).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.PkgPath != "" || name == "" || name == "-" {
+			continue
+		}
+		key := envPrefix + envName(name)
+		value, found := lookup(key)
+		if !found {
+			continue
+		}
+		applied, err := setFromEnv(v.Field(i), value)
+		if err != nil {
+			log.Errorf("Ignoring invalid value for %v: %v", key, err)
+		} else if applied {
+			log.Debugf("Overriding %v from %v", name, key)
+		}
+	}
+}
+
+// mixedCaseAcronyms are acronyms in JSON names that aren't all upper case, so
+// wouldn't otherwise be recognized as single words.
+var mixedCaseAcronyms = strings.NewReplacer("DoH", "DOH")
+
+// envName converts a JSON name like "updateURL" into upper snake case like
+// "UPDATE_URL".
+func envName(name string) string {
+	var b strings.Builder
+	runes := []rune(mixedCaseAcronyms.Replace(name))
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) {
+				b.WriteRune('_')
+			} else if i+1 < len(runes) && unicode.IsLower(runes[i+1]) && !isAcronymPlural(runes, i+1) {
+				// The start of a word after an acronym, like the P in "DNSProxy"
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// isAcronymPlural returns whether the rune at i is an "s" pluralizing the
+// acronym before it, like in "webSocketURLs".
+func isAcronymPlural(runes []rune, i int) bool {
+	if runes[i] != 's' {
+		return false
+	}
+	return i+1 == len(runes) || !unicode.IsLower(runes[i+1])
+}
+
+// setFromEnv sets a simple field from its environment variable value,
+// returning false if the field isn't simple enough to be set that way.
+func setFromEnv(field reflect.Value, value string) (bool, error) {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false, err
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false, err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return false, nil
+		}
+		var values []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+		field.Set(reflect.ValueOf(values).Convert(field.Type()))
+	default:
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,121 @@
+package proxybench
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvName(t *testing.T) {
+	assert.Equal(t, "SAMPLE_RATE", envName("sampleRate"))
+	assert.Equal(t, "PERIOD", envName("period"))
+	assert.Equal(t, "UPDATE_URL", envName("updateURL"))
+	assert.Equal(t, "HTTP2_STREAMS", envName("http2Streams"))
+	assert.Equal(t, "DOH_URL", envName("dohURL"))
+	assert.Equal(t, "TLS_FINGERPRINT", envName("tlsFingerprint"))
+	assert.Equal(t, "WEB_SOCKET_URLS", envName("webSocketURLs"))
+	assert.Equal(t, "BENCH_DOH", envName("benchDoH"))
+	assert.Equal(t, "DNS_PROXY", envName("DNSProxy"))
+	assert.Equal(t, "URLS_PER_HOST", envName("URLsPerHost"))
+}
+
+func TestEnvNameForEveryOpt(t *testing.T) {
+	// New settings need to be added here so that we notice if their
+	// environment variable isn't named as expected.
+	expected := map[string]string{
+		"sampleRate":          "SAMPLE_RATE",
+		"period":              "PERIOD",
+		"proxies":             "PROXIES",
+		"urls":                "URLS",
+		"updateURL":           "UPDATE_URL",
+		"updatePeriod":        "UPDATE_PERIOD",
+		"targets":             "TARGETS",
+		"benchNewProxies":     "BENCH_NEW_PROXIES",
+		"simulatedBandwidth":  "SIMULATED_BANDWIDTH",
+		"reportTCPInfo":       "REPORT_TCP_INFO",
+		"compareProtocols":    "COMPARE_PROTOCOLS",
+		"samplesPerTarget":    "SAMPLES_PER_TARGET",
+		"keepAliveRequests":   "KEEP_ALIVE_REQUESTS",
+		"http2Streams":        "HTTP2_STREAMS",
+		"anomalyThreshold":    "ANOMALY_THRESHOLD",
+		"anomalySuccessDrop":  "ANOMALY_SUCCESS_DROP",
+		"anomalyMinSamples":   "ANOMALY_MIN_SAMPLES",
+		"directBaseline":      "DIRECT_BASELINE",
+		"baselineIssuers":     "BASELINE_ISSUERS",
+		"reportFields":        "REPORT_FIELDS",
+		"failureBias":         "FAILURE_BIAS",
+		"isolateBy":           "ISOLATE_BY",
+		"concurrencyPerGroup": "CONCURRENCY_PER_GROUP",
+		"concurrency":         "CONCURRENCY",
+		"webSocketURLs":       "WEB_SOCKET_URLS",
+		"webSocketPing":       "WEB_SOCKET_PING",
+		"perOriginDelay":      "PER_ORIGIN_DELAY",
+		"minRequestInterval":  "MIN_REQUEST_INTERVAL",
+		"requestTimeout":      "REQUEST_TIMEOUT",
+		"shuffleOrder":        "SHUFFLE_ORDER",
+		"benchDoH":            "BENCH_DOH",
+		"dohURL":              "DOH_URL",
+		"dohQueryName":        "DOH_QUERY_NAME",
+		"benchTLSResumption":  "BENCH_TLS_RESUMPTION",
+		"uploadURL":           "UPLOAD_URL",
+		"uploadBytes":         "UPLOAD_BYTES",
+		"captivePortalCheck":  "CAPTIVE_PORTAL_CHECK",
+		"captivePortalURL":    "CAPTIVE_PORTAL_URL",
+		"statsHalfLife":       "STATS_HALF_LIFE",
+		"slowThreshold":       "SLOW_THRESHOLD",
+		"warmConnections":     "WARM_CONNECTIONS",
+		"maxRetries":          "MAX_RETRIES",
+		"retryBudget":         "RETRY_BUDGET",
+		"enableHTTP2":         "ENABLE_HTTP2",
+		"http3":               "HTTP3",
+	}
+	typ := reflect.TypeOf(Opts{})
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		if assert.Contains(t, expected, name, "missing expected environment variable name") {
+			assert.Equal(t, expected[name], envName(name), "wrong environment variable name for %v", name)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"PROXYBENCH_SAMPLE_RATE":   "0.25",
+		"PROXYBENCH_PERIOD":        "10m",
+		"PROXYBENCH_UPDATE_URL":    "https://example.com/opts.json",
+		"PROXYBENCH_URLS":          "https://a.com, https://b.com",
+		"PROXYBENCH_HTTP3":         "true",
+		"PROXYBENCH_HTTP2_STREAMS": "4",
+		"PROXYBENCH_MAX_RETRIES":   "not a number",
+		"PROXYBENCH_PROXIES":       "ignored",
+	}
+	lookup := func(key string) (string, bool) {
+		value, found := env[key]
+		return value, found
+	}
+	opts := &Opts{SampleRate: 1, URLs: []string{"https://c.com"}, MaxRetries: 2}
+	opts.applyEnv(lookup)
+	assert.Equal(t, 0.25, opts.SampleRate)
+	assert.Equal(t, "10m", opts.PeriodString)
+	assert.Equal(t, "https://example.com/opts.json", opts.UpdateURL)
+	assert.Equal(t, []string{"https://a.com", "https://b.com"}, opts.URLs)
+	assert.True(t, opts.HTTP3)
+	assert.Equal(t, 4, opts.HTTP2Streams)
+	assert.Equal(t, 2, opts.MaxRetries, "invalid values should be ignored")
+	assert.Nil(t, opts.Proxies, "complex settings can't be overridden")
+}
+
+func TestApplyEnvBeforeDefaults(t *testing.T) {
+	os.Setenv("PROXYBENCH_PERIOD", "10m")
+	defer os.Unsetenv("PROXYBENCH_PERIOD")
+	opts := &Opts{PeriodString: "2h"}
+	opts.applyDefaults()
+	assert.Equal(t, 10*time.Minute, opts.Period, "environment should override config")
+}
@@ -0,0 +1,5 @@
+package proxybench
+
+// KnownReportFields exposes knownReportFields to the external tests, which can
+// import the reporter packages without an import cycle.
+var KnownReportFields = knownReportFields
@@ -0,0 +1,280 @@
+// Package grpcreporter streams proxybench reports to a collector implementing
+// the Collector gRPC service defined in report.proto.
+package grpcreporter
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxybench"
+	"github.com/getlantern/proxybench/internal/reportqueue"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	streamMethod = "/proxybench.Collector/StreamReports"
+
+	minBackoff   = 1 * time.Second
+	maxBackoff   = 1 * time.Minute
+	closeTimeout = 10 * time.Second
+
+	// DefaultBufferSize is the number of reports buffered while the collector
+	// is slow or unreachable if no buffer size is specified.
+	DefaultBufferSize = 1000
+)
+
+var (
+	log = golog.LoggerFor("proxybench.grpcreporter")
+
+	streamDesc = &grpc.StreamDesc{
+		StreamName:    "StreamReports",
+		ClientStreams: true,
+	}
+)
+
+// Reporter streams reports to a gRPC collector. Reports are buffered and sent
+// in the background. If the collector can't keep up and the buffer fills, new
+// reports are dropped rather than blocking the benchmarks. If the stream
+// breaks, the Reporter reconnects with exponential backoff.
+type Reporter struct {
+	cc    *grpc.ClientConn
+	queue *reportqueue.Queue
+}
+
+// New creates a Reporter that streams to the Collector service on the given
+// connection, buffering up to bufferSize reports.
+func New(cc *grpc.ClientConn, bufferSize int) *Reporter {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	r := &Reporter{
+		cc:    cc,
+		queue: reportqueue.New(bufferSize, closeTimeout),
+	}
+	r.queue.Start(r.run)
+	return r
+}
+
+// Report queues a report for sending. It implements proxybench.Reporter.
+func (r *Reporter) Report(result proxybench.Result) {
+	r.queue.Add(newReport(result.Timing, result.Fields))
+}
+
+// Dropped returns the number of reports dropped so far because the buffer was
+// full or the Reporter was closed.
+func (r *Reporter) Dropped() int64 {
+	return r.queue.Dropped()
+}
+
+// Flush waits (for a limited time) until all reports queued so far have been
+// sent.
+func (r *Reporter) Flush() error {
+	return r.queue.Flush()
+}
+
+// Close stops accepting reports and waits (for a limited time) for buffered
+// reports to be sent. Reports that couldn't be sent in time are abandoned and
+// counted as dropped.
+func (r *Reporter) Close() error {
+	return r.queue.Close()
+}
+
+func (r *Reporter) run() {
+	ctx := r.queue.Context()
+	backoff := minBackoff
+	var pending *report
+	for {
+		stream, err := r.cc.NewStream(ctx, streamDesc, streamMethod, grpc.ForceCodec(codec{}))
+		if err == nil {
+			pending, err = r.send(stream, pending)
+			if err == nil {
+				// Closed and everything sent
+				return
+			}
+			backoff = minBackoff
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Debugf("Error streaming reports, will retry in %v: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// send sends reports over the stream until the Reporter is closed and the
+// buffer is drained, or until there's an error, in which case it returns the
+// report that still needs to be sent.
+func (r *Reporter) send(stream grpc.ClientStream, pending *report) (*report, error) {
+	for {
+		if pending == nil {
+			select {
+			case item := <-r.queue.Items():
+				pending = item.(*report)
+			case <-r.queue.Closing():
+				select {
+				case item := <-r.queue.Items():
+					pending = item.(*report)
+				default:
+					return nil, r.finish(stream)
+				}
+			}
+		}
+		if err := stream.SendMsg(pending); err != nil {
+			return pending, err
+		}
+		r.queue.Sent(1)
+		pending = nil
+	}
+}
+
+func (r *Reporter) finish(stream grpc.ClientStream) error {
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	ack := &reportAck{}
+	if err := stream.RecvMsg(ack); err != nil {
+		return err
+	}
+	log.Debugf("Collector acknowledged %d reports", ack.received)
+	return nil
+}
+
+// standardFields are the context fields that have dedicated fields in the
+// Report message.
+var standardFields = map[string]protowire.Number{
+	"url":              2,
+	"proxy_type":       3,
+	"proxy_protocol":   4,
+	"proxy_provider":   5,
+	"proxy_datacenter": 6,
+	"proxy_host":       7,
+	"proxy_port":       8,
+	"run_id":           10,
+}
+
+type report struct {
+	timing   time.Duration
+	standard map[protowire.Number]string
+	success  bool
+	fields   map[string]string
+}
+
+func newReport(timing time.Duration, ctx map[string]interface{}) *report {
+	rep := &report{
+		timing:   timing,
+		standard: make(map[protowire.Number]string, len(standardFields)),
+		fields:   make(map[string]string, len(ctx)),
+	}
+	for key, value := range ctx {
+		if num, found := standardFields[key]; found {
+			rep.standard[num] = fmt.Sprint(value)
+		} else if key == "proxybench_success" {
+			rep.success = value == true
+		} else {
+			rep.fields[key] = fmt.Sprint(value)
+		}
+	}
+	return rep
+}
+
+func (rep *report) marshal() []byte {
+	var b []byte
+	if rep.timing != 0 {
+		b = protowire.AppendTag(b, 1, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(rep.timing))
+	}
+	nums := make([]int, 0, len(rep.standard))
+	for num := range rep.standard {
+		nums = append(nums, int(num))
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		b = protowire.AppendTag(b, protowire.Number(num), protowire.BytesType)
+		b = protowire.AppendString(b, rep.standard[protowire.Number(num)])
+	}
+	if rep.success {
+		b = protowire.AppendTag(b, 9, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	keys := make([]string, 0, len(rep.fields))
+	for key := range rep.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// Map entries are encoded as embedded messages with the key in field 1
+		// and the value in field 2.
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendString(entry, key)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, rep.fields[key])
+		b = protowire.AppendTag(b, 11, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+type reportAck struct {
+	received int64
+}
+
+func (ack *reportAck) unmarshal(b []byte) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num == 1 && typ == protowire.VarintType {
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			ack.received = int64(v)
+			b = b[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// codec encodes the messages in report.proto without requiring generated
+// code.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	rep, ok := v.(*report)
+	if !ok {
+		return nil, fmt.Errorf("Unable to marshal %T", v)
+	}
+	return rep.marshal(), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	ack, ok := v.(*reportAck)
+	if !ok {
+		return fmt.Errorf("Unable to unmarshal into %T", v)
+	}
+	return ack.unmarshal(data)
+}
+
+func (codec) Name() string {
+	return "proto"
+}
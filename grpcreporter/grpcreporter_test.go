@@ -0,0 +1,87 @@
+package grpcreporter
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// rawCodec lets the test server work with raw message bytes
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) { return *v.(*[]byte), nil }
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+func (rawCodec) Name() string { return "proto" }
+
+func TestReporter(t *testing.T) {
+	var mx sync.Mutex
+	var urls []string
+	handler := func(srv interface{}, stream grpc.ServerStream) error {
+		var received int64
+		for {
+			var msg []byte
+			err := stream.RecvMsg(&msg)
+			if err == io.EOF {
+				ack := protowire.AppendTag(nil, 1, protowire.VarintType)
+				ack = protowire.AppendVarint(ack, uint64(received))
+				return stream.SendMsg(&ack)
+			}
+			if err != nil {
+				return err
+			}
+			received++
+			for len(msg) > 0 {
+				num, typ, n := protowire.ConsumeTag(msg)
+				msg = msg[n:]
+				if num == 2 {
+					url, n := protowire.ConsumeString(msg)
+					mx.Lock()
+					urls = append(urls, url)
+					mx.Unlock()
+					msg = msg[n:]
+					continue
+				}
+				msg = msg[protowire.ConsumeFieldValue(num, typ, msg):]
+			}
+		}
+	}
+
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(handler))
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cc.Close()
+
+	r := New(cc, 10)
+	r.Report(proxybench.NewResult(1*time.Second, map[string]interface{}{"url": "https://a.com", "proxybench_success": true, "extra": 5}))
+	r.Report(proxybench.NewResult(2*time.Second, map[string]interface{}{"url": "https://b.com"}))
+	assert.NoError(t, r.Flush())
+	assert.NoError(t, r.Close())
+	assert.EqualValues(t, 0, r.Dropped())
+
+	r.Report(proxybench.NewResult(0, map[string]interface{}{"url": "https://c.com"}))
+	assert.EqualValues(t, 1, r.Dropped(), "reports after close should be dropped")
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, []string{"https://a.com", "https://b.com"}, urls)
+}
@@ -0,0 +1,99 @@
+package proxybench
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyHistorySize is the number of recent results kept per proxy and
+// protocol for the dashboard's sparklines.
+const latencyHistorySize = 60
+
+// historyPoint is a single result in the latency history.
+type historyPoint struct {
+	Time    time.Time `json:"time"`
+	Latency float64   `json:"latency"` // seconds, 0 for failures
+	Success bool      `json:"success"`
+}
+
+// proxyHistory is the recent latency history of a proxy over a protocol.
+type proxyHistory struct {
+	Proxy    string         `json:"proxy"`
+	Protocol string         `json:"protocol"`
+	Points   []historyPoint `json:"points"`
+}
+
+// latencyHistory keeps the most recent results for every proxy and protocol
+// for Opts.StatusDashboard.
+type latencyHistory struct {
+	entries map[string]*proxyHistory
+	mx      sync.Mutex
+}
+
+func (lh *latencyHistory) record(proxy *proxy, timing time.Duration, err error) {
+	key := statsKey(proxy.key(), proxy.protocol)
+	lh.mx.Lock()
+	defer lh.mx.Unlock()
+	if lh.entries == nil {
+		lh.entries = make(map[string]*proxyHistory)
+	}
+	entry := lh.entries[key]
+	if entry == nil {
+		entry = &proxyHistory{Proxy: proxy.key(), Protocol: proxy.protocol}
+		lh.entries[key] = entry
+		lh.evictIfNecessary()
+	}
+	point := historyPoint{Time: time.Now(), Success: err == nil}
+	if err == nil {
+		point.Latency = timing.Seconds()
+	}
+	entry.Points = append(entry.Points, point)
+	if len(entry.Points) > latencyHistorySize {
+		entry.Points = entry.Points[len(entry.Points)-latencyHistorySize:]
+	}
+}
+
+// evictIfNecessary drops the least recently updated entries once we're
+// tracking more than maxStatsEntries. Must be called with the lock held.
+func (lh *latencyHistory) evictIfNecessary() {
+	if len(lh.entries) <= maxStatsEntries {
+		return
+	}
+	keys := make([]string, 0, len(lh.entries))
+	for key := range lh.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return lh.entries[keys[i]].lastUpdated().Before(lh.entries[keys[j]].lastUpdated())
+	})
+	for _, key := range keys[:len(keys)-maxStatsEntries] {
+		delete(lh.entries, key)
+	}
+}
+
+func (ph *proxyHistory) lastUpdated() time.Time {
+	if len(ph.Points) == 0 {
+		return time.Time{}
+	}
+	return ph.Points[len(ph.Points)-1].Time
+}
+
+// snapshot returns a copy of the history, sorted by proxy and protocol.
+func (lh *latencyHistory) snapshot() []proxyHistory {
+	lh.mx.Lock()
+	result := make([]proxyHistory, 0, len(lh.entries))
+	for _, entry := range lh.entries {
+		copied := *entry
+		copied.Points = append([]historyPoint(nil), entry.Points...)
+		result = append(result, copied)
+	}
+	lh.mx.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Proxy != result[j].Proxy {
+			return result[i].Proxy < result[j].Proxy
+		}
+		return result[i].Protocol < result[j].Protocol
+	})
+	return result
+}
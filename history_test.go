@@ -0,0 +1,68 @@
+package proxybench
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyHistory(t *testing.T) {
+	lh := &latencyHistory{}
+	p := (&Proxy{Addrs: map[string]string{"https": "1.2.3.4:443"}}).withProtocol("https")
+	for i := 0; i < latencyHistorySize+10; i++ {
+		lh.record(p, time.Duration(i)*time.Millisecond, nil)
+	}
+	lh.record(p, 0, errors.New("failed"))
+
+	snapshot := lh.snapshot()
+	if assert.Len(t, snapshot, 1) {
+		points := snapshot[0].Points
+		assert.Len(t, points, latencyHistorySize, "history should be bounded")
+		assert.Equal(t, 0.069, points[len(points)-2].Latency)
+		assert.False(t, points[len(points)-1].Success)
+		assert.Equal(t, "https", snapshot[0].Protocol)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	opts := &Opts{StatusDashboard: true}
+	r := newRunner(context.Background(), opts, nil)
+	p := (&Proxy{Addrs: map[string]string{"https": "1.2.3.4:443"}}).withProtocol("https")
+	r.newRun(opts, false).record("https://a.com", p, 100*time.Millisecond, nil)
+
+	srv := httptest.NewServer(r.dashboardHandler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/proxybench/")
+	if assert.NoError(t, err) {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Contains(t, string(body), "<title>proxybench</title>")
+	}
+
+	resp, err = http.Get(srv.URL + "/proxybench/history")
+	if assert.NoError(t, err) {
+		var history []proxyHistory
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&history))
+		resp.Body.Close()
+		if assert.Len(t, history, 1) && assert.Len(t, history[0].Points, 1) {
+			assert.Equal(t, 0.1, history[0].Points[0].Latency)
+		}
+	}
+
+	assert.NotNil(t, fetchStatus(t, srv.URL), "status should still be served")
+
+	resp, err = http.Get(srv.URL + "/proxybench/other")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+}
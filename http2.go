@@ -0,0 +1,102 @@
+package proxybench
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/ops"
+)
+
+// benchHTTP2 fetches origin through p with opts.HTTP2Streams concurrent
+// requests multiplexed over a single HTTP/2 connection to the origin, tunnelled
+// through the proxy.
+func (rn *run) benchHTTP2(origin string, p *Proxy, enqueued time.Time) {
+	proxy := rn.attempt(p.withRandomProtocol(), enqueued)
+	proxyFN, done, err := proxyFunc(rn.ctx, rn.opts, rn.reporter(), origin, proxy)
+	if err != nil {
+		rn.outcomes.record(proxy, origin, 0, err)
+		return
+	}
+	defer done()
+	transport := newHTTP2Transport(proxyFN, proxy)
+	defer transport.CloseIdleConnections()
+	rn.multiplex(origin, proxy, transport)
+}
+
+// newHTTP2Transport returns a transport that negotiates HTTP/2 with origins
+// and uses only a single connection per origin, so that concurrent requests
+// are multiplexed over it.
+func newHTTP2Transport(proxyFN func(*http.Request) (*url.URL, error), proxy *proxy) *http.Transport {
+	return &http.Transport{
+		Proxy:              proxyFN,
+		ProxyConnectHeader: proxy.proxyHeader(),
+		ForceAttemptHTTP2:  true,
+		MaxConnsPerHost:    1,
+	}
+}
+
+// multiplex issues opts.HTTP2Streams concurrent requests for origin using
+// transport, reporting each of them individually and additionally how long
+// they took altogether and whether they were actually multiplexed.
+func (rn *run) multiplex(origin string, proxy *proxy, transport *http.Transport) {
+	opts := rn.opts
+	rn.pacer.wait(rn.ctx, opts, origin)
+	streams := opts.HTTP2Streams
+	timings := make([]time.Duration, streams)
+	protos := make([]string, streams)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < streams; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report := func(timing time.Duration, ctx map[string]interface{}) {
+				ctx["h2_stream_index"] = i
+				protos[i], _ = ctx["http_proto"].(string)
+				rn.reporter()(timing, ctx)
+			}
+			timing, err := doRequest(rn.ctx, opts, report, origin, proxy, transport)
+			rn.outcomes.record(proxy, origin, timing, err)
+			if err == nil {
+				timings[i] = timing
+			}
+		}()
+	}
+	wg.Wait()
+	total := time.Since(start)
+	if rn.ctx.Err() != nil {
+		return
+	}
+
+	var succeeded int
+	var sum, max time.Duration
+	multiplexed := true
+	for i, timing := range timings {
+		if timing <= 0 {
+			continue
+		}
+		succeeded++
+		sum += timing
+		if timing > max {
+			max = timing
+		}
+		if !strings.HasPrefix(protos[i], "HTTP/2") {
+			multiplexed = false
+		}
+	}
+	op := beginOp(opts, origin, proxy).
+		Set("h2_streams", streams).
+		Set("h2_streams_succeeded", succeeded).
+		Set("h2_total_time", total.Seconds())
+	defer op.End()
+	if succeeded > 0 {
+		op.Set("h2_stream_latency_mean", (sum/time.Duration(succeeded)).Seconds()).
+			Set("h2_stream_latency_max", max.Seconds()).
+			Set("h2_multiplexed", multiplexed)
+	}
+	rn.reporter()(0, ops.AsMap(op, true))
+}
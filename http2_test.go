@@ -0,0 +1,51 @@
+package proxybench
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiplex(t *testing.T) {
+	var mx sync.Mutex
+	conns := make(map[string]bool)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mx.Lock()
+		conns[req.RemoteAddr] = true
+		mx.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		resp.Write([]byte("hello"))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	var reported []map[string]interface{}
+	var reportedMx sync.Mutex
+	r := &Runner{ctx: context.Background(), stats: newStats()}
+	r.SetReporter(func(timing time.Duration, ctx map[string]interface{}) {
+		reportedMx.Lock()
+		reported = append(reported, ctx)
+		reportedMx.Unlock()
+	})
+	rn := r.newRun(&Opts{HTTP2Streams: 5}, false)
+	proxy := rn.attempt((&Proxy{Addrs: map[string]string{protocolSystem: ""}}).withRandomProtocol(), time.Now())
+	transport := newHTTP2Transport(http.ProxyFromEnvironment, proxy)
+	transport.TLSClientConfig = &tls.Config{RootCAs: srv.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+	rn.multiplex(srv.URL, proxy, transport)
+
+	if !assert.Len(t, reported, 6) {
+		return
+	}
+	summary := reported[5]
+	assert.Equal(t, 5, summary["h2_streams"])
+	assert.Equal(t, 5, summary["h2_streams_succeeded"])
+	assert.Equal(t, true, summary["h2_multiplexed"])
+	assert.Len(t, conns, 1, "all streams should share a connection")
+}
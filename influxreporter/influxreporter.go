@@ -0,0 +1,300 @@
+// Package influxreporter writes proxybench reports to InfluxDB using the line
+// protocol over its HTTP write endpoint.
+package influxreporter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxybench"
+	"github.com/getlantern/proxybench/internal/reportqueue"
+)
+
+const (
+	measurement = "proxybench"
+
+	minBackoff = 1 * time.Second
+	maxBackoff = 1 * time.Minute
+
+	// DefaultBatchSize is the maximum number of points written at once if no
+	// batch size is specified.
+	DefaultBatchSize = 100
+
+	// DefaultFlushInterval is how often partial batches are written if no
+	// flush interval is specified.
+	DefaultFlushInterval = 10 * time.Second
+
+	// DefaultBufferSize is the number of points buffered while InfluxDB is
+	// slow or unreachable if no buffer size is specified.
+	DefaultBufferSize = 1000
+)
+
+var (
+	log = golog.LoggerFor("proxybench.influxreporter")
+
+	// closeTimeout is how long Close waits for buffered points to be written
+	// before abandoning them.
+	closeTimeout = 10 * time.Second
+
+	// tags maps the report fields that are written as tags to their tag keys.
+	// Everything else is written as a field.
+	tags = map[string]string{
+		"url":              "url",
+		"proxy_type":       "proxy_type",
+		"proxy_host":       "proxy",
+		"proxy_protocol":   "protocol",
+		"proxy_provider":   "provider",
+		"proxy_datacenter": "datacenter",
+	}
+)
+
+// Opts configures a Reporter.
+type Opts struct {
+	// WriteURL is the full URL of the write endpoint including the
+	// destination, like
+	// "http://localhost:8086/api/v2/write?org=lantern&bucket=proxybench".
+	WriteURL string
+
+	// Token, if set, authenticates to InfluxDB.
+	Token string
+
+	// BatchSize is the maximum number of points written at once.
+	BatchSize int
+
+	// FlushInterval is how often partial batches are written.
+	FlushInterval time.Duration
+
+	// BufferSize is the number of points buffered while InfluxDB is slow or
+	// unreachable. Points beyond that are dropped.
+	BufferSize int
+}
+
+// Reporter writes reports to InfluxDB as points of the "proxybench"
+// measurement, tagged by URL and proxy, with the timing in seconds and the
+// remaining report fields as fields. Points are buffered and written in
+// batches in the background. If InfluxDB can't keep up and the buffer fills,
+// new points are dropped rather than blocking the benchmarks. Writes that fail
+// with a network error, a 429 or a 5xx status are retried with exponential
+// backoff. Other failures drop the batch.
+type Reporter struct {
+	opts   Opts
+	client *http.Client
+	queue  *reportqueue.Queue
+}
+
+// New creates a Reporter that writes to InfluxDB as configured by opts.
+func New(opts *Opts) (*Reporter, error) {
+	if opts.WriteURL == "" {
+		return nil, fmt.Errorf("No InfluxDB write URL configured")
+	}
+	r := &Reporter{
+		opts:   *opts,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	if r.opts.BatchSize <= 0 {
+		r.opts.BatchSize = DefaultBatchSize
+	}
+	if r.opts.FlushInterval <= 0 {
+		r.opts.FlushInterval = DefaultFlushInterval
+	}
+	if r.opts.BufferSize <= 0 {
+		r.opts.BufferSize = DefaultBufferSize
+	}
+	r.queue = reportqueue.New(r.opts.BufferSize, closeTimeout)
+	r.queue.Start(r.run)
+	return r, nil
+}
+
+// Report queues a report for writing. It implements proxybench.Reporter.
+func (r *Reporter) Report(result proxybench.Result) {
+	r.queue.Add(point(result.Time, result.Timing, result.Fields))
+}
+
+// Dropped returns the number of reports dropped so far because the buffer was
+// full, the Reporter was closed or InfluxDB rejected them.
+func (r *Reporter) Dropped() int64 {
+	return r.queue.Dropped()
+}
+
+// Flush waits (for a limited time) until all reports queued so far have been
+// written or dropped.
+func (r *Reporter) Flush() error {
+	return r.queue.Flush()
+}
+
+// Close stops accepting reports and waits (for a limited time) for buffered
+// reports to be written. Reports that couldn't be written in time are
+// abandoned and counted as dropped.
+func (r *Reporter) Close() error {
+	return r.queue.Close()
+}
+
+func (r *Reporter) run() {
+	ticker := time.NewTicker(r.opts.FlushInterval)
+	defer ticker.Stop()
+	backoff := minBackoff
+	var batch [][]byte
+	for {
+		full := len(batch) >= r.opts.BatchSize
+		if full {
+			// Stop taking points until the batch is written
+			select {
+			case <-ticker.C:
+			case <-r.queue.Closing():
+				r.drain(batch)
+				return
+			}
+		} else {
+			select {
+			case p := <-r.queue.Items():
+				batch = append(batch, p.([]byte))
+				if len(batch) < r.opts.BatchSize {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			case <-r.queue.Closing():
+				r.drain(batch)
+				return
+			}
+		}
+		if retry, err := r.write(batch); err != nil {
+			if !retry {
+				log.Errorf("Dropping %d reports after failing to write them to InfluxDB: %v", len(batch), err)
+				r.queue.Discard(len(batch))
+				backoff = minBackoff
+				batch = nil
+				continue
+			}
+			log.Debugf("Error writing to InfluxDB, will retry in %v: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-r.queue.Closing():
+				r.drain(batch)
+				return
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = minBackoff
+		batch = nil
+	}
+}
+
+// drain makes a final attempt to write the given batch along with everything
+// that's still buffered.
+func (r *Reporter) drain(batch [][]byte) {
+	for {
+		select {
+		case p := <-r.queue.Items():
+			batch = append(batch, p.([]byte))
+		default:
+			if len(batch) > 0 {
+				if _, err := r.write(batch); err != nil {
+					log.Debugf("Error writing buffered reports to InfluxDB: %v", err)
+				}
+			}
+			return
+		}
+	}
+}
+
+// write writes a batch, returning whether it's worth retrying if it fails.
+func (r *Reporter) write(batch [][]byte) (bool, error) {
+	req, err := http.NewRequest("POST", r.opts.WriteURL, bytes.NewReader(bytes.Join(batch, []byte("\n"))))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(r.queue.Context())
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if r.opts.Token != "" {
+		req.Header.Set("Authorization", "Token "+r.opts.Token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("Unexpected status %v", resp.Status)
+	}
+	r.queue.Sent(len(batch))
+	return false, nil
+}
+
+// point formats a report as a line protocol point.
+func point(ts time.Time, timing time.Duration, ctx map[string]interface{}) []byte {
+	var b strings.Builder
+	b.WriteString(measurement)
+	keys := make([]string, 0, len(ctx))
+	for key := range ctx {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		tag, isTag := tags[key]
+		if !isTag {
+			continue
+		}
+		value := fmt.Sprint(ctx[key])
+		if value == "" {
+			// Empty tag values aren't allowed
+			continue
+		}
+		b.WriteString(",")
+		b.WriteString(escapeTag(tag))
+		b.WriteString("=")
+		b.WriteString(escapeTag(value))
+	}
+	b.WriteString(" timing=")
+	b.WriteString(strconv.FormatFloat(timing.Seconds(), 'f', -1, 64))
+	for _, key := range keys {
+		if _, isTag := tags[key]; isTag {
+			continue
+		}
+		b.WriteString(",")
+		b.WriteString(escapeTag(key))
+		b.WriteString("=")
+		b.WriteString(fieldValue(ctx[key]))
+	}
+	b.WriteString(" ")
+	b.WriteString(strconv.FormatInt(ts.UnixNano(), 10))
+	return []byte(b.String())
+}
+
+func fieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v) + "i"
+	case int64:
+		return strconv.FormatInt(v, 10) + "i"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		s := strings.Replace(fmt.Sprint(v), `\`, `\\`, -1)
+		return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+	}
+}
+
+var tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+
+func escapeTag(s string) string {
+	return tagEscaper.Replace(s)
+}
@@ -0,0 +1,110 @@
+package influxreporter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter(t *testing.T) {
+	var mx sync.Mutex
+	var lines []string
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mx.Lock()
+		lines = append(lines, strings.Split(string(body), "\n")...)
+		auth = req.Header.Get("Authorization")
+		mx.Unlock()
+		resp.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	r, err := New(&Opts{WriteURL: srv.URL, Token: "secret", BatchSize: 2, FlushInterval: time.Hour})
+	if !assert.NoError(t, err) {
+		return
+	}
+	r.Report(proxybench.NewResult(1500*time.Millisecond, map[string]interface{}{"url": "https://a.com", "proxy_provider": "do", "proxybench_success": true}))
+	r.Report(proxybench.NewResult(0, map[string]interface{}{"url": "https://b.com", "failure_reason": "dial"}))
+	assert.NoError(t, r.Flush(), "full batch should be written without waiting for the flush interval")
+	r.Report(proxybench.NewResult(0, map[string]interface{}{"run_verdict": true, "critical_targets": 2}))
+	assert.NoError(t, r.Close(), "partial batch should be written on close")
+	assert.EqualValues(t, 0, r.Dropped())
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, "Token secret", auth)
+	if assert.Len(t, lines, 3) {
+		assert.Regexp(t, `^proxybench,provider=do,url=https://a.com timing=1.5,proxybench_success=true \d+$`, lines[0])
+		assert.Regexp(t, `^proxybench,url=https://b.com timing=0,failure_reason="dial" \d+$`, lines[1])
+		assert.Regexp(t, `^proxybench timing=0,critical_targets=2i,run_verdict=true \d+$`, lines[2])
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	var mx sync.Mutex
+	var writes int
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mx.Lock()
+		writes++
+		mx.Unlock()
+		resp.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	r, err := New(&Opts{WriteURL: srv.URL, BatchSize: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	r.Report(proxybench.NewResult(time.Second, map[string]interface{}{"url": "https://a.com"}))
+	assert.NoError(t, r.Flush())
+	assert.NoError(t, r.Close())
+	assert.EqualValues(t, 1, r.Dropped())
+	mx.Lock()
+	assert.Equal(t, 1, writes)
+	mx.Unlock()
+}
+
+func TestCloseTimeout(t *testing.T) {
+	oldCloseTimeout := closeTimeout
+	closeTimeout = 50 * time.Millisecond
+	defer func() {
+		closeTimeout = oldCloseTimeout
+	}()
+	abandoned := make(chan bool, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		// Hang until the Reporter gives up
+		ioutil.ReadAll(req.Body)
+		<-req.Context().Done()
+		abandoned <- true
+	}))
+	defer srv.Close()
+
+	r, err := New(&Opts{WriteURL: srv.URL, BatchSize: 1, FlushInterval: time.Hour})
+	if !assert.NoError(t, err) {
+		return
+	}
+	r.Report(proxybench.NewResult(time.Second, map[string]interface{}{"url": "https://a.com"}))
+	assert.Error(t, r.Close())
+	select {
+	case <-abandoned:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Close should stop writing in the background")
+	}
+	assert.EqualValues(t, 1, r.Dropped(), "abandoned report should be dropped")
+}
+
+func TestEscaping(t *testing.T) {
+	line := string(point(time.Unix(0, 1), 0, map[string]interface{}{
+		"proxy_provider": "big provider,inc=1",
+		"failure_error":  `dial "x" failed\`,
+	}))
+	assert.Equal(t, `proxybench,provider=big\ provider\,inc\=1 timing=0,failure_error="dial \"x\" failed\\" 1`, line)
+}
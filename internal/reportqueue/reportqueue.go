@@ -0,0 +1,159 @@
+// Package reportqueue buffers reports for reporters that send them in the
+// background, such as over the network.
+package reportqueue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const flushPollInterval = 10 * time.Millisecond
+
+// Queue buffers reports until a sender running in the background takes them.
+// If the sender can't keep up and the buffer fills, new reports are dropped
+// rather than blocking the benchmarks. The sender accounts for every report it
+// takes with Sent or Discard.
+type Queue struct {
+	// dropped and unsent are accessed atomically (and first for 64-bit
+	// alignment)
+	dropped int64
+	unsent  int64
+
+	items        chan interface{}
+	closeTimeout time.Duration
+	ctx          context.Context
+	cancel       context.CancelFunc
+	closing      chan struct{}
+	done         chan struct{}
+	closeOne     sync.Once
+}
+
+// New creates a Queue buffering up to bufferSize reports. Close and Flush wait
+// up to closeTimeout for buffered reports to be sent.
+func New(bufferSize int, closeTimeout time.Duration) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Queue{
+		items:        make(chan interface{}, bufferSize),
+		closeTimeout: closeTimeout,
+		ctx:          ctx,
+		cancel:       cancel,
+		closing:      make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Start runs the sender in the background. The sender should return once the
+// Queue is closing and it has sent what it can, or once the Context is done.
+func (q *Queue) Start(send func()) {
+	go func() {
+		defer close(q.done)
+		defer q.cancel()
+		send()
+	}()
+}
+
+// Add queues a report, dropping it if the buffer is full or the Queue is
+// closing.
+func (q *Queue) Add(item interface{}) {
+	select {
+	case <-q.closing:
+		q.Drop()
+		return
+	default:
+	}
+	atomic.AddInt64(&q.unsent, 1)
+	select {
+	case q.items <- item:
+	default:
+		atomic.AddInt64(&q.unsent, -1)
+		q.Drop()
+	}
+}
+
+// Items returns the channel from which the sender takes reports.
+func (q *Queue) Items() <-chan interface{} {
+	return q.items
+}
+
+// Closing returns a channel that's closed once Close is called, after which
+// the sender should send whatever is still buffered and return.
+func (q *Queue) Closing() <-chan struct{} {
+	return q.closing
+}
+
+// Context returns a context that's cancelled once the sender should give up,
+// because Close timed out.
+func (q *Queue) Context() context.Context {
+	return q.ctx
+}
+
+// Sent records that n reports taken from the Queue were sent.
+func (q *Queue) Sent(n int) {
+	atomic.AddInt64(&q.unsent, -int64(n))
+}
+
+// Discard records that n reports taken from the Queue won't be sent.
+func (q *Queue) Discard(n int) {
+	atomic.AddInt64(&q.unsent, -int64(n))
+	atomic.AddInt64(&q.dropped, int64(n))
+}
+
+// Drop records a report that was dropped before it was queued.
+func (q *Queue) Drop() {
+	atomic.AddInt64(&q.dropped, 1)
+}
+
+// Dropped returns the number of reports dropped so far.
+func (q *Queue) Dropped() int64 {
+	return atomic.LoadInt64(&q.dropped)
+}
+
+// Flush waits (for a limited time) until all reports queued so far have been
+// sent or discarded.
+func (q *Queue) Flush() error {
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+	timeout := time.After(q.closeTimeout)
+	for {
+		unsent := atomic.LoadInt64(&q.unsent)
+		if unsent == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-q.done:
+			return fmt.Errorf("Reporter closed with %d reports unsent", atomic.LoadInt64(&q.unsent))
+		case <-timeout:
+			return fmt.Errorf("Timed out flushing reports, %d remain unsent", unsent)
+		}
+	}
+}
+
+// Close stops accepting reports and waits (for a limited time) for buffered
+// reports to be sent. If they aren't sent in time, the sender is cancelled.
+// Reports that weren't sent are abandoned and counted as dropped.
+func (q *Queue) Close() error {
+	q.closeOne.Do(func() {
+		close(q.closing)
+	})
+	timedOut := false
+	select {
+	case <-q.done:
+	case <-time.After(q.closeTimeout):
+		timedOut = true
+		q.cancel()
+		<-q.done
+	}
+	abandoned := atomic.SwapInt64(&q.unsent, 0)
+	atomic.AddInt64(&q.dropped, abandoned)
+	if timedOut {
+		return fmt.Errorf("Timed out sending buffered reports, dropped %d", abandoned)
+	}
+	if abandoned > 0 {
+		return fmt.Errorf("Unable to send buffered reports, dropped %d", abandoned)
+	}
+	return nil
+}
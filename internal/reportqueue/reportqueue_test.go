@@ -0,0 +1,61 @@
+package reportqueue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue(t *testing.T) {
+	q := New(2, time.Second)
+	var sent []interface{}
+	q.Start(func() {
+		for {
+			select {
+			case item := <-q.Items():
+				sent = append(sent, item)
+				q.Sent(1)
+			case <-q.Closing():
+				return
+			}
+		}
+	})
+	q.Add("a")
+	q.Add("b")
+	assert.NoError(t, q.Flush())
+	assert.NoError(t, q.Close())
+	q.Add("c")
+	assert.EqualValues(t, 1, q.Dropped(), "report after close should be dropped")
+	assert.Equal(t, []interface{}{"a", "b"}, sent)
+}
+
+func TestQueueFull(t *testing.T) {
+	q := New(1, time.Second)
+	q.Add("a")
+	q.Add("b")
+	assert.EqualValues(t, 1, q.Dropped())
+	q.Start(func() {
+		item := <-q.Items()
+		assert.Equal(t, "a", item)
+		q.Discard(1)
+	})
+	assert.NoError(t, q.Close())
+	assert.EqualValues(t, 2, q.Dropped())
+}
+
+func TestQueueCloseTimeout(t *testing.T) {
+	q := New(1, 50*time.Millisecond)
+	q.Start(func() {
+		// Never send anything, just wait to be cancelled
+		<-q.Context().Done()
+	})
+	q.Add("a")
+	assert.Error(t, q.Close())
+	select {
+	case <-q.done:
+	default:
+		assert.Fail(t, "Close should wait for the cancelled sender")
+	}
+	assert.EqualValues(t, 1, q.Dropped(), "abandoned report should be dropped")
+}
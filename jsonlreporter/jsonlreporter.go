@@ -0,0 +1,194 @@
+// Package jsonlreporter appends proxybench reports to a local file as JSON
+// lines, rotating the file by size and age.
+package jsonlreporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxybench"
+)
+
+const (
+	// DefaultMaxSize is the size in bytes at which the file is rotated if no
+	// maximum size is specified.
+	DefaultMaxSize = 100 * 1024 * 1024
+
+	// DefaultMaxAge is the age at which the file is rotated if no maximum age
+	// is specified.
+	DefaultMaxAge = 24 * time.Hour
+
+	// DefaultMaxBackups is the number of rotated files kept if no number is
+	// specified.
+	DefaultMaxBackups = 5
+
+	rotatedTimeFormat = "20060102T150405.000000000"
+)
+
+var log = golog.LoggerFor("proxybench.jsonlreporter")
+
+// Opts configures a Reporter.
+type Opts struct {
+	// Path is the file to which reports are appended.
+	Path string
+
+	// MaxSize is the size in bytes beyond which the file is rotated.
+	MaxSize int64
+
+	// MaxAge is how long after opening the file it's rotated.
+	MaxAge time.Duration
+
+	// MaxBackups is the number of rotated files to keep. Older ones are
+	// deleted.
+	MaxBackups int
+}
+
+// Reporter appends each report to a file as a JSON object on its own line,
+// with the report's fields along with "timestamp" (RFC 3339) and "timing" (in
+// seconds). Once the file grows beyond MaxSize or gets older than MaxAge, it's
+// renamed with the time of rotation appended to its name and a new file is
+// started.
+type Reporter struct {
+	opts   Opts
+	file   *os.File
+	size   int64
+	opened time.Time
+	mx     sync.Mutex
+}
+
+// New creates a Reporter that appends to the file configured by opts,
+// creating it if necessary.
+func New(opts *Opts) (*Reporter, error) {
+	if opts.Path == "" {
+		return nil, fmt.Errorf("No path configured")
+	}
+	r := &Reporter{opts: *opts}
+	if r.opts.MaxSize <= 0 {
+		r.opts.MaxSize = DefaultMaxSize
+	}
+	if r.opts.MaxAge <= 0 {
+		r.opts.MaxAge = DefaultMaxAge
+	}
+	if r.opts.MaxBackups <= 0 {
+		r.opts.MaxBackups = DefaultMaxBackups
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Report appends a report to the file. It implements proxybench.Reporter.
+func (r *Reporter) Report(result proxybench.Result) {
+	entry := make(map[string]interface{}, len(result.Fields)+2)
+	for key, value := range result.Fields {
+		entry[key] = value
+	}
+	now := time.Now()
+	entry["timestamp"] = result.Time.UTC().Format(time.RFC3339Nano)
+	entry["timing"] = result.Timing.Seconds()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Unable to encode report: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.file == nil {
+		return
+	}
+	if r.size > 0 && (r.size+int64(len(line)) > r.opts.MaxSize || now.Sub(r.opened) >= r.opts.MaxAge) {
+		if err := r.rotate(now); err != nil {
+			log.Errorf("Unable to rotate %v: %v", r.opts.Path, err)
+			if r.file == nil {
+				return
+			}
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		log.Errorf("Unable to write report to %v: %v", r.opts.Path, err)
+	}
+}
+
+// Flush implements proxybench.Reporter. Reports are written as they're
+// reported, so there's nothing to flush.
+func (r *Reporter) Flush() error {
+	return nil
+}
+
+// Close closes the file.
+func (r *Reporter) Close() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *Reporter) open() error {
+	file, err := os.OpenFile(r.opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open %v: %v", r.opts.Path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Unable to stat %v: %v", r.opts.Path, err)
+	}
+	r.file = file
+	r.size = info.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+// rotate renames the current file out of the way, starts a new one and
+// deletes excess backups.
+func (r *Reporter) rotate(now time.Time) error {
+	if err := r.file.Close(); err != nil {
+		log.Debugf("Error closing %v: %v", r.opts.Path, err)
+	}
+	r.file = nil
+	rotated := r.opts.Path + "." + now.UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(r.opts.Path, rotated); err != nil {
+		// Keep appending to the current file rather than losing reports
+		if openErr := r.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.pruneBackups()
+	return nil
+}
+
+func (r *Reporter) pruneBackups() {
+	backups, err := filepath.Glob(r.opts.Path + ".*")
+	if err != nil {
+		return
+	}
+	if len(backups) <= r.opts.MaxBackups {
+		return
+	}
+	// The timestamp format sorts chronologically
+	sort.Strings(backups)
+	for _, backup := range backups[:len(backups)-r.opts.MaxBackups] {
+		if err := os.Remove(backup); err != nil {
+			log.Debugf("Unable to remove old backup %v: %v", backup, err)
+		}
+	}
+}
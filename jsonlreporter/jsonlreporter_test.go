@@ -0,0 +1,80 @@
+package jsonlreporter
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonlreporter")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "results.jsonl")
+
+	r, err := New(&Opts{Path: path, MaxSize: 200, MaxBackups: 2})
+	if !assert.NoError(t, err) {
+		return
+	}
+	r.Report(proxybench.NewResult(1500*time.Millisecond, map[string]interface{}{"url": "https://a.com", "proxybench_success": true}))
+	assert.NoError(t, r.Close())
+
+	f, err := os.Open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if assert.True(t, scanner.Scan()) {
+		var entry map[string]interface{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		assert.Equal(t, "https://a.com", entry["url"])
+		assert.Equal(t, 1.5, entry["timing"])
+		assert.Equal(t, true, entry["proxybench_success"])
+		assert.NotEmpty(t, entry["timestamp"])
+	}
+
+	r, err = New(&Opts{Path: path, MaxSize: 200, MaxBackups: 2})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	for i := 0; i < 20; i++ {
+		r.Report(proxybench.NewResult(0, map[string]interface{}{"url": "https://a.com"}))
+	}
+	backups, _ := filepath.Glob(path + ".*")
+	assert.Len(t, backups, 2, "excess backups should be removed")
+	info, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.True(t, info.Size() <= 200, "file should have been rotated")
+	}
+}
+
+func TestRotateByAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonlreporter")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "results.jsonl")
+
+	r, err := New(&Opts{Path: path, MaxAge: 50 * time.Millisecond})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	r.Report(proxybench.NewResult(0, map[string]interface{}{}))
+	time.Sleep(100 * time.Millisecond)
+	r.Report(proxybench.NewResult(0, map[string]interface{}{}))
+	backups, _ := filepath.Glob(path + ".*")
+	assert.Len(t, backups, 1)
+}
@@ -0,0 +1,199 @@
+// Package kafkareporter produces proxybench reports to a Kafka topic.
+package kafkareporter
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxybench"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const (
+	// DefaultBatchSize is the maximum number of reports produced at once if no
+	// batch size is specified.
+	DefaultBatchSize = 100
+
+	// DefaultBatchTimeout is how long partial batches wait before being
+	// produced if no timeout is specified.
+	DefaultBatchTimeout = 1 * time.Second
+
+	flushTimeout      = 10 * time.Second
+	flushPollInterval = 10 * time.Millisecond
+)
+
+var log = golog.LoggerFor("proxybench.kafkareporter")
+
+// Opts configures a Reporter.
+type Opts struct {
+	// Brokers are the addresses (host:port) of the brokers used to bootstrap
+	// the connection to the cluster.
+	Brokers []string
+
+	// Topic is the topic to which reports are produced.
+	Topic string
+
+	// TLS, if set, is used to connect to the brokers over TLS.
+	TLS *tls.Config
+
+	// SASLMechanism, if set, authenticates to the brokers with Username and
+	// Password. It's one of "PLAIN", "SCRAM-SHA-256" or "SCRAM-SHA-512".
+	SASLMechanism string
+
+	Username string
+	Password string
+
+	// BatchSize is the maximum number of reports produced at once.
+	BatchSize int
+
+	// BatchTimeout is how long partial batches wait before being produced.
+	BatchTimeout time.Duration
+}
+
+// Reporter produces each report to a Kafka topic as a JSON object with the
+// report's fields along with "timestamp" (RFC 3339) and "timing" (in seconds).
+// Messages are keyed by proxy host so that the results for a given proxy stay
+// in order on a single partition. Messages are produced asynchronously in
+// batches so that the benchmarks never wait on Kafka.
+type Reporter struct {
+	w       *kafka.Writer
+	dropped int64
+	pending int64
+}
+
+// New creates a Reporter that produces to the cluster and topic configured by
+// opts.
+func New(opts *Opts) (*Reporter, error) {
+	if len(opts.Brokers) == 0 {
+		return nil, fmt.Errorf("No Kafka brokers configured")
+	}
+	if opts.Topic == "" {
+		return nil, fmt.Errorf("No Kafka topic configured")
+	}
+	mechanism, err := saslMechanism(opts)
+	if err != nil {
+		return nil, err
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	batchTimeout := opts.BatchTimeout
+	if batchTimeout <= 0 {
+		batchTimeout = DefaultBatchTimeout
+	}
+	r := &Reporter{}
+	r.w = &kafka.Writer{
+		Addr:         kafka.TCP(opts.Brokers...),
+		Topic:        opts.Topic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    batchSize,
+		BatchTimeout: batchTimeout,
+		RequiredAcks: kafka.RequireOne,
+		Async:        true,
+		Completion:   r.completed,
+		Transport: &kafka.Transport{
+			TLS:  opts.TLS,
+			SASL: mechanism,
+		},
+		ErrorLogger: kafka.LoggerFunc(log.Debugf),
+	}
+	return r, nil
+}
+
+// Report queues a report for producing. It implements proxybench.Reporter.
+func (r *Reporter) Report(result proxybench.Result) {
+	msg, err := message(result.Time, result.Timing, result.Fields)
+	if err != nil {
+		log.Errorf("Unable to encode report: %v", err)
+		atomic.AddInt64(&r.dropped, 1)
+		return
+	}
+	atomic.AddInt64(&r.pending, 1)
+	if err := r.w.WriteMessages(context.Background(), msg); err != nil {
+		log.Debugf("Unable to queue report for Kafka: %v", err)
+		atomic.AddInt64(&r.pending, -1)
+		atomic.AddInt64(&r.dropped, 1)
+	}
+}
+
+// Dropped returns the number of reports dropped so far because they couldn't
+// be produced or the Reporter was closed.
+func (r *Reporter) Dropped() int64 {
+	return atomic.LoadInt64(&r.dropped)
+}
+
+// Flush waits (for a limited time) until all reports queued so far have been
+// produced or dropped.
+func (r *Reporter) Flush() error {
+	ticker := time.NewTicker(flushPollInterval)
+	defer ticker.Stop()
+	timeout := time.After(flushTimeout)
+	for {
+		pending := atomic.LoadInt64(&r.pending)
+		if pending <= 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-timeout:
+			return fmt.Errorf("Timed out flushing reports, %d remain unproduced", pending)
+		}
+	}
+}
+
+// Close produces any pending reports and closes the connections to the
+// brokers.
+func (r *Reporter) Close() error {
+	return r.w.Close()
+}
+
+func (r *Reporter) completed(messages []kafka.Message, err error) {
+	atomic.AddInt64(&r.pending, -int64(len(messages)))
+	if err != nil {
+		log.Errorf("Unable to produce %d reports to Kafka: %v", len(messages), err)
+		atomic.AddInt64(&r.dropped, int64(len(messages)))
+	}
+}
+
+func message(ts time.Time, timing time.Duration, ctx map[string]interface{}) (kafka.Message, error) {
+	entry := make(map[string]interface{}, len(ctx)+2)
+	for key, value := range ctx {
+		entry[key] = value
+	}
+	entry["timestamp"] = ts.UTC().Format(time.RFC3339Nano)
+	entry["timing"] = timing.Seconds()
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+	msg := kafka.Message{Value: value, Time: ts}
+	if host, ok := ctx["proxy_host"]; ok {
+		msg.Key = []byte(fmt.Sprint(host))
+	}
+	return msg, nil
+}
+
+func saslMechanism(opts *Opts) (sasl.Mechanism, error) {
+	switch strings.ToUpper(opts.SASLMechanism) {
+	case "":
+		return nil, nil
+	case "PLAIN":
+		return plain.Mechanism{Username: opts.Username, Password: opts.Password}, nil
+	case "SCRAM-SHA-256":
+		return scram.Mechanism(scram.SHA256, opts.Username, opts.Password)
+	case "SCRAM-SHA-512":
+		return scram.Mechanism(scram.SHA512, opts.Username, opts.Password)
+	default:
+		return nil, fmt.Errorf("Unknown SASL mechanism %v", opts.SASLMechanism)
+	}
+}
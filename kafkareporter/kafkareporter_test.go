@@ -0,0 +1,72 @@
+package kafkareporter
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessage(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg, err := message(ts, 1500*time.Millisecond, map[string]interface{}{
+		"url":                "https://a.com",
+		"proxy_host":         "1.2.3.4",
+		"proxybench_success": true,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "1.2.3.4", string(msg.Key), "messages should be keyed by proxy")
+	assert.Equal(t, ts, msg.Time)
+	var entry map[string]interface{}
+	if assert.NoError(t, json.Unmarshal(msg.Value, &entry)) {
+		assert.Equal(t, "https://a.com", entry["url"])
+		assert.Equal(t, 1.5, entry["timing"])
+		assert.Equal(t, "2020-01-02T03:04:05Z", entry["timestamp"])
+		assert.Equal(t, true, entry["proxybench_success"])
+	}
+
+	msg, err = message(ts, 0, map[string]interface{}{"run_verdict": "healthy"})
+	if assert.NoError(t, err) {
+		assert.Nil(t, msg.Key)
+	}
+}
+
+func TestSASLMechanism(t *testing.T) {
+	mechanism, err := saslMechanism(&Opts{})
+	assert.NoError(t, err)
+	assert.Nil(t, mechanism)
+
+	for _, name := range []string{"PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512"} {
+		mechanism, err := saslMechanism(&Opts{SASLMechanism: name, Username: "user", Password: "pass"})
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, name, mechanism.Name())
+		}
+	}
+
+	_, err = saslMechanism(&Opts{SASLMechanism: "GSSAPI"})
+	assert.Error(t, err)
+}
+
+func TestFlush(t *testing.T) {
+	r := &Reporter{pending: 2}
+	r.completed(make([]kafka.Message, 1), nil)
+	r.completed(make([]kafka.Message, 1), errors.New("failed"))
+	assert.NoError(t, r.Flush(), "completed reports should no longer be pending")
+	assert.EqualValues(t, 1, r.Dropped())
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(&Opts{Topic: "proxybench"})
+	assert.Error(t, err, "brokers are required")
+	_, err = New(&Opts{Brokers: []string{"localhost:9092"}})
+	assert.Error(t, err, "topic is required")
+	r, err := New(&Opts{Brokers: []string{"localhost:9092"}, Topic: "proxybench", SASLMechanism: "PLAIN"})
+	if assert.NoError(t, err) {
+		assert.NoError(t, r.Close())
+	}
+}
@@ -0,0 +1,73 @@
+package proxybench
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/getlantern/ops"
+)
+
+// benchKeepAlive fetches origin through p opts.KeepAliveRequests times in a
+// row over a single kept-alive connection, and additionally reports the
+// latency of the first request against that of the subsequent ones, which
+// quantifies the overhead of setting up a connection through the proxy. Only
+// the first request counts towards the aggregate stats, since the others
+// aren't comparable with regular requests.
+func (rn *run) benchKeepAlive(origin string, p *Proxy, enqueued time.Time) {
+	opts := rn.opts
+	proxy := rn.attempt(p.withRandomProtocol(), enqueued)
+	proxyFN, done, err := proxyFunc(rn.ctx, opts, rn.reporter(), origin, proxy)
+	if err != nil {
+		rn.outcomes.record(proxy, origin, 0, err)
+		return
+	}
+	defer done()
+	transport := &http.Transport{
+		Proxy:              proxyFN,
+		ProxyConnectHeader: proxy.proxyHeader(),
+		ForceAttemptHTTP2:  opts.EnableHTTP2,
+		MaxConnsPerHost:    1,
+	}
+	defer transport.CloseIdleConnections()
+
+	var first, subsequent time.Duration
+	for i := 0; i < opts.KeepAliveRequests; i++ {
+		rn.pacer.wait(rn.ctx, opts, origin)
+		var reused bool
+		ctx := httptrace.WithClientTrace(rn.ctx, &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				reused = info.Reused
+			},
+		})
+		index := i
+		report := func(timing time.Duration, ctx map[string]interface{}) {
+			ctx["keepalive_index"] = index
+			ctx["conn_reused"] = reused
+			rn.reporter()(timing, ctx)
+		}
+		timing, err := doRequest(ctx, opts, report, origin, proxy, transport)
+		rn.outcomes.record(proxy, origin, timing, err)
+		if i == 0 && rn.ctx.Err() == nil {
+			rn.record(origin, proxy, timing, err)
+		}
+		if err != nil || timing <= 0 {
+			log.Debugf("Not comparing keep-alive latencies for %v, request %d failed", p.key(), i)
+			return
+		}
+		if i == 0 {
+			first = timing
+		} else {
+			subsequent += timing
+		}
+	}
+	subsequent /= time.Duration(opts.KeepAliveRequests - 1)
+
+	op := beginOp(opts, origin, proxy).
+		Set("keepalive_requests", opts.KeepAliveRequests).
+		Set("keepalive_first_latency", first.Seconds()).
+		Set("keepalive_subsequent_latency", subsequent.Seconds()).
+		Set("keepalive_setup_overhead", (first - subsequent).Seconds())
+	defer op.End()
+	rn.reporter()(0, ops.AsMap(op, true))
+}
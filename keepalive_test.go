@@ -0,0 +1,36 @@
+package proxybench
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeepAlive(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	var reported []map[string]interface{}
+	r := &Runner{ctx: context.Background(), stats: newStats()}
+	r.SetReporter(func(timing time.Duration, ctx map[string]interface{}) {
+		reported = append(reported, ctx)
+	})
+	rn := r.newRun(&Opts{KeepAliveRequests: 3}, false)
+	rn.benchKeepAlive(srv.URL, &Proxy{Addrs: map[string]string{protocolSystem: ""}}, time.Now())
+
+	if !assert.Len(t, reported, 4) {
+		return
+	}
+	for i, expected := range []bool{false, true, true} {
+		assert.Equal(t, i, reported[i]["keepalive_index"])
+		assert.Equal(t, expected, reported[i]["conn_reused"], "request %d", i)
+	}
+	assert.Equal(t, 3, reported[3]["keepalive_requests"])
+	assert.NotNil(t, reported[3]["keepalive_setup_overhead"])
+}
@@ -0,0 +1,65 @@
+package proxybench
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/getlantern/ops"
+)
+
+// defaultMonitorInterval is used in place of non-positive monitoring intervals,
+// which would otherwise benchmark in a busy loop.
+const defaultMonitorInterval = 1 * time.Second
+
+// Monitor continuously benchmarks a single proxy over each of its protocols
+// every interval, for live debugging of a problematic proxy. Unlike Start, it
+// ignores SampleRate and Period and doesn't fetch updated Opts. If interval
+// isn't positive, it defaults to 1 second.
+func Monitor(opts *Opts, p *Proxy, interval time.Duration, report ReportFN) *Runner {
+	return MonitorContext(context.Background(), opts, p, interval, report)
+}
+
+// MonitorContext is like Monitor, but stops once ctx is done or the Runner is
+// stopped.
+func MonitorContext(ctx context.Context, opts *Opts, p *Proxy, interval time.Duration, report ReportFN) *Runner {
+	return MonitorWithReporter(ctx, opts, p, interval, report)
+}
+
+// MonitorWithReporter is like MonitorContext, but reports to a Reporter.
+func MonitorWithReporter(ctx context.Context, opts *Opts, p *Proxy, interval time.Duration, rep Reporter) *Runner {
+	if interval <= 0 {
+		log.Errorf("Invalid monitoring interval %v, defaulting to %v", interval, defaultMonitorInterval)
+		interval = defaultMonitorInterval
+	}
+	r := newRunner(ctx, opts, rep)
+	r.serveStatus(opts)
+	ctx = r.ctx
+
+	protocols := make([]string, 0, len(p.Addrs))
+	for protocol := range p.Addrs {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+
+	ops.Go(func() {
+		defer close(r.done)
+		for {
+			rn := r.newRun(opts, false)
+			for _, target := range opts.targets() {
+				for _, protocol := range protocols {
+					if ctx.Err() != nil {
+						return
+					}
+					rn.request(target.URL, rn.attempt(p.withProtocol(protocol), time.Now()))
+				}
+			}
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	return r
+}
@@ -0,0 +1,84 @@
+package proxybench
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMonitor(t *testing.T) {
+	// Find a port that nothing is listening on
+	l, err := net.Listen("tcp", "localhost:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var mx sync.Mutex
+	var phases []interface{}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Proxy{Addrs: map[string]string{"https": addr}}
+	MonitorContext(ctx, &Opts{Targets: []*Target{&Target{URL: "http://example.com"}}}, p, 10*time.Millisecond, func(timing time.Duration, ctx map[string]interface{}) {
+		mx.Lock()
+		phases = append(phases, ctx["failure_phase"])
+		mx.Unlock()
+	})
+
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	mx.Lock()
+	reported := len(phases)
+	if assert.True(t, reported > 1, "should have benchmarked repeatedly") {
+		assert.Equal(t, failurePhaseTCPConnect, phases[0])
+	}
+	mx.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+	mx.Lock()
+	assert.Equal(t, reported, len(phases), "should stop once cancelled")
+	mx.Unlock()
+}
+
+func TestStop(t *testing.T) {
+	var mx sync.Mutex
+	reported := 0
+	p := &Proxy{Addrs: map[string]string{"https": "localhost:1"}}
+	r := Monitor(&Opts{Targets: []*Target{&Target{URL: "http://example.com"}}}, p, 10*time.Millisecond, func(timing time.Duration, ctx map[string]interface{}) {
+		mx.Lock()
+		reported++
+		mx.Unlock()
+	})
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, r.Close())
+
+	mx.Lock()
+	stoppedAt := reported
+	mx.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	mx.Lock()
+	assert.Equal(t, stoppedAt, reported, "shouldn't report after stopping")
+	mx.Unlock()
+}
+
+func TestMonitorDefaultsInterval(t *testing.T) {
+	var mx sync.Mutex
+	reported := 0
+	p := &Proxy{Addrs: map[string]string{"https": "localhost:1"}}
+	r := Monitor(&Opts{Targets: []*Target{&Target{URL: "http://example.com"}}}, p, 0, func(timing time.Duration, ctx map[string]interface{}) {
+		mx.Lock()
+		reported++
+		mx.Unlock()
+	})
+	time.Sleep(200 * time.Millisecond)
+	assert.NoError(t, r.Close())
+
+	mx.Lock()
+	assert.Equal(t, 1, reported, "should wait the default interval between rounds instead of busy looping")
+	mx.Unlock()
+}
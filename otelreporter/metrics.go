@@ -0,0 +1,126 @@
+package otelreporter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// metricLabels maps the report fields that identify the proxy of each request
+// to the metric attributes that carry them
+var metricLabels = []struct{ field, attr string }{
+	{"proxy_host", "proxy"},
+	{"proxy_protocol", "protocol"},
+	{"proxy_provider", "provider"},
+	{"proxy_datacenter", "datacenter"},
+}
+
+// MetricsReporter records the following metrics about the outcome of each
+// request reported by proxybench, attributed by proxy, protocol, provider and
+// datacenter:
+//
+//   - proxybench.request.duration, a histogram of the latency of successful
+//     requests in seconds
+//   - proxybench.request.failures, a counter of failed requests, additionally
+//     attributed by failure reason
+//
+// Reports that don't describe an individual request, like run summaries, are
+// ignored.
+type MetricsReporter struct {
+	duration metric.Float64Histogram
+	failures metric.Int64Counter
+	flush    func(context.Context) error
+	shutdown func(context.Context) error
+}
+
+// NewMetricsReporter creates a MetricsReporter that records metrics using the
+// given MeterProvider.
+func NewMetricsReporter(mp metric.MeterProvider) (*MetricsReporter, error) {
+	meter := mp.Meter(instrumentationName)
+	duration, err := meter.Float64Histogram("proxybench.request.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("Latency of successful requests through proxies."))
+	if err != nil {
+		return nil, err
+	}
+	failures, err := meter.Int64Counter("proxybench.request.failures",
+		metric.WithUnit("{request}"),
+		metric.WithDescription("Failed requests through proxies."))
+	if err != nil {
+		return nil, err
+	}
+	return &MetricsReporter{
+		duration: duration,
+		failures: failures,
+		flush:    func(context.Context) error { return nil },
+		shutdown: func(context.Context) error { return nil },
+	}, nil
+}
+
+// NewOTLPMetricsReporter creates a MetricsReporter that periodically exports
+// metrics over OTLP/HTTP, configured by the given options and the standard
+// OTEL_EXPORTER_OTLP_* environment variables.
+func NewOTLPMetricsReporter(ctx context.Context, opts ...otlpmetrichttp.Option) (*MetricsReporter, error) {
+	exporter, err := otlpmetrichttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create OTLP metric exporter: %v", err)
+	}
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter)),
+		sdkmetric.WithResource(newResource()),
+	)
+	r, err := NewMetricsReporter(mp)
+	if err != nil {
+		mp.Shutdown(ctx)
+		return nil, err
+	}
+	r.flush = mp.ForceFlush
+	r.shutdown = mp.Shutdown
+	return r, nil
+}
+
+// Report records the metrics for a report. It implements proxybench.Reporter.
+func (r *MetricsReporter) Report(result proxybench.Result) {
+	if !result.IsRequest {
+		return
+	}
+	ctx := result.Fields
+	attrs := make([]attribute.KeyValue, 0, len(metricLabels)+1)
+	for _, label := range metricLabels {
+		if value, found := ctx[label.field]; found {
+			attrs = append(attrs, attribute.String(label.attr, fmt.Sprint(value)))
+		}
+	}
+	if result.Success {
+		if result.Timing > 0 {
+			r.duration.Record(context.Background(), result.Timing.Seconds(), metric.WithAttributes(attrs...))
+		}
+		return
+	}
+	if reason, found := ctx["failure_reason"]; found {
+		attrs = append(attrs, attribute.String("failure_reason", fmt.Sprint(reason)))
+	}
+	r.failures.Add(context.Background(), 1, metric.WithAttributes(attrs...))
+}
+
+// Flush exports any metrics that haven't been exported yet, if the
+// MetricsReporter exports them itself.
+func (r *MetricsReporter) Flush() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return r.flush(ctx)
+}
+
+// Close exports any metrics that haven't been exported yet, if the
+// MetricsReporter exports them itself.
+func (r *MetricsReporter) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return r.shutdown(ctx)
+}
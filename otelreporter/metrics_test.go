@@ -0,0 +1,61 @@
+package otelreporter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestMetricsReporter(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	r, err := NewMetricsReporter(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxy := map[string]interface{}{"proxy_protocol": "https", "proxy_provider": "do"}
+	with := func(fields map[string]interface{}) map[string]interface{} {
+		ctx := map[string]interface{}{}
+		for key, value := range proxy {
+			ctx[key] = value
+		}
+		for key, value := range fields {
+			ctx[key] = value
+		}
+		return ctx
+	}
+	r.Report(proxybench.NewResult(1*time.Second, with(map[string]interface{}{"proxybench_success": true})))
+	r.Report(proxybench.NewResult(3*time.Second, with(map[string]interface{}{"proxybench_success": true})))
+	r.Report(proxybench.NewResult(0, with(map[string]interface{}{"proxybench_success": false, "failure_reason": "dial"})))
+	r.Report(proxybench.NewResult(0, with(map[string]interface{}{"proxy_fully_down": true})))
+
+	var rm metricdata.ResourceMetrics
+	if !assert.NoError(t, reader.Collect(context.Background(), &rm)) || !assert.Len(t, rm.ScopeMetrics, 1) {
+		return
+	}
+	metrics := make(map[string]metricdata.Metrics)
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+
+	duration := metrics["proxybench.request.duration"].Data.(metricdata.Histogram[float64])
+	if assert.Len(t, duration.DataPoints, 1) {
+		point := duration.DataPoints[0]
+		assert.EqualValues(t, 2, point.Count)
+		assert.Equal(t, 4.0, point.Sum)
+		protocol, _ := point.Attributes.Value("protocol")
+		assert.Equal(t, "https", protocol.AsString())
+	}
+
+	failures := metrics["proxybench.request.failures"].Data.(metricdata.Sum[int64])
+	if assert.Len(t, failures.DataPoints, 1) {
+		point := failures.DataPoints[0]
+		assert.EqualValues(t, 1, point.Value)
+		assert.True(t, point.Attributes.HasValue(attribute.Key("failure_reason")))
+	}
+}
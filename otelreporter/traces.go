@@ -0,0 +1,158 @@
+// Package otelreporter publishes proxybench reports to OpenTelemetry as traces
+// and metrics.
+package otelreporter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	instrumentationName = "github.com/getlantern/proxybench"
+	serviceName         = "proxybench"
+)
+
+// TraceReporter creates a span for each request reported by proxybench, with
+// child spans for the DNS lookup, dial, TLS handshake and transfer phases
+// where those were timed. Since reports only carry the duration of each
+// phase, the phases are laid out in sequence from the start of the request,
+// with the transfer ending when the request does. All report fields are
+// recorded as attributes prefixed with "proxybench.". Reports that don't
+// describe an individual request, like run summaries, are ignored.
+type TraceReporter struct {
+	tracer   trace.Tracer
+	flush    func(context.Context) error
+	shutdown func(context.Context) error
+}
+
+// NewTraceReporter creates a TraceReporter that creates spans using the given
+// TracerProvider.
+func NewTraceReporter(tp trace.TracerProvider) *TraceReporter {
+	return &TraceReporter{
+		tracer:   tp.Tracer(instrumentationName),
+		flush:    func(context.Context) error { return nil },
+		shutdown: func(context.Context) error { return nil },
+	}
+}
+
+// NewOTLPTraceReporter creates a TraceReporter that exports spans in batches
+// over OTLP/HTTP, configured by the given options and the standard
+// OTEL_EXPORTER_OTLP_* environment variables.
+func NewOTLPTraceReporter(ctx context.Context, opts ...otlptracehttp.Option) (*TraceReporter, error) {
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create OTLP trace exporter: %v", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(newResource()),
+	)
+	r := NewTraceReporter(tp)
+	r.flush = tp.ForceFlush
+	r.shutdown = tp.Shutdown
+	return r, nil
+}
+
+// Report creates the spans for a report. It implements proxybench.Reporter.
+func (r *TraceReporter) Report(result proxybench.Result) {
+	if !result.IsRequest {
+		return
+	}
+	ctx := result.Fields
+	end := result.Time
+	duration := result.Timing
+	if !result.Success {
+		duration = seconds(ctx, "failure_time")
+	}
+	start := end.Add(-duration)
+
+	parent, span := r.tracer.Start(context.Background(), "proxybench.request",
+		trace.WithTimestamp(start),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attributes(ctx)...))
+	if !result.Success {
+		span.SetStatus(codes.Error, fmt.Sprint(ctx["failure_error"]))
+	}
+
+	phaseStart := start
+	for _, phase := range []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"dns", result.DNSTime},
+		{"dial", result.ConnectTime},
+		{"tls_handshake", result.TLSHandshakeTime},
+	} {
+		if d := phase.duration; d > 0 {
+			r.child(parent, phase.name, phaseStart, phaseStart.Add(d))
+			phaseStart = phaseStart.Add(d)
+		}
+	}
+	if transfer := result.TransferTime; transfer > 0 {
+		r.child(parent, "transfer", end.Add(-transfer), end)
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+func (r *TraceReporter) child(parent context.Context, name string, start time.Time, end time.Time) {
+	_, span := r.tracer.Start(parent, name, trace.WithTimestamp(start))
+	span.End(trace.WithTimestamp(end))
+}
+
+// Flush exports any spans that haven't been exported yet, if the
+// TraceReporter exports them itself.
+func (r *TraceReporter) Flush() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return r.flush(ctx)
+}
+
+// Close flushes any spans that haven't been exported yet, if the
+// TraceReporter exports them itself.
+func (r *TraceReporter) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return r.shutdown(ctx)
+}
+
+func newResource() *resource.Resource {
+	return resource.NewSchemaless(semconv.ServiceName(serviceName))
+}
+
+// attributes converts report fields to span attributes.
+func attributes(ctx map[string]interface{}) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(ctx))
+	for key, value := range ctx {
+		key = "proxybench." + key
+		switch v := value.(type) {
+		case bool:
+			attrs = append(attrs, attribute.Bool(key, v))
+		case int:
+			attrs = append(attrs, attribute.Int(key, v))
+		case int64:
+			attrs = append(attrs, attribute.Int64(key, v))
+		case float64:
+			attrs = append(attrs, attribute.Float64(key, v))
+		default:
+			attrs = append(attrs, attribute.String(key, fmt.Sprint(v)))
+		}
+	}
+	return attrs
+}
+
+// seconds returns the duration in the given report field, which is in
+// seconds, or 0 if there isn't one.
+func seconds(ctx map[string]interface{}, field string) time.Duration {
+	s, _ := ctx[field].(float64)
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,56 @@
+package otelreporter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraceReporter(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	r := NewTraceReporter(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	r.Report(proxybench.NewResult(1*time.Second, map[string]interface{}{
+		"url":                "https://a.com",
+		"proxybench_success": true,
+		"connect_time":       0.1,
+		"tls_handshake_time": 0.2,
+		"transfer_time":      0.3,
+	}))
+	r.Report(proxybench.NewResult(0, map[string]interface{}{"proxybench_success": false, "failure_time": 0.5, "failure_error": "boom"}))
+	r.Report(proxybench.NewResult(0, map[string]interface{}{"run_verdict": true}))
+	assert.NoError(t, r.Close())
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	var requests []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "proxybench.request" {
+			requests = append(requests, span)
+		} else {
+			spans[span.Name()] = span
+		}
+	}
+	if !assert.Len(t, requests, 2) || !assert.Len(t, spans, 3) {
+		return
+	}
+	request := requests[0]
+	assert.Equal(t, 1*time.Second, request.EndTime().Sub(request.StartTime()))
+	assert.Contains(t, request.Attributes(), attribute.String("proxybench.url", "https://a.com"))
+
+	dial, tls, transfer := spans["dial"], spans["tls_handshake"], spans["transfer"]
+	assert.Equal(t, request.SpanContext().SpanID(), dial.Parent().SpanID())
+	assert.Equal(t, request.StartTime(), dial.StartTime())
+	assert.Equal(t, dial.EndTime(), tls.StartTime(), "phases should be laid out in sequence")
+	assert.Equal(t, 200*time.Millisecond, tls.EndTime().Sub(tls.StartTime()))
+	assert.Equal(t, request.EndTime(), transfer.EndTime())
+
+	failed := requests[1]
+	assert.Equal(t, 500*time.Millisecond, failed.EndTime().Sub(failed.StartTime()))
+	assert.Equal(t, codes.Error, failed.Status().Code)
+	assert.Equal(t, "boom", failed.Status().Description)
+}
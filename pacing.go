@@ -0,0 +1,62 @@
+package proxybench
+
+import (
+	"context"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// originPacer spaces out consecutive requests to the same origin host so that
+// we don't burst any single origin, and optionally all requests so that the
+// overall load on proxies and origins stays bounded.
+type originPacer struct {
+	next       map[string]time.Time
+	nextGlobal time.Time
+	mx         sync.Mutex
+}
+
+func newOriginPacer() *originPacer {
+	return &originPacer{next: make(map[string]time.Time)}
+}
+
+// wait blocks until it's okay to make another request to origin, based on
+// opts.PerOriginDelay and opts.MinRequestInterval, or until ctx is done.
+func (op *originPacer) wait(ctx context.Context, opts *Opts, origin string) {
+	if op == nil || (opts.PerOriginDelay <= 0 && opts.MinRequestInterval <= 0) {
+		return
+	}
+
+	op.mx.Lock()
+	now := time.Now()
+	slot := now
+	if opts.MinRequestInterval > 0 {
+		if op.nextGlobal.After(slot) {
+			slot = op.nextGlobal
+		}
+	}
+	var host string
+	if opts.PerOriginDelay > 0 {
+		if u, err := url.Parse(origin); err == nil {
+			host = u.Hostname()
+			if op.next[host].After(slot) {
+				slot = op.next[host]
+			}
+		}
+	}
+	if opts.MinRequestInterval > 0 {
+		op.nextGlobal = slot.Add(opts.MinRequestInterval)
+	}
+	if host != "" {
+		// Add +/- 20% jitter to the delay
+		delay := time.Duration(float64(opts.PerOriginDelay) * (0.8 + rand.Float64()*0.4))
+		op.next[host] = slot.Add(delay)
+	}
+	op.mx.Unlock()
+
+	select {
+	case <-time.After(slot.Sub(now)):
+	case <-ctx.Done():
+	}
+}
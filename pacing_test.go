@@ -0,0 +1,26 @@
+package proxybench
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinRequestInterval(t *testing.T) {
+	pacer := newOriginPacer()
+	opts := &Opts{MinRequestInterval: 50 * time.Millisecond}
+	start := time.Now()
+	pacer.wait(context.Background(), opts, "https://a.com")
+	pacer.wait(context.Background(), opts, "https://b.com")
+	pacer.wait(context.Background(), opts, "https://c.com")
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 100*time.Millisecond, "requests to different origins should still be spaced out, took %v", elapsed)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start = time.Now()
+	pacer.wait(ctx, opts, "https://a.com")
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "waiting should stop once ctx is done")
+}
@@ -0,0 +1,110 @@
+package proxybench
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/getlantern/ops"
+)
+
+// phaseTimer times the phases of a request using httptrace. When going
+// through a local relay, the connect and TLS phases are those of the
+// connection to the relay and of the tunnelled connection to the origin
+// respectively, while dialing the proxy itself counts towards the time to
+// first byte.
+type phaseTimer struct {
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	dns          time.Duration
+	connect      time.Duration
+	tlsHandshake time.Duration
+	firstByte    time.Duration
+	mx           sync.Mutex
+}
+
+func newPhaseTimer(start time.Time) *phaseTimer {
+	return &phaseTimer{start: start}
+}
+
+// trace returns a ClientTrace that records phase timings. Its hooks may be
+// called concurrently.
+func (pt *phaseTimer) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			pt.mx.Lock()
+			pt.dnsStart = time.Now()
+			pt.mx.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			pt.mx.Lock()
+			if info.Err == nil && !pt.dnsStart.IsZero() {
+				pt.dns = time.Since(pt.dnsStart)
+			}
+			pt.mx.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			pt.mx.Lock()
+			pt.connectStart = time.Now()
+			pt.mx.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			pt.mx.Lock()
+			if err == nil && !pt.connectStart.IsZero() {
+				pt.connect = time.Since(pt.connectStart)
+			}
+			pt.mx.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			pt.mx.Lock()
+			pt.tlsStart = time.Now()
+			pt.mx.Unlock()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			pt.mx.Lock()
+			if err == nil && !pt.tlsStart.IsZero() {
+				pt.tlsHandshake = time.Since(pt.tlsStart)
+			}
+			pt.mx.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			pt.mx.Lock()
+			pt.firstByte = time.Since(pt.start)
+			pt.mx.Unlock()
+		},
+	}
+}
+
+// set sets the timings of whichever phases completed on op. Phases that
+// didn't happen, like DNS lookups for IP addresses or TLS handshakes for
+// plain HTTP, are omitted.
+func (pt *phaseTimer) set(op ops.Op) {
+	pt.mx.Lock()
+	defer pt.mx.Unlock()
+	if pt.dns > 0 {
+		op.Set("dns_time", pt.dns.Seconds())
+	}
+	if pt.connect > 0 {
+		op.Set("connect_time", pt.connect.Seconds())
+	}
+	if pt.tlsHandshake > 0 {
+		op.Set("tls_handshake_time", pt.tlsHandshake.Seconds())
+	}
+	if pt.firstByte > 0 {
+		op.Set("ttfb", pt.firstByte.Seconds())
+	}
+}
+
+// setTransfer sets how long it took to read the response body, from the first
+// byte until done, on op.
+func (pt *phaseTimer) setTransfer(op ops.Op, done time.Time) {
+	pt.mx.Lock()
+	firstByte := pt.firstByte
+	pt.mx.Unlock()
+	if firstByte > 0 {
+		op.Set("transfer_time", done.Sub(pt.start.Add(firstByte)).Seconds())
+	}
+}
@@ -0,0 +1,35 @@
+package proxybench
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPhaseTimings(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	var reported map[string]interface{}
+	report := func(timing time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	}
+	proxy := (&Proxy{Addrs: map[string]string{"https": "localhost:1"}}).withProtocol("https")
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = true
+	_, err := doRequest(context.Background(), &Opts{}, report, srv.URL, proxy, transport)
+	if !assert.NoError(t, err) || !assert.NotNil(t, reported) {
+		return
+	}
+	for _, field := range []string{"connect_time", "tls_handshake_time", "ttfb", "transfer_time", "throughput_bps"} {
+		assert.Contains(t, reported, field)
+	}
+	assert.EqualValues(t, len("hello"), reported["response_bytes"])
+	assert.NotContains(t, reported, "dns_time", "no DNS lookup for an IP address")
+}
@@ -0,0 +1,139 @@
+// Package promreporter maintains Prometheus metrics from proxybench reports
+// and optionally serves them for scraping.
+package promreporter
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxybench"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "proxybench"
+
+var (
+	log = golog.LoggerFor("proxybench.promreporter")
+
+	// labels identify the proxy and protocol of each request
+	labels = []string{"proxy", "protocol", "provider", "datacenter"}
+)
+
+// Reporter updates Prometheus metrics with the outcome of each request
+// reported by proxybench:
+//
+//   - proxybench_request_duration_seconds, a histogram of the latency of
+//     successful requests
+//   - proxybench_requests_total, a counter of requests by result ("success"
+//     or "failure")
+//   - proxybench_bytes_total, a counter of bytes transferred by direction
+//     ("down" or "up")
+//
+// Reports that don't describe an individual request, like run summaries, are
+// ignored.
+type Reporter struct {
+	registry *prometheus.Registry
+	latency  *prometheus.HistogramVec
+	requests *prometheus.CounterVec
+	bytes    *prometheus.CounterVec
+}
+
+// New creates a Reporter with its own registry.
+func New() *Reporter {
+	r := &Reporter{
+		registry: prometheus.NewRegistry(),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Latency of successful requests through proxies.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}, labels),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Requests through proxies by result.",
+		}, append(labels, "result")),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bytes_total",
+			Help:      "Bytes transferred through proxies by direction.",
+		}, append(labels, "direction")),
+	}
+	r.registry.MustRegister(r.latency, r.requests, r.bytes)
+	return r
+}
+
+// Report updates the metrics. It implements proxybench.Reporter.
+func (r *Reporter) Report(result proxybench.Result) {
+	if !result.IsRequest {
+		return
+	}
+	ctx := result.Fields
+	values := make([]string, 0, len(labels)+1)
+	for _, key := range []string{"proxy_host", "proxy_protocol", "proxy_provider", "proxy_datacenter"} {
+		values = append(values, label(ctx[key]))
+	}
+	if result.Success {
+		r.requests.WithLabelValues(append(values, "success")...).Inc()
+		if result.Timing > 0 {
+			r.latency.WithLabelValues(values...).Observe(result.Timing.Seconds())
+		}
+	} else {
+		r.requests.WithLabelValues(append(values, "failure")...).Inc()
+	}
+	if n := count(ctx["response_bytes"]); n > 0 {
+		r.bytes.WithLabelValues(append(values, "down")...).Add(n)
+	}
+	if n := count(ctx["request_bytes"]) + count(ctx["upload_bytes"]); n > 0 {
+		r.bytes.WithLabelValues(append(values, "up")...).Add(n)
+	}
+}
+
+// Flush implements proxybench.Reporter. Metrics are updated as they're
+// reported, so there's nothing to flush.
+func (r *Reporter) Flush() error {
+	return nil
+}
+
+// Close implements proxybench.Reporter. The metrics remain available for
+// scraping.
+func (r *Reporter) Close() error {
+	return nil
+}
+
+// Handler returns an http.Handler that serves the metrics for scraping.
+func (r *Reporter) Handler() http.Handler {
+	return promhttp.HandlerFor(r.registry, promhttp.HandlerOpts{})
+}
+
+// ListenAndServe serves the metrics at /metrics on the given address until
+// there's an error.
+func (r *Reporter) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", r.Handler())
+	log.Debugf("Serving metrics at http://%v/metrics", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func label(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// count converts a numeric report field to a float64, or 0 if it isn't one.
+func count(value interface{}) float64 {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float64:
+		return v
+	default:
+		return 0
+	}
+}
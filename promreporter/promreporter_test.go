@@ -0,0 +1,51 @@
+package promreporter
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter(t *testing.T) {
+	r := New()
+	proxy := map[string]interface{}{
+		"proxy_host":       "1.2.3.4",
+		"proxy_protocol":   "https",
+		"proxy_provider":   "do",
+		"proxy_datacenter": "ams",
+	}
+	with := func(fields map[string]interface{}) map[string]interface{} {
+		ctx := make(map[string]interface{})
+		for key, value := range proxy {
+			ctx[key] = value
+		}
+		for key, value := range fields {
+			ctx[key] = value
+		}
+		return ctx
+	}
+	r.Report(proxybench.NewResult(200*time.Millisecond, with(map[string]interface{}{"proxybench_success": true, "response_bytes": int64(1000)})))
+	r.Report(proxybench.NewResult(0, with(map[string]interface{}{"proxybench_success": false})))
+	r.Report(proxybench.NewResult(0, with(map[string]interface{}{"proxybench_success": true, "upload_bytes": 500})))
+	r.Report(proxybench.NewResult(0, with(map[string]interface{}{"proxy_fully_down": true})))
+
+	srv := httptest.NewServer(r.Handler())
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	metrics := string(body)
+	labels := `datacenter="ams",protocol="https",provider="do",proxy="1.2.3.4"`
+	assert.Contains(t, metrics, `proxybench_requests_total{`+labels+`,result="success"} 2`)
+	assert.Contains(t, metrics, `proxybench_requests_total{`+labels+`,result="failure"} 1`)
+	assert.Contains(t, metrics, `proxybench_request_duration_seconds_count{`+labels+`} 1`)
+	assert.Contains(t, metrics, `proxybench_bytes_total{datacenter="ams",direction="down",protocol="https",provider="do",proxy="1.2.3.4"} 1000`)
+	assert.Contains(t, metrics, `proxybench_bytes_total{datacenter="ams",direction="up",protocol="https",provider="do",proxy="1.2.3.4"} 500`)
+}
@@ -0,0 +1,59 @@
+package proxybench
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+// ProtocolDialer dials the proxy at addr using a custom transport, with the
+// proxy's PTArgs for the protocol (which may be nil).
+type ProtocolDialer func(addr string, args map[string]string) (net.Conn, error)
+
+var (
+	customProtocols   = make(map[string]ProtocolDialer)
+	customProtocolsMx sync.RWMutex
+)
+
+// RegisterProtocol registers a dialer for proxies' addresses under the given
+// protocol name, so that applications can benchmark transports that
+// proxybench doesn't support itself. The proxy at the other end is expected
+// to be an HTTP proxy, just like for the built-in protocols. Registering a
+// built-in protocol replaces its dialer.
+func RegisterProtocol(name string, dial ProtocolDialer) {
+	customProtocolsMx.Lock()
+	defer customProtocolsMx.Unlock()
+	customProtocols[name] = dial
+}
+
+func customProtocol(name string) (ProtocolDialer, bool) {
+	customProtocolsMx.RLock()
+	defer customProtocolsMx.RUnlock()
+	dial, found := customProtocols[name]
+	return dial, found
+}
+
+// allProtocols returns the built-in protocols followed by any additional
+// registered ones.
+func allProtocols() []string {
+	customProtocolsMx.RLock()
+	defer customProtocolsMx.RUnlock()
+	all := append([]string(nil), protocols...)
+	var custom []string
+	for name := range customProtocols {
+		if !isBuiltinProtocol(name) {
+			custom = append(custom, name)
+		}
+	}
+	sort.Strings(custom)
+	return append(all, custom...)
+}
+
+func isBuiltinProtocol(name string) bool {
+	for _, protocol := range protocols {
+		if protocol == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package proxybench
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterProtocol(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	originURL, _ := url.Parse(origin.URL)
+
+	dialedArgs := make(chan map[string]string, 1)
+	RegisterProtocol("custom", func(addr string, args map[string]string) (net.Conn, error) {
+		dialedArgs <- args
+		// The origin doubles as an HTTP proxy, since it doesn't care about
+		// absolute request URIs.
+		return net.Dial("tcp", addr)
+	})
+	defer func() {
+		customProtocolsMx.Lock()
+		delete(customProtocols, "custom")
+		customProtocolsMx.Unlock()
+	}()
+
+	p := &Proxy{
+		Addrs:  map[string]string{"custom": originURL.Host},
+		PTArgs: map[string]map[string]string{"custom": {"key": "value"}},
+	}
+	proxy := p.withRandomProtocol()
+	assert.Equal(t, "custom", proxy.protocol)
+	timing, err := request(context.Background(), &Opts{}, func(time.Duration, map[string]interface{}) {}, origin.URL, proxy)
+	if assert.NoError(t, err) {
+		assert.True(t, timing > 0)
+		assert.Equal(t, map[string]string{"key": "value"}, <-dialedArgs)
+	}
+}
@@ -3,50 +3,329 @@
 package proxybench
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/golog"
+	"github.com/getlantern/lampshade"
 	"github.com/getlantern/netx"
 	"github.com/getlantern/ops"
 	"github.com/oxtoacart/bpool"
+	utls "github.com/refraction-networking/utls"
 
 	"git.torproject.org/pluggable-transports/goptlib.git"
+	"git.torproject.org/pluggable-transports/obfs4.git/transports/meeklite"
 	"git.torproject.org/pluggable-transports/obfs4.git/transports/obfs4"
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
 )
 
 var (
 	log          = golog.LoggerFor("proxybench")
 	buffers      = bpool.NewBytePool(10, 65536)
-	protocols    = []string{"https", "obfs4"}
+	protocols    = []string{"https", "obfs4", "socks5", "http", "shadowsocks", "lampshade", "quic", "wss", "meek", "snowflake"}
 	testingProxy = ""
+
+	// lampshadeBuffers is shared by all lampshade dialers
+	lampshadeBuffers = lampshade.NewBufferPool(10 * 1024 * 1024)
+
+	// comparedProtocols are the protocols compared head to head when
+	// Opts.CompareProtocols is set. Deltas are relative to the first.
+	comparedProtocols = []string{"https", "obfs4"}
+)
+
+const (
+	// maxPlausibleTiming bounds the latency we're willing to report. Anything
+	// beyond this (or negative) is almost certainly the result of a clock jump,
+	// for example when a mobile device wakes from sleep.
+	maxPlausibleTiming = 10 * time.Minute
+
+	// maxClockDrift is how far the wall clock may diverge from the monotonic
+	// clock during a single request before we consider the clock unreliable.
+	maxClockDrift = 5 * time.Second
+
+	// discardedTiming is returned in place of a timing that was discarded
+	// because of a clock anomaly. The request succeeded, but it mustn't count
+	// as either a success or a failure.
+	discardedTiming = time.Duration(-1)
+
+	// defaultRequestTimeout is used if Opts.RequestTimeout isn't set
+	defaultRequestTimeout = 1 * time.Minute
+
+	// maxUpdateSize is the largest updated Opts that we're willing to fetch
+	maxUpdateSize = 10 * 1024 * 1024
+
+	// maxUpdateProxyAttempts is how many of the configured proxies to try
+	// fetching updated Opts through if fetching them directly fails
+	maxUpdateProxyAttempts = 3
+
+	// defaultOBFS4IATMode disables inter-arrival time obfuscation
+	defaultOBFS4IATMode = "0"
+
+	// defaultOBFS4Cert is the obfs4 cert used if the proxy doesn't specify one
+	defaultOBFS4Cert = "1LYfzzTyz7xsu0bTBUJacwDTLN3NU/gNSjC+pfdRVNuh/LYmtbLOlhZwCfNTKyUVvfMTWQ"
+
+	// lampshadeWindowSize and lampshadeMaxPadding are the lampshade flow
+	// control window (in frames) and maximum random padding of the client
+	// init message
+	lampshadeWindowSize = 50
+	lampshadeMaxPadding = 100
+
+	// protocolSystem identifies a pseudo-proxy that uses whatever proxy the
+	// system is configured with (via the HTTP_PROXY family of environment
+	// variables), for comparing against the system's own proxy. Such a proxy
+	// is configured with an empty "system" address.
+	protocolSystem = "system"
+
+	// maxListenRetries is how many times to retry listening for the local
+	// relay, starting with a backoff of minListenBackoff
+	maxListenRetries = 3
+	minListenBackoff = 50 * time.Millisecond
+
+	// authTokenHeader carries Proxy.AuthToken
+	authTokenHeader = "X-Lantern-Auth-Token"
+
+	// failurePhaseTCPConnect means that we couldn't reach the proxy at all
+	failurePhaseTCPConnect = "tcp_connect"
+	// failurePhaseHandshake means that we reached the proxy but the TLS or
+	// obfs4 handshake failed
+	failurePhaseHandshake = "proxy_handshake"
 )
 
 type Proxy struct {
 	Addrs      map[string]string `json:"addrs"`
 	Provider   string            `json:"provider"`
 	DataCenter string            `json:"dataCenter"`
+
+	// FrontDomain, if set, is sent as the SNI when connecting to the proxy
+	// over https or wss, for proxies reached via a fronting domain. The https
+	// or wss address should then be the address of the front. For meek, it's
+	// the front to which requests are sent, and for snowflake the front for
+	// the broker.
+	FrontDomain string `json:"frontDomain"`
+
+	// SOCKS5Username and SOCKS5Password are the credentials for the socks5
+	// address, if it requires username/password authentication.
+	SOCKS5Username string `json:"socks5Username"`
+	SOCKS5Password string `json:"socks5Password"`
+
+	// ShadowsocksCipher and ShadowsocksPassword configure the shadowsocks
+	// address. The cipher is one of the AEAD ciphers, for example
+	// "chacha20-ietf-poly1305".
+	ShadowsocksCipher   string `json:"shadowsocksCipher"`
+	ShadowsocksPassword string `json:"shadowsocksPassword"`
+
+	// LampshadeCert is the PEM-encoded certificate of the lampshade address,
+	// whose RSA public key is used to encrypt the session keys.
+	LampshadeCert string `json:"lampshadeCert"`
+
+	// WSSPath and WSSHeaders are the path of the WebSocket tunnel endpoint at
+	// the wss address and any additional headers to send when connecting to
+	// it. When fronting, the Host header can be set here.
+	WSSPath    string            `json:"wssPath"`
+	WSSHeaders map[string]string `json:"wssHeaders"`
+
+	// MeekURL is the URL of the meek server for the meek address.
+	MeekURL string `json:"meekURL"`
+
+	// SnowflakeBrokerURL and SnowflakeSTUNServers configure the rendezvous
+	// for the snowflake address, which only identifies the bridge since
+	// connections go through whichever Snowflake the broker hands out. STUN
+	// servers are URLs like "stun:stun.l.google.com:19302".
+	SnowflakeBrokerURL   string   `json:"snowflakeBrokerURL"`
+	SnowflakeSTUNServers []string `json:"snowflakeSTUNServers"`
+
+	// PTArgs are transport-specific parameters by protocol, like the "cert"
+	// and "iat-mode" for obfs4, the "url" and "front" for meek or the
+	// "cipher" and "password" for shadowsocks. They take precedence over the
+	// dedicated fields above and over compiled-in defaults.
+	PTArgs map[string]map[string]string `json:"ptArgs"`
+
+	// AuthToken, if set, is sent to the proxy in the X-Lantern-Auth-Token
+	// header, as required by Lantern's chained proxies.
+	AuthToken string `json:"authToken"`
+
+	// Username and Password, if set, authenticate to the proxy using basic
+	// auth via Proxy-Authorization, or as the socks5 credentials if
+	// SOCKS5Username isn't set.
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// Cert (PEM-encoded) or CertPin (the base64-encoded SHA-256 hash of the
+	// SubjectPublicKeyInfo), if set, is the certificate that the proxy must
+	// present over https, wss or quic. Mismatches fail the request, since
+	// they suggest that something is intercepting traffic to the proxy.
+	Cert    string `json:"cert"`
+	CertPin string `json:"certPin"`
+
+	// TLSFingerprint, if set, makes the ClientHello sent to https proxies
+	// mimic a browser's, either "chrome", "firefox" or "randomized". Otherwise
+	// it's Go's own.
+	TLSFingerprint string `json:"tlsFingerprint"`
+
+	// RequestTimeout, if set, is a duration like "30s" that overrides
+	// Opts.RequestTimeout for requests through this proxy.
+	RequestTimeout string `json:"requestTimeout"`
 }
 
+// requestTimeout returns the timeout for requests through p, falling back to
+// opts.RequestTimeout if p doesn't have a valid one of its own.
+func (p *Proxy) requestTimeout(opts *Opts) time.Duration {
+	if p.RequestTimeout != "" {
+		timeout, err := time.ParseDuration(p.RequestTimeout)
+		if err == nil && timeout > 0 {
+			return timeout
+		}
+		log.Debugf("Ignoring invalid request timeout %v for %v", p.RequestTimeout, p.key())
+	}
+	return opts.requestTimeout()
+}
+
+// withRandomProtocol picks one of the protocols for which p has an address at
+// random.
 func (p *Proxy) withRandomProtocol() *proxy {
-	protocol := protocols[rand.Intn(len(protocols))]
-	return &proxy{p, protocol, p.Addrs[protocol]}
+	if _, isSystem := p.Addrs[protocolSystem]; isSystem {
+		return p.withProtocol(protocolSystem)
+	}
+	candidates := allProtocols()
+	available := make([]string, 0, len(candidates))
+	for _, protocol := range candidates {
+		if p.Addrs[protocol] != "" {
+			available = append(available, protocol)
+		}
+	}
+	if len(available) == 0 {
+		available = protocols
+	}
+	return p.withProtocol(available[rand.Intn(len(available))])
+}
+
+func (p *Proxy) withProtocol(protocol string) *proxy {
+	return &proxy{Proxy: p, protocol: protocol, addr: p.Addrs[protocol]}
+}
+
+// String identifies the proxy in logs. Formatting the struct itself would race
+// with the dialer, which updates its fields while requests are in flight.
+func (p *proxy) String() string {
+	return p.protocol + "=" + p.addr
+}
+
+// key identifies a Proxy by its set of protocol addresses, independent of the
+// order in which they appear in the config.
+func (p *Proxy) key() string {
+	addrs := make([]string, 0, len(p.Addrs))
+	for protocol, addr := range p.Addrs {
+		addrs = append(addrs, protocol+"="+addr)
+	}
+	sort.Strings(addrs)
+	return strings.Join(addrs, ",")
 }
 
 type proxy struct {
 	*Proxy
-	protocol string
-	addr     string
+	protocol   string
+	addr       string
+	newlyAdded bool
+	// enqueued is when the request was queued for execution
+	enqueued time.Time
+
+	// tcpConn is the raw TCP connection to the proxy, once dialed
+	tcpConn net.Conn
+	// tlsHandshakeComplete is whether the TLS handshake with an https proxy
+	// completed, and alpn is the protocol negotiated in it
+	tlsHandshakeComplete bool
+	alpn                 string
+	// obfs4IATMode is the iat-mode with which we actually dialed obfs4
+	obfs4IATMode string
+	// failurePhase is the stage at which dialing the proxy failed, if it did
+	failurePhase string
+	// relayAddr is the bound address of the local relay to the proxy
+	relayAddr string
+	// dialAttempts are the attempts to connect to each of the proxy's IPs
+	dialAttempts []dialAttempt
+	// crossRunReuse is whether a warm connection from a previous run was
+	// reused, if using warm connections
+	crossRunReuse *bool
+	// quicHandshake is how long the QUIC handshake with the proxy took
+	quicHandshake time.Duration
+	// snowflakeRendezvous is how long it took to be matched with a Snowflake
+	snowflakeRendezvous time.Duration
+	// certRejected is whether the proxy presented an unexpected certificate
+	certRejected bool
+	// tcpInfo is the latest TCP_INFO snapshot, if using ReportTCPInfo
+	tcpInfo *tcpInfoSnapshot
+	mx      sync.Mutex
 }
 
+// Target is a URL to benchmark along with options for benchmarking it.
+type Target struct {
+	URL string `json:"url"`
+
+	// Critical targets must succeed through at least one proxy for a run to
+	// be considered healthy.
+	Critical bool `json:"critical"`
+
+	// ExpectContentType, if set, is the media type that responses must have,
+	// like "image/png". A type wildcard like "image/*" is also allowed.
+	// Responses with other content types (for example captive portal pages)
+	// are treated as failures.
+	ExpectContentType string `json:"expectContentType"`
+
+	// ExpectHTTPVersion, if set, is the HTTP version with which the origin
+	// must respond, like "HTTP/2.0" or "HTTP/1.1". Responses over other
+	// versions are treated as failures. HTTP/2 requires EnableHTTP2.
+	ExpectHTTPVersion string `json:"expectHTTPVersion"`
+
+	// Method is the HTTP method with which to request the URL. Defaults to
+	// GET.
+	Method string `json:"method"`
+
+	// Headers are additional request headers, including Host.
+	Headers map[string]string `json:"headers"`
+
+	// Body is sent as the request body. Alternatively, BodySize sends a body
+	// of that many zero bytes, for benchmarking uploads of a given size.
+	Body     string `json:"body"`
+	BodySize int    `json:"bodySize"`
+
+	// ExpectBytes, if set, is the exact size of the response body, for
+	// downloading known-size payloads. Responses that are shorter (including
+	// ones cut short before their Content-Length) are reported as truncated
+	// rather than being mistaken for successes.
+	ExpectBytes int64 `json:"expectBytes"`
+}
+
+// Opts configures benchmarking.
+//
+// Settings whose values are strings, numbers, booleans or lists of strings can
+// be overridden with environment variables named PROXYBENCH_ followed by the
+// JSON name in upper snake case, like PROXYBENCH_SAMPLE_RATE, PROXYBENCH_PERIOD
+// or PROXYBENCH_UPDATE_URL. Lists are comma-separated. These take precedence
+// over both local and fetched Opts.
 type Opts struct {
 	SampleRate   float64 `json:"sampleRate"`
 	Period       time.Duration
@@ -54,23 +333,336 @@ type Opts struct {
 	Proxies      []*Proxy `json:"proxies"`
 	URLs         []string `json:"urls"`
 	UpdateURL    string   `json:"updateURL"`
+
+	// UpdatePeriod, if set, is how often to fetch updated Opts from the
+	// UpdateURL, independently of Period and of whether a run is sampled, so
+	// that config changes and new proxies are picked up promptly even if
+	// Period is long. By default, updates are only fetched before each
+	// potential run.
+	UpdatePeriod       time.Duration
+	UpdatePeriodString string `json:"updatePeriod"`
+
+	// Targets are benchmarked in addition to URLs and allow specifying
+	// additional options per URL.
+	Targets []*Target `json:"targets"`
+
+	// BenchNewProxies causes proxies that appear in an updated config to be
+	// benchmarked immediately, regardless of SampleRate.
+	BenchNewProxies bool `json:"benchNewProxies"`
+
+	// SimulatedBandwidth, if positive, caps the throughput of the local relay
+	// to the given number of bytes per second in each direction in order to
+	// simulate a slow client connection. This is meant for testing and
+	// research and is off by default.
+	SimulatedBandwidth int `json:"simulatedBandwidth"`
+
+	// ReportTCPInfo reports the kernel's smoothed RTT and retransmit count for
+	// the connection to the proxy. Only supported on Linux.
+	ReportTCPInfo bool `json:"reportTCPInfo"`
+
+	// CompareProtocols benchmarks each proxy over https and obfs4 back to back
+	// for every URL and additionally reports a head-to-head comparison. It
+	// takes precedence over the other benchmark modes (HTTP2Streams,
+	// KeepAliveRequests and SamplesPerTarget), which are ignored when it's set.
+	CompareProtocols bool `json:"compareProtocols"`
+
+	// SamplesPerTarget, if greater than 1, fetches each URL through each proxy
+	// that many times per run and additionally reports the min, max, mean and
+	// percentiles of the successful samples. It's ignored if CompareProtocols,
+	// KeepAliveRequests or (for https URLs) HTTP2Streams is set.
+	SamplesPerTarget int `json:"samplesPerTarget"`
+
+	// KeepAliveRequests, if greater than 1, fetches each URL through each
+	// proxy that many times in a row over a single kept-alive connection and
+	// additionally reports the latency of the first request against that of
+	// the subsequent ones. It takes precedence over SamplesPerTarget, but is
+	// ignored if CompareProtocols or (for https URLs) HTTP2Streams is set.
+	KeepAliveRequests int `json:"keepAliveRequests"`
+
+	// HTTP2Streams, if greater than 1, fetches each https URL through each
+	// proxy with that many concurrent requests multiplexed over a single
+	// HTTP/2 connection to the origin, and additionally reports how long they
+	// took altogether. HTTP/2 is negotiated for these regardless of
+	// EnableHTTP2. It takes precedence over KeepAliveRequests and
+	// SamplesPerTarget for https URLs, but is ignored if CompareProtocols is
+	// set.
+	HTTP2Streams int `json:"http2Streams"`
+
+	// AnomalyThreshold, if positive, enables detection of regressions for each
+	// proxy, protocol and URL. A successful request whose latency is more than
+	// AnomalyThreshold standard deviations above the rolling mean is flagged,
+	// as is a recent success rate that has dropped more than
+	// AnomalySuccessDrop (default 0.2) below the long-term success rate.
+	// Anomalies are reported and passed to the handler set with
+	// Runner.SetAnomalyHandler once each time they start, and only after
+	// AnomalyMinSamples (default 10) requests have established a baseline.
+	AnomalyThreshold   float64 `json:"anomalyThreshold"`
+	AnomalySuccessDrop float64 `json:"anomalySuccessDrop"`
+	AnomalyMinSamples  int     `json:"anomalyMinSamples"`
+
+	// StatsFile, if set, is where aggregate stats are persisted so that they
+	// survive restarts. It's loaded on Start and saved after every run. This
+	// is a local setting and is carried over when fetching updated Opts.
+	StatsFile string `json:"-"`
+
+	// DirectBaseline additionally fetches each URL directly, without a proxy,
+	// to establish a baseline from the client's own network. Baselines are
+	// fetched at the start of each run, and successful proxied requests to
+	// the same URLs report the overhead added by the proxy.
+	DirectBaseline bool `json:"directBaseline"`
+
+	// BaselineIssuers optionally maps origin hostnames to the certificate
+	// issuer organizations we expect to see when fetching them directly. If
+	// the baseline sees a different issuer, it's flagged as intercepted.
+	BaselineIssuers map[string][]string `json:"baselineIssuers"`
+
+	// ReportFields, if set, limits the fields included in the context passed
+	// to the ReportFN to the given ones. By default, all fields are included.
+	ReportFields []string `json:"reportFields"`
+
+	// FailureBias, if positive, biases each run toward proxies that have
+	// failed recently. A proxy that has been failing consistently is always
+	// benchmarked while a perfectly healthy one is only benchmarked with a
+	// probability of 1 / (1 + FailureBias).
+	FailureBias float64 `json:"failureBias"`
+
+	// IsolateBy runs benchmarks concurrently in separate queues per "proxy"
+	// or per "provider", so that one slow proxy or provider can't hold up the
+	// others. By default, everything runs sequentially in a single queue.
+	IsolateBy string `json:"isolateBy"`
+
+	// ConcurrencyPerGroup is the number of requests that may run concurrently
+	// within each isolated queue. Defaults to 1.
+	ConcurrencyPerGroup int `json:"concurrencyPerGroup"`
+
+	// Concurrency is the maximum number of requests that may run at once. By
+	// default, requests run sequentially unless IsolateBy is set, in which case
+	// this caps the total across all queues.
+	Concurrency int `json:"concurrency"`
+
+	// WebSocketURLs are ws:// or wss:// URLs to which we benchmark upgrading
+	// to a WebSocket through each proxy.
+	WebSocketURLs []string `json:"webSocketURLs"`
+
+	// WebSocketPing additionally measures the round trip time of a ping over
+	// each successfully upgraded WebSocket.
+	WebSocketPing bool `json:"webSocketPing"`
+
+	// PerOriginDelay is the delay (with some jitter) between consecutive
+	// requests to the same origin host, to avoid tripping the origin's rate
+	// limits. Defaults to no delay.
+	PerOriginDelay       time.Duration
+	PerOriginDelayString string `json:"perOriginDelay"`
+
+	// MinRequestInterval is the minimum delay between any two requests, which
+	// caps the rate of requests (and hence the added load on proxies and
+	// origins) regardless of how many proxies and URLs there are or how
+	// concurrently they're benchmarked. Defaults to no delay.
+	MinRequestInterval       time.Duration
+	MinRequestIntervalString string `json:"minRequestInterval"`
+
+	// RequestTimeout is how long to wait for each request to complete,
+	// including reading the response body. Individual proxies can override
+	// it. Defaults to 1 minute.
+	RequestTimeout       time.Duration
+	RequestTimeoutString string `json:"requestTimeout"`
+
+	// ShuffleOrder randomizes the order in which targets and proxies are
+	// benchmarked on each run, to avoid systematically measuring the same
+	// endpoints at the same point in a run.
+	ShuffleOrder bool `json:"shuffleOrder"`
+
+	// BenchDoH additionally benchmarks resolving DoHQueryName using
+	// DNS-over-HTTPS against DoHURL through each proxy.
+	BenchDoH bool `json:"benchDoH"`
+
+	// DoHURL is the DNS-over-HTTPS endpoint used when BenchDoH is enabled.
+	// Defaults to Cloudflare's.
+	DoHURL string `json:"dohURL"`
+
+	// DoHQueryName is the name resolved when BenchDoH is enabled. Defaults to
+	// example.com.
+	DoHQueryName string `json:"dohQueryName"`
+
+	// BenchTLSResumption additionally benchmarks TLS session resumption with
+	// each proxy that has an https address, by performing a full handshake
+	// followed by one that resumes its session, and reporting the latency of
+	// both.
+	BenchTLSResumption bool `json:"benchTLSResumption"`
+
+	// UploadURL, if set, is an endpoint that accepts POSTs, to which we
+	// additionally benchmark uploading UploadBytes (default 1 MB) of random
+	// data through each proxy, since upstream throughput is often throttled
+	// differently from downstream.
+	UploadURL   string `json:"uploadURL"`
+	UploadBytes int    `json:"uploadBytes"`
+
+	// CaptivePortalCheck checks whether we're behind a captive portal before
+	// each run by fetching CaptivePortalURL directly. If we are, the run is
+	// skipped, since every request would just be intercepted by the portal.
+	CaptivePortalCheck bool `json:"captivePortalCheck"`
+
+	// CaptivePortalURL must respond with 204 No Content when not behind a
+	// captive portal. Defaults to Google's connectivity check.
+	CaptivePortalURL string `json:"captivePortalURL"`
+
+	// StatsHalfLife, if set, enables time-decayed aggregation of stats, in
+	// which the weight of each sample halves every StatsHalfLife. This tracks
+	// current health more closely than the per-sample EMA. Besides the mean,
+	// decayed latency percentiles are estimated from a histogram of samples.
+	StatsHalfLife       time.Duration
+	StatsHalfLifeString string `json:"statsHalfLife"`
+
+	// SlowThreshold, if set, marks reports whose timing exceeds it as slow.
+	SlowThreshold       time.Duration
+	SlowThresholdString string `json:"slowThreshold"`
+
+	// WarmConnections keeps connections to proxies open across runs and
+	// reuses them where possible, to measure the steady-state performance
+	// experienced by long-lived clients rather than always connecting cold.
+	WarmConnections bool `json:"warmConnections"`
+
+	// MaxRetries is the number of times to retry a failed request.
+	MaxRetries int `json:"maxRetries"`
+
+	// RetryBudget limits the total number of retries across all requests in a
+	// run, so that a network on which everything fails doesn't cause a retry
+	// storm. Zero means no limit beyond MaxRetries.
+	RetryBudget int `json:"retryBudget"`
+
+	// EnableHTTP2 advertises h2 via ALPN when connecting to https proxies and
+	// allows HTTP/2 to origins.
+	EnableHTTP2 bool `json:"enableHTTP2"`
+
+	// HTTP3 sends requests to quic proxies over HTTP/3, rather than tunnelling
+	// HTTP/1.1 over a QUIC stream. Only https targets can be requested this
+	// way, others (and warm connections) still use a tunnel.
+	HTTP3 bool `json:"http3"`
+
+	// BeforeRequest, if set, is called with every request right before it's
+	// sent, allowing it to be modified (for example to add headers). This runs
+	// while the request is being timed, so it should be quick. This is a local
+	// setting and is carried over when fetching updated Opts.
+	BeforeRequest func(req *http.Request, proxy *Proxy) `json:"-"`
+
+	// BootstrapProxy, if set, is an obfs4 proxy through which to fetch updated
+	// Opts when fetching them directly fails, for networks in which TLS to the
+	// UpdateURL is blocked. If that fails too, a few of the configured Proxies
+	// are tried. This is a local setting and is carried over when fetching
+	// updated Opts.
+	BootstrapProxy *Proxy `json:"-"`
+
+	// Reporters, if set, receive every report in addition to the ReportFN or
+	// Reporter the Runner was started with. Each is isolated from the others,
+	// so one that panics or fails to flush doesn't affect the rest. This is a
+	// local setting and is carried over when fetching updated Opts.
+	Reporters []Reporter `json:"-"`
+
+	// StatusAddr, if set, is the address (like "127.0.0.1:7070") on which to
+	// serve the status of the Runner as JSON at /proxybench/status. It should
+	// normally be a loopback address. This is a local setting and is carried
+	// over when fetching updated Opts.
+	StatusAddr string `json:"-"`
+
+	// StatusDashboard additionally serves a web dashboard at /proxybench/ on
+	// the StatusAddr, showing the stats and recent latency history of every
+	// proxy and protocol. This is a local setting and is carried over when
+	// fetching updated Opts.
+	StatusDashboard bool `json:"-"`
+
+	// UpdatePublicKey, if set, is the Ed25519 public key with which Opts
+	// fetched from the UpdateURL must be signed. The signature of the exact
+	// JSON is fetched from the UpdateURL with ".sig" appended, base64 encoded.
+	// Unsigned or incorrectly signed Opts are rejected and the current ones
+	// kept. This is a local setting and is carried over when fetching updated
+	// Opts.
+	UpdatePublicKey ed25519.PublicKey `json:"-"`
+
+	// UpdateClient, if set, is the http.Client used to fetch updated Opts
+	// directly from the UpdateURL, for example one configured with client
+	// certificates or a corporate proxy. It defaults to http.DefaultClient.
+	// This is a local setting and is carried over when fetching updated Opts.
+	UpdateClient *http.Client `json:"-"`
+
+	// UpdateHeader contains extra headers, like Authorization, to send when
+	// fetching updated Opts (and their signature) from the UpdateURL. This is
+	// a local setting and is carried over when fetching updated Opts.
+	UpdateHeader http.Header `json:"-"`
+
+	// DefaultSampleRate, if positive, is the SampleRate used when none is
+	// configured, instead of 5%. Unlike SampleRate, it's a local setting and is
+	// carried over when fetching updated Opts, so it also applies to fetched
+	// Opts that don't specify a SampleRate.
+	DefaultSampleRate float64 `json:"-"`
+
+	// newProxies are the proxies that weren't present in the config that this
+	// one replaced.
+	newProxies []*Proxy
+
+	// updateValidators are the ETag and Last-Modified of the response from
+	// which these Opts were fetched, for making the next fetch conditional.
+	updateValidators updateValidators
+}
+
+// benchModes returns the names of the mutually exclusive benchmark modes that
+// are enabled, in order of precedence.
+func (opts *Opts) benchModes() []string {
+	var modes []string
+	if opts.CompareProtocols {
+		modes = append(modes, "compareProtocols")
+	}
+	if opts.HTTP2Streams > 1 {
+		modes = append(modes, "http2Streams")
+	}
+	if opts.KeepAliveRequests > 1 {
+		modes = append(modes, "keepAliveRequests")
+	}
+	if opts.SamplesPerTarget > 1 {
+		modes = append(modes, "samplesPerTarget")
+	}
+	return modes
 }
 
 func (opts *Opts) applyDefaults() {
 	testingMode := testingProxy != ""
+	opts.applyEnv(os.LookupEnv)
 	if opts.PeriodString != "" {
 		opts.Period, _ = time.ParseDuration(opts.PeriodString)
 	}
 	if opts.Period <= 0 {
 		opts.Period = 1 * time.Hour
 	}
+	if opts.UpdatePeriodString != "" {
+		opts.UpdatePeriod, _ = time.ParseDuration(opts.UpdatePeriodString)
+	}
+	if opts.SlowThresholdString != "" {
+		opts.SlowThreshold, _ = time.ParseDuration(opts.SlowThresholdString)
+	}
+	if opts.StatsHalfLifeString != "" {
+		opts.StatsHalfLife, _ = time.ParseDuration(opts.StatsHalfLifeString)
+	}
+	if opts.PerOriginDelayString != "" {
+		opts.PerOriginDelay, _ = time.ParseDuration(opts.PerOriginDelayString)
+	}
+	if opts.MinRequestIntervalString != "" {
+		opts.MinRequestInterval, _ = time.ParseDuration(opts.MinRequestIntervalString)
+	}
+	if opts.RequestTimeoutString != "" {
+		opts.RequestTimeout, _ = time.ParseDuration(opts.RequestTimeoutString)
+	}
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = defaultRequestTimeout
+	}
+	if opts.SampleRate <= 0 {
+		opts.SampleRate = opts.DefaultSampleRate
+	}
 	if opts.SampleRate <= 0 {
 		opts.SampleRate = 0.05 // 5%
 	}
 	if opts.UpdateURL == "" && !testingMode {
 		opts.UpdateURL = "https://s3.amazonaws.com/lantern/proxybench.json"
 	}
-	if len(opts.URLs) == 0 {
+	if len(opts.URLs) == 0 && len(opts.Targets) == 0 {
 		opts.URLs = []string{
 			"https://www.google.com/humans.txt",
 			"https://www.facebook.com/humans.txt",
@@ -79,125 +671,780 @@ func (opts *Opts) applyDefaults() {
 			"http://149.154.167.91/",                                         // Telegram Instant Messenger
 		}
 	}
+	if opts.ConcurrencyPerGroup <= 0 {
+		opts.ConcurrencyPerGroup = 1
+	}
+	if opts.CaptivePortalURL == "" {
+		opts.CaptivePortalURL = defaultCaptivePortalURL
+	}
+	if opts.DoHURL == "" {
+		opts.DoHURL = defaultDoHURL
+	}
+	if opts.DoHQueryName == "" {
+		opts.DoHQueryName = defaultDoHQueryName
+	}
+	for _, field := range opts.ReportFields {
+		if !knownReportFields[field] {
+			log.Debugf("Ignoring unknown report field %v unless it is set globally", field)
+		}
+	}
+	if modes := opts.benchModes(); len(modes) > 1 {
+		log.Errorf("Benchmark modes %v can't be combined, only the first applicable one is used for each URL", strings.Join(modes, ", "))
+	}
 	if testingMode {
 		log.Debug("Overriding urls and proxy in testing mode")
 		opts.SampleRate = 1
 		opts.URLs = []string{"http://i.ytimg.com/vi/video_id/0.jpg"}
+		opts.Targets = nil
 		opts.Proxies = []*Proxy{&Proxy{Addrs: map[string]string{"https": testingProxy}, Provider: "testingProvider", DataCenter: "testingDC"}}
 	}
 }
 
+// targets returns all Targets to benchmark, including the URLs.
+func (opts *Opts) targets() []*Target {
+	targets := make([]*Target, 0, len(opts.URLs)+len(opts.Targets))
+	for _, u := range opts.URLs {
+		targets = append(targets, &Target{URL: u})
+	}
+	return append(targets, opts.Targets...)
+}
+
+// target returns the configured Target for the given URL, if any.
+func (opts *Opts) target(u string) *Target {
+	for _, target := range opts.Targets {
+		if target.URL == u {
+			return target
+		}
+	}
+	return nil
+}
+
+// newRequest builds a request for origin as configured by the Target, which
+// may be nil for plain URLs.
+func (t *Target) newRequest(origin string) (*http.Request, error) {
+	if t == nil {
+		return http.NewRequest("GET", origin, nil)
+	}
+	method := t.Method
+	if method == "" {
+		method = "GET"
+	}
+	var body io.Reader
+	if t.Body != "" {
+		body = strings.NewReader(t.Body)
+	} else if t.BodySize > 0 {
+		body = bytes.NewReader(make([]byte, t.BodySize))
+	}
+	req, err := http.NewRequest(method, origin, body)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range t.Headers {
+		if http.CanonicalHeaderKey(key) == "Host" {
+			req.Host = value
+		} else {
+			req.Header.Set(key, value)
+		}
+	}
+	return req, nil
+}
+
+// ReportFN receives the timing and context of each report. It implements
+// Reporter, so it can be used wherever a Reporter is expected.
 type ReportFN func(timing time.Duration, ctx map[string]interface{})
 
-func Start(opts *Opts, report ReportFN) {
-	opts.applyDefaults()
+// Runner is a handle on a benchmarking loop started with Start.
+type Runner struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+	report    atomic.Value // reporterHolder
+	anomalies anomalyDetector
+	onAnomaly atomic.Value // func(Anomaly)
+	lastRun   atomic.Value // runInfo
+	history   latencyHistory
+	status    *http.Server
+	flush     atomic.Value // func() error
+	sampler   atomic.Value // samplerHolder
+	stats     *stats
+	pacer     *originPacer
+	warm      warmPool
+	opts      *Opts
+	optsMx    sync.RWMutex
+	refreshMx sync.Mutex
+}
+
+// SetReporter changes the ReportFN to which results are reported. Requests
+// that are already in flight continue to report to the previous ReportFN.
+func (r *Runner) SetReporter(report ReportFN) {
+	r.SetResultReporter(report)
+}
+
+// reporter returns the current ReportFN, limiting reports to the fields
+// configured in opts and marking slow timings.
+func (r *Runner) reporter(opts *Opts) ReportFN {
+	rep := r.resultReporter(opts)
+	report := ReportFN(func(timing time.Duration, ctx map[string]interface{}) {
+		rep.Report(NewResult(timing, ctx))
+	})
+	if len(opts.ReportFields) > 0 {
+		unfiltered := report
+		report = func(timing time.Duration, ctx map[string]interface{}) {
+			unfiltered(timing, filterFields(ctx, opts.ReportFields))
+		}
+	}
+	if opts.SlowThreshold <= 0 {
+		return report
+	}
+	return func(timing time.Duration, ctx map[string]interface{}) {
+		if timing > opts.SlowThreshold {
+			ctx["slow"] = true
+		}
+		report(timing, ctx)
+	}
+}
+
+// SetReportFlusher sets a function that Flush calls to wait for reports that
+// the ReportFN buffers to be delivered, like grpcreporter.Reporter.Flush.
+func (r *Runner) SetReportFlusher(flush func() error) {
+	r.flush.Store(flush)
+}
+
+// Flush synchronously reports a snapshot of the aggregate stats, persists
+// them to the StatsFile, if any, and waits for buffered reports to be
+// delivered by flushing the Reporter and Opts.Reporters and calling the
+// function set with SetReportFlusher. It's useful right before the process
+// might be killed, like when a mobile app is backgrounded.
+func (r *Runner) Flush() error {
+	opts := r.currentOpts()
+	report := r.reporter(opts)
+	for _, entry := range r.stats.snapshot() {
+		op := ops.Begin("proxybench").
+			Set("stats_snapshot", true).
+			Set("stats_proxy", entry.Proxy).
+			Set("proxy_protocol", entry.Protocol).
+			Set("proxy_provider", entry.Provider).
+			Set("proxy_datacenter", entry.DataCenter).
+			Set("stats_successes", entry.Successes).
+			Set("stats_failures", entry.Failures).
+			Set("stats_latency_ema", entry.LatencyEMA).
+			Set("stats_failure_ema", entry.FailureEMA)
+		report(0, ops.AsMap(op, true))
+		op.End()
+	}
+	if opts.StatsFile != "" {
+		if err := r.stats.save(opts.StatsFile); err != nil {
+			return fmt.Errorf("Unable to save stats to %v: %v", opts.StatsFile, err)
+		}
+	}
+	if err := r.resultReporter(opts).Flush(); err != nil {
+		return err
+	}
+	if flush, _ := r.flush.Load().(func() error); flush != nil {
+		return flush()
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the aggregate stats for every proxy and
+// protocol benchmarked so far.
+func (r *Runner) Stats() []StatsEntry {
+	return r.stats.snapshot()
+}
+
+// EffectiveOpts returns the JSON serialization of the Opts currently in use,
+// including defaults and fetched updates. See Opts.MarshalEffective.
+func (r *Runner) EffectiveOpts() ([]byte, error) {
+	return r.currentOpts().MarshalEffective()
+}
+
+func (r *Runner) currentOpts() *Opts {
+	r.optsMx.RLock()
+	defer r.optsMx.RUnlock()
+	return r.opts
+}
+
+// RefreshConfig synchronously fetches updated Opts from the UpdateURL and
+// applies them, returning whether the configuration actually changed. It's
+// safe to call concurrently with the benchmarking loop.
+func (r *Runner) RefreshConfig() (changed bool, err error) {
+	r.refreshMx.Lock()
+	defer r.refreshMx.Unlock()
+	current := r.currentOpts()
+	newOpts, err := current.FetchUpdate(r.ctx)
+	if err != nil || newOpts == current {
+		return false, err
+	}
+	if bytes.Equal(newOpts.hash(), current.hash()) {
+		log.Debug("Updated options are unchanged")
+		// Remember the validators so that the next fetch can be conditional.
+		// They're only accessed while refreshing.
+		current.updateValidators = newOpts.updateValidators
+		return false, nil
+	}
+	log.Debug("Applying updated options")
+	r.optsMx.Lock()
+	r.opts = newOpts
+	r.optsMx.Unlock()
+	return true, nil
+}
+
+func (r *Runner) saveStats(opts *Opts) {
+	if opts.StatsFile == "" {
+		return
+	}
+	if err := r.stats.save(opts.StatsFile); err != nil {
+		log.Errorf("Unable to save stats to %v: %v", opts.StatsFile, err)
+	}
+}
+
+func Start(opts *Opts, report ReportFN) *Runner {
+	return StartContext(context.Background(), opts, report)
+}
+
+// StartContext is like Start, but stops benchmarking once ctx is done. If ctx
+// is cancelled in the middle of a run, the results gathered so far are still
+// reported, followed by a run_cancelled report summarizing how much of the run
+// was completed.
+func StartContext(ctx context.Context, opts *Opts, report ReportFN) *Runner {
+	return StartWithReporter(ctx, opts, report)
+}
+
+// StartWithReporter is like StartContext, but reports to a Reporter.
+func StartWithReporter(ctx context.Context, opts *Opts, rep Reporter) *Runner {
+	r := newRunner(ctx, opts, rep)
+	if opts.StatsFile != "" {
+		r.stats = loadStats(opts.StatsFile)
+	}
+	// Only serve the status once the stats are loaded
+	r.serveStatus(opts)
+	ctx = r.ctx
 
 	ops.Go(func() {
+		defer close(r.done)
+		var nextRun time.Time
 		for {
-			opts = opts.fetchUpdate()
-			if rand.Float64() < opts.SampleRate {
-				log.Debugf("Running benchmarks")
-				bench(opts, report)
+			changed, err := r.RefreshConfig()
+			if err != nil {
+				log.Errorf("Unable to refresh config: %v", err)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			opts := r.currentOpts()
+			if changed && time.Until(nextRun) > opts.Period {
+				// Don't keep waiting out a Period that's since been shortened
+				nextRun = time.Now().Add(opts.Period)
+			}
+			if opts.BenchNewProxies && len(opts.newProxies) > 0 {
+				log.Debugf("Benchmarking %d newly added proxies", len(opts.newProxies))
+				r.newRun(opts, true).bench(opts.newProxies)
+				opts.newProxies = nil
+				r.saveStats(opts)
+			}
+			if !time.Now().Before(nextRun) {
+				if r.shouldSample(opts) {
+					log.Debugf("Running benchmarks")
+					r.bench(opts)
+					r.saveStats(opts)
+				}
+				// Add +/- 20% to sleep time
+				sleepPeriod := time.Duration(float64(opts.Period) * (1.0 + (rand.Float64()-1.0)/5))
+				log.Debugf("Waiting %v before running again", sleepPeriod)
+				nextRun = time.Now().Add(sleepPeriod)
+			}
+			wait := time.Until(nextRun)
+			if opts.UpdatePeriod > 0 && opts.UpdatePeriod < wait {
+				// Wake up in time to poll for updated Opts
+				wait = opts.UpdatePeriod
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				log.Debugf("Stopping benchmarks: %v", ctx.Err())
+				return
 			}
-			// Add +/- 20% to sleep time
-			sleepPeriod := time.Duration(float64(opts.Period) * (1.0 + (rand.Float64()-1.0)/5))
-			log.Debugf("Waiting %v before running again", sleepPeriod)
-			time.Sleep(sleepPeriod)
 		}
 	})
+	return r
+}
+
+// newRunner creates a Runner with the given Opts (after applying defaults)
+// that runs until ctx is done or the Runner is stopped. The caller must close
+// r.done once the Runner's loop has finished.
+func newRunner(ctx context.Context, opts *Opts, rep Reporter) *Runner {
+	opts.applyDefaults()
+	ctx, cancel := context.WithCancel(ctx)
+	r := &Runner{
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		stats:  newStats(),
+		pacer:  newOriginPacer(),
+		opts:   opts,
+	}
+	r.SetResultReporter(rep)
+	return r
+}
+
+// Stop stops benchmarking, interrupting any run that's in progress, and waits
+// for the benchmarking loop to finish. Connections kept open by
+// WarmConnections are closed too, as are the status listener, the Reporter
+// and Opts.Reporters. Stats are saved to the StatsFile, if any.
+func (r *Runner) Stop() {
+	r.cancel()
+	<-r.done
+	r.saveStats(r.currentOpts())
+	r.warm.close()
+	if r.status != nil {
+		r.status.Close()
+	}
+	if err := r.resultReporter(r.currentOpts()).Close(); err != nil {
+		log.Errorf("Unable to close reporters: %v", err)
+	}
+}
+
+// Close is like Stop, but implements io.Closer.
+func (r *Runner) Close() error {
+	r.Stop()
+	return nil
+}
+
+// request fetches origin through the given proxy, reporting the result and
+// returning the measured timing.
+func request(ctx context.Context, opts *Opts, report ReportFN, origin string, proxy *proxy) (time.Duration, error) {
+	if proxy.usesHTTP3(opts, origin) {
+		return requestHTTP3(ctx, opts, report, origin, proxy)
+	}
+	proxyFN, done, err := proxyFunc(ctx, opts, report, origin, proxy)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	return doRequest(ctx, opts, report, origin, proxy, &http.Transport{
+		Proxy:              proxyFN,
+		ProxyConnectHeader: proxy.proxyHeader(),
+		DisableKeepAlives:  true,
+		ForceAttemptHTTP2:  opts.EnableHTTP2,
+	})
 }
 
-func bench(opts *Opts, report ReportFN) {
-	for _, origin := range opts.URLs {
-		for _, proxy := range opts.Proxies {
-			request(report, origin, proxy.withRandomProtocol())
+// proxyHeader returns the headers with which to authenticate to the proxy,
+// if it needs any and speaks HTTP.
+func (p *proxy) proxyHeader() http.Header {
+	switch p.protocol {
+	case protocolSystem, "socks5", "shadowsocks":
+		return nil
+	}
+	var header http.Header
+	if p.AuthToken != "" {
+		header = http.Header{authTokenHeader: []string{p.AuthToken}}
+	}
+	if p.Username != "" {
+		if header == nil {
+			header = make(http.Header)
 		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
+		header.Set("Proxy-Authorization", "Basic "+credentials)
 	}
+	return header
 }
 
-func request(report ReportFN, origin string, proxy *proxy) {
+// proxyFunc returns a function for use as http.Transport.Proxy that routes
+// requests through the given proxy, along with a function to call once done
+// with it. If the local relay can't be set up, that's reported as a failure
+// to fetch origin.
+func proxyFunc(ctx context.Context, opts *Opts, report ReportFN, origin string, proxy *proxy) (func(*http.Request) (*url.URL, error), func(), error) {
+	if proxy.protocol == protocolSystem {
+		return http.ProxyFromEnvironment, func() {}, nil
+	}
 	// http.Transport can't talk to HTTPS proxies, so we need an intermediary.
-	l, err := setupLocalProxy(proxy)
+	l, err := setupLocalProxy(ctx, opts, proxy)
 	if err != nil {
-		log.Errorf("Unable to set up local proxy for %v: %v", proxy.addr, err)
+		op := beginOp(opts, origin, proxy).Set("failure_reason", "listen")
+		report(0, ops.AsMap(op, true))
+		op.End()
+		return nil, nil, log.Errorf("Unable to set up local proxy for %v: %v", proxy.addr, err)
+	}
+	return http.ProxyURL(proxy.localProxyURL(l.Addr().String())), func() { l.Close() }, nil
+}
+
+// localProxyURL returns the URL by which http.Transport reaches the remote
+// proxy via the local relay at relayAddr.
+func (p *proxy) localProxyURL(relayAddr string) *url.URL {
+	switch p.protocol {
+	case "shadowsocks":
+		// The relay learns the target from http.Transport's SOCKS5 handshake
+		return &url.URL{Scheme: "socks5", Host: relayAddr}
+	case "socks5":
+		// The relay just forwards bytes, so http.Transport conducts the
+		// SOCKS5 handshake, including authentication, with the remote proxy.
+		u := &url.URL{Scheme: "socks5", Host: relayAddr}
+		if p.SOCKS5Username != "" {
+			u.User = url.UserPassword(p.SOCKS5Username, p.SOCKS5Password)
+		} else if p.Username != "" {
+			u.User = url.UserPassword(p.Username, p.Password)
+		}
+		return u
+	}
+	// Note - we're using HTTP here, but this is talking to the local proxy,
+	// which talks HTTPS (or obfs4, or plain HTTP) to the remote proxy.
+	return &url.URL{Scheme: "http", Host: relayAddr}
+}
+
+// setSystemProxy records which proxy, if any, the system uses for req.
+func setSystemProxy(op ops.Op, req *http.Request) {
+	op.Set("proxy_type", "system")
+	proxyURL, err := http.ProxyFromEnvironment(req)
+	if err != nil || proxyURL == nil {
+		op.Set("system_proxy_direct", true)
 		return
 	}
-	doRequest(report, origin, proxy, l.Addr().String())
-	l.Close()
+	op.Set("proxy_host", proxyURL.Hostname()).Set("proxy_port", proxyURL.Port())
 }
 
-func doRequest(report ReportFN, origin string, proxy *proxy, addr string) {
+// beginOp begins an op for a request to origin through the given proxy,
+// populated with the details of the proxy.
+func beginOp(opts *Opts, origin string, proxy *proxy) ops.Op {
 	op := ops.Begin("proxybench").
 		Set("url", origin).
 		Set("proxy_type", "chained").
 		Set("proxy_protocol", proxy.protocol).
 		Set("proxy_provider", proxy.Provider).
 		Set("proxy_datacenter", proxy.DataCenter)
-	defer op.End()
+	if proxy.newlyAdded {
+		op.Set("newly_added", true)
+	}
+	if opts.SimulatedBandwidth > 0 {
+		op.Set("simulated_bandwidth_bps", opts.SimulatedBandwidth)
+	}
 	host, port, _ := net.SplitHostPort(proxy.addr)
 	op.Set("proxy_host", host).Set("proxy_port", port)
+	if (proxy.protocol == "https" || proxy.protocol == "wss" || proxy.protocol == "meek") && proxy.FrontDomain != "" {
+		op.Set("front_domain", proxy.FrontDomain)
+	}
+	if proxy.protocol == "https" && proxy.TLSFingerprint != "" {
+		op.Set("tls_fingerprint", proxy.TLSFingerprint)
+	}
+	proxy.mx.Lock()
+	relayAddr := proxy.relayAddr
+	proxy.mx.Unlock()
+	if relayAddr != "" {
+		op.Set("local_relay_addr", relayAddr)
+	}
+	return op
+}
+
+func doRequest(ctx context.Context, opts *Opts, report ReportFN, origin string, proxy *proxy, transport http.RoundTripper) (time.Duration, error) {
+	op := beginOp(opts, origin, proxy)
+	defer op.End()
 
 	log.Debug("Making request")
+	timeout := proxy.requestTimeout(opts)
+	op.Set("request_timeout", timeout.Seconds())
 	client := &http.Client{
-		Timeout: 1 * time.Minute,
-		Transport: &http.Transport{
-			Proxy: func(req *http.Request) (*url.URL, error) {
-				// Note - we're using HTTP here, but this is talking to the local proxy,
-				// which talks HTTPS to the remote proxy.
-				return url.Parse("http://" + addr)
-			},
-			DisableKeepAlives: true,
-		},
+		Timeout:   timeout,
+		Transport: transport,
 	}
 	defer op.End()
 	start := time.Now()
-	req, err := http.NewRequest("GET", origin, nil)
+	if !proxy.enqueued.IsZero() {
+		// Time spent waiting to run isn't included in the timing, but it's
+		// useful to know when the runner itself is the bottleneck.
+		op.Set("queue_wait_time", start.Sub(proxy.enqueued).Seconds())
+	}
+	req, err := opts.target(origin).newRequest(origin)
 	if err != nil {
 		log.Debugf("Unable to build request for %v: %v", origin, err)
-		return
+		return 0, err
 	}
+	op.Set("request_method", req.Method)
+	if req.ContentLength > 0 {
+		op.Set("request_bytes", req.ContentLength)
+	}
+	phases := newPhaseTimer(start)
+	req = req.WithContext(httptrace.WithClientTrace(ctx, phases.trace()))
 	op.Set("origin", req.URL.Host).Set("origin_host", req.URL.Host)
+	if proxy.protocol == protocolSystem {
+		setSystemProxy(op, req)
+	}
+	if req.URL.Scheme == "http" || proxy.usesHTTP3(opts, origin) {
+		// The request itself goes to the proxy rather than through a tunnel
+		// (whose CONNECT carries the headers instead)
+		for key, values := range proxy.proxyHeader() {
+			req.Header[key] = values
+		}
+	}
+	if opts.BeforeRequest != nil {
+		opts.BeforeRequest(req, proxy.Proxy)
+	}
 	resp, err := client.Do(req)
+	phases.set(op)
 	if err != nil {
 		log.Debugf("Error fetching %v from %v: %v", origin, proxy, err)
-		return
+		if ctx.Err() != nil {
+			// Interrupted, not the proxy's fault
+			return 0, err
+		}
+		reason := failureReason(err)
+		if phase := proxy.dialFailurePhase(); phase != "" {
+			reason = "dial"
+			op.Set("failure_phase", phase)
+			proxy.setDialAttempts(op)
+		}
+		if proxy.certVerificationFailed() {
+			op.Set("cert_verification_failed", true)
+		}
+		if reason == "timeout" {
+			op.Set("request_timeout_hit", true)
+		}
+		reportFailure(report, op, reason, start, err)
+		return 0, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == 403 || resp.StatusCode == 500 {
 		log.Debugf("Unexpected status %v fetching %v from %v: %v", resp.Status, origin, proxy, err)
-		return
+		err := fmt.Errorf("Unexpected status %v", resp.Status)
+		op.Set("http_status", resp.StatusCode)
+		reportFailure(report, op, "status", start, err)
+		return 0, err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	op.Set("content_type", contentType).Set("http_proto", resp.Proto)
+	if target := opts.target(origin); target != nil {
+		if !contentTypeMatches(contentType, target.ExpectContentType) {
+			log.Debugf("Unexpected content type %v fetching %v from %v, expected %v", contentType, origin, proxy, target.ExpectContentType)
+			err := fmt.Errorf("Unexpected content type %v", contentType)
+			op.Set("content_type_mismatch", true)
+			reportFailure(report, op, "content_type", start, err)
+			return 0, err
+		}
+		if !httpVersionMatches(resp, target.ExpectHTTPVersion) {
+			log.Debugf("Unexpected HTTP version %v fetching %v from %v, expected %v", resp.Proto, origin, proxy, target.ExpectHTTPVersion)
+			err := fmt.Errorf("Unexpected HTTP version %v", resp.Proto)
+			op.Set("http_version_mismatch", true)
+			reportFailure(report, op, "http_version", start, err)
+			return 0, err
+		}
 	}
 	// Read the full response body
-	io.Copy(ioutil.Discard, resp.Body)
-	delta := time.Now().Sub(start)
-	op.Set("proxybench_success", true)
+	size, err := io.Copy(ioutil.Discard, resp.Body)
+	op.Set("response_bytes", size)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// Cancelled while reading the body, the timing is meaningless
+		return 0, ctxErr
+	}
+	if err == io.ErrUnexpectedEOF {
+		log.Debugf("Body of %v from %v truncated after %d of %d bytes", origin, proxy, size, resp.ContentLength)
+		op.Set("response_truncated", true).Set("expected_bytes", resp.ContentLength)
+		reportFailure(report, op, "truncated", start, err)
+		return 0, err
+	}
+	if err != nil {
+		log.Debugf("Error reading body of %v from %v: %v", origin, proxy, err)
+		if failureReason(err) == "timeout" {
+			op.Set("request_timeout_hit", true)
+		}
+		reportFailure(report, op, "body", start, err)
+		return 0, err
+	}
+	if target := opts.target(origin); target != nil && target.ExpectBytes > 0 && size != target.ExpectBytes {
+		log.Debugf("Received %d bytes of %v from %v, expected %d", size, origin, proxy, target.ExpectBytes)
+		err := fmt.Errorf("Received %d bytes, expected %d", size, target.ExpectBytes)
+		op.Set("expected_bytes", target.ExpectBytes)
+		if size < target.ExpectBytes {
+			op.Set("response_truncated", true)
+			reportFailure(report, op, "truncated", start, err)
+		} else {
+			reportFailure(report, op, "size", start, err)
+		}
+		return 0, err
+	}
+	delta := time.Since(start)
+	phases.setTransfer(op, start.Add(delta))
+	if delta > 0 {
+		// Bytes per second, like simulated_bandwidth_bps
+		op.Set("throughput_bps", float64(size)/delta.Seconds())
+	}
+	if proxy.protocol == "obfs4" {
+		proxy.mx.Lock()
+		iatMode := proxy.obfs4IATMode
+		proxy.mx.Unlock()
+		if iatMode != "" {
+			op.Set("obfs4_iat_mode", iatMode)
+		}
+	}
+	if alpn, ok := proxy.negotiatedProtocol(); ok {
+		op.Set("alpn", alpn)
+	}
+	proxy.setQUICHandshake(op)
+	proxy.setSnowflakeRendezvous(op)
+	proxy.setDialAttempts(op)
+	if reused, known := proxy.crossRunReused(); known {
+		op.Set("cross_run_reuse", reused)
+	}
+	if opts.ReportTCPInfo {
+		rtt, retransmits, err := proxy.lastTCPInfo()
+		if err != nil {
+			log.Debugf("Unable to read TCP info for %v: %v", proxy.addr, err)
+		} else {
+			op.Set("tcp_rtt_us", rtt).Set("tcp_retransmits", retransmits)
+		}
+	}
+	if drift, anomalous := checkClock(start, delta); anomalous {
+		// The sample is reported without proxybench_success so that it isn't
+		// counted as either a success or a failure, and discardedTiming tells
+		// the caller that it was discarded.
+		log.Debugf("Discarding implausible timing %v (wall clock drift %v)", delta, drift)
+		op.Set("clock_anomaly", true).Set("clock_drift", drift.Seconds())
+		report(0, ops.AsMap(op, true))
+		return discardedTiming, nil
+	}
 	log.Debugf("Request succeeded in %v", delta)
+	op.Set("proxybench_success", true)
 	report(delta, ops.AsMap(op, true))
+	return delta, nil
+}
+
+// reportFailure reports a failed request, including why and how long after
+// starting it failed. Failures are reported with a timing of 0 so that they
+// don't skew latency figures.
+func reportFailure(report ReportFN, op ops.Op, reason string, start time.Time, err error) {
+	op.Set("proxybench_success", false).
+		Set("failure_reason", reason).
+		Set("failure_time", time.Since(start).Seconds()).
+		Set("failure_error", err.Error())
+	report(0, ops.AsMap(op, true))
+}
+
+// failureReason categorizes an error returned by http.Client.Do.
+func failureReason(err error) string {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return "timeout"
+	}
+	return "request"
+}
+
+// checkClock is clockAnomaly, replaceable in tests.
+var checkClock = clockAnomaly
+
+// clockAnomaly checks the monotonic duration delta measured since start for
+// plausibility and compares it against the elapsed wall-clock time. It returns
+// the drift between the two clocks and whether the measurement should be
+// discarded.
+func clockAnomaly(start time.Time, delta time.Duration) (time.Duration, bool) {
+	// Round(0) strips the monotonic reading, leaving only the wall clock.
+	wallDelta := time.Now().Round(0).Sub(start.Round(0))
+	drift := wallDelta - delta
+	if delta < 0 || delta > maxPlausibleTiming {
+		return drift, true
+	}
+	return drift, drift > maxClockDrift || drift < -maxClockDrift
 }
 
-func setupLocalProxy(proxy *proxy) (net.Listener, error) {
-	l, err := net.Listen("tcp", "localhost:")
+// contentTypeMatches checks whether the given Content-Type header matches the
+// expected media type, which may be a type wildcard like "image/*".
+func contentTypeMatches(contentType string, expected string) bool {
+	if expected == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasSuffix(expected, "/*") {
+		return strings.HasPrefix(mediaType, strings.ToLower(strings.TrimSuffix(expected, "*")))
+	}
+	return mediaType == strings.ToLower(expected)
+}
+
+// listenLocal listens on an ephemeral local port, retrying with backoff in
+// case of transient failures like running out of ports or file descriptors
+// when running lots of benchmarks concurrently.
+func listenLocal() (net.Listener, error) {
+	backoff := minListenBackoff
+	for i := 0; ; i++ {
+		l, err := net.Listen("tcp", "localhost:")
+		if err == nil || i >= maxListenRetries {
+			return l, err
+		}
+		log.Debugf("Unable to listen for local proxy, retrying in %v: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// httpVersionMatches checks whether resp was served over the expected HTTP
+// version, which may be abbreviated like "2" or "HTTP/2".
+func httpVersionMatches(resp *http.Response, expected string) bool {
+	if expected == "" {
+		return true
+	}
+	expected = strings.ToUpper(expected)
+	if !strings.HasPrefix(expected, "HTTP/") {
+		expected = "HTTP/" + expected
+	}
+	if !strings.Contains(expected, ".") {
+		expected += ".0"
+	}
+	major, minor, ok := http.ParseHTTPVersion(expected)
+	if !ok {
+		log.Debugf("Invalid expected HTTP version %v", expected)
+		return false
+	}
+	return resp.ProtoMajor == major && resp.ProtoMinor == minor
+}
+
+func setupLocalProxy(ctx context.Context, opts *Opts, proxy *proxy) (net.Listener, error) {
+	l, err := listenLocal()
 	if err != nil {
 		return nil, err
 	}
+	proxy.mx.Lock()
+	proxy.relayAddr = l.Addr().String()
+	proxy.mx.Unlock()
 	go func() {
 		in, err := l.Accept()
 		if err != nil {
 			log.Errorf("Unable to accept connection: %v", err)
 			return
 		}
-		go doLocalProxy(in, proxy)
+		go doLocalProxy(ctx, opts, in, proxy)
 	}()
 	return l, nil
 }
 
-func doLocalProxy(in net.Conn, proxy *proxy) {
+func doLocalProxy(ctx context.Context, opts *Opts, in net.Conn, proxy *proxy) {
 	defer in.Close()
-	out, err := proxy.dial()
+	var target socks.Addr
+	if proxy.protocol == "shadowsocks" {
+		// Shadowsocks needs the target up front, so act as a SOCKS5 server
+		// towards http.Transport to find out what it is.
+		var err error
+		target, err = socks.Handshake(in)
+		if err != nil {
+			log.Debugf("Unable to read target for %v: %v", proxy, err)
+			return
+		}
+	}
+	out, err := proxy.dial(ctx, opts)
 	if err != nil {
 		log.Debugf("Unable to dial proxy %v: %v", proxy, err)
 		return
 	}
+	if target != nil {
+		if _, err := out.Write(target); err != nil {
+			log.Debugf("Unable to send target to %v: %v", proxy, err)
+			out.Close()
+			return
+		}
+	}
+	if opts.ReportTCPInfo {
+		out = &tcpInfoConn{Conn: out, raw: proxy.dialedConn(), proxy: proxy}
+	}
+	if opts.SimulatedBandwidth > 0 {
+		out = newThrottledConn(out, opts.SimulatedBandwidth)
+	}
 	bufOut := buffers.Get()
 	bufIn := buffers.Get()
 	defer buffers.Put(bufOut)
@@ -211,68 +1458,511 @@ func doLocalProxy(in net.Conn, proxy *proxy) {
 	}
 }
 
-func (p *proxy) dial() (net.Conn, error) {
+// dial dials the proxy, recording the phase at which dialing failed, if it
+// did.
+func (p *proxy) dial(ctx context.Context, opts *Opts) (net.Conn, error) {
+	conn, err := p.doDial(ctx, opts)
+	if err != nil {
+		p.mx.Lock()
+		if p.failurePhase == "" && p.tcpConn != nil {
+			p.failurePhase = failurePhaseHandshake
+		}
+		p.mx.Unlock()
+	}
+	return conn, err
+}
+
+func (p *proxy) doDial(ctx context.Context, opts *Opts) (net.Conn, error) {
+	if dial, found := customProtocol(p.protocol); found {
+		return dial(p.addr, p.PTArgs[p.protocol])
+	}
 	switch p.protocol {
 	case "https":
-		return p.dialTLS()
+		return p.dialTLS(ctx, opts)
 	case "obfs4":
-		return p.dialOBFS4()
+		return p.dialOBFS4(ctx)
+	case "shadowsocks":
+		return p.dialShadowsocks(ctx)
+	case "lampshade":
+		return p.dialLampshade(ctx)
+	case "quic":
+		return p.dialQUIC()
+	case "wss":
+		return p.dialWSS(ctx)
+	case "meek":
+		return p.dialMeek(ctx)
+	case "snowflake":
+		return p.dialSnowflake()
+	case "socks5", "http":
+		// No wrapping, http.Transport talks to these directly over the relay
+		return p.dialTCP(ctx, "tcp", p.addr)
 	default:
 		return nil, fmt.Errorf("Unknown protocol %v", p.protocol)
 	}
 }
 
-func (p *proxy) dialTLS() (net.Conn, error) {
-	conn, err := netx.Dial("tcp", p.addr)
+// dialTCP dials the raw TCP connection to the proxy and remembers it so that
+// we can inspect it later.
+func (p *proxy) dialTCP(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := p.dialEachIP(ctx, network, addr)
 	if err != nil {
+		p.mx.Lock()
+		p.failurePhase = failurePhaseTCPConnect
+		p.mx.Unlock()
 		return nil, err
 	}
-	tlsConn := tls.Client(conn, &tls.Config{
-		InsecureSkipVerify: true,
-	})
+	p.mx.Lock()
+	p.tcpConn = conn
+	p.mx.Unlock()
+	return conn, nil
+}
+
+func (p *proxy) dialedConn() net.Conn {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.tcpConn
+}
+
+func (p *proxy) dialFailurePhase() string {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.failurePhase
+}
+
+func (p *proxy) dialTLS(ctx context.Context, opts *Opts) (net.Conn, error) {
+	var helloID utls.ClientHelloID
+	if p.TLSFingerprint != "" {
+		var err error
+		helloID, err = tlsFingerprint(p.TLSFingerprint)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn, err := p.dialTCP(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	nextProtos := []string{"http/1.1"}
+	if opts.EnableHTTP2 {
+		nextProtos = []string{"h2", "http/1.1"}
+	}
+	var tlsConn net.Conn
+	var handshake func() (string, error)
+	if p.TLSFingerprint != "" {
+		uconn, err := utlsClient(conn, &utls.Config{
+			InsecureSkipVerify:    true,
+			VerifyPeerCertificate: p.verifyPeerCertificate,
+			ServerName:            p.FrontDomain,
+			NextProtos:            nextProtos,
+		}, helloID)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn = uconn
+		handshake = func() (string, error) {
+			err := uconn.Handshake()
+			return uconn.ConnectionState().NegotiatedProtocol, err
+		}
+	} else {
+		stdConn := tls.Client(conn, &tls.Config{
+			InsecureSkipVerify:    true,
+			VerifyPeerCertificate: p.verifyPeerCertificate,
+			ServerName:            p.FrontDomain,
+			NextProtos:            nextProtos,
+		})
+		tlsConn = stdConn
+		handshake = func() (string, error) {
+			err := stdConn.Handshake()
+			return stdConn.ConnectionState().NegotiatedProtocol, err
+		}
+	}
+	// Handshake eagerly so that handshake failures are attributed to dialing
+	alpn, err := handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.mx.Lock()
+	p.tlsHandshakeComplete = true
+	p.alpn = alpn
+	p.mx.Unlock()
 	return tlsConn, nil
 }
 
-func (p *proxy) dialOBFS4() (net.Conn, error) {
+// negotiatedProtocol returns the protocol negotiated via ALPN with an https
+// proxy, if the TLS handshake has completed.
+func (p *proxy) negotiatedProtocol() (string, bool) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.alpn, p.tlsHandshakeComplete
+}
+
+func (p *proxy) dialOBFS4(ctx context.Context) (net.Conn, error) {
 	tr := obfs4.Transport{}
 	cf, err := tr.ClientFactory("")
 	if err != nil {
 		return nil, log.Errorf("Unable to create obfs4 client factory: %v", err)
 	}
 
-	ptArgs := &pt.Args{}
-	ptArgs.Add("cert", "1LYfzzTyz7xsu0bTBUJacwDTLN3NU/gNSjC+pfdRVNuh/LYmtbLOlhZwCfNTKyUVvfMTWQ")
-	ptArgs.Add("iat-mode", "0")
+	ptArgs := p.ptArgs(map[string]string{
+		"cert":     defaultOBFS4Cert,
+		"iat-mode": defaultOBFS4IATMode,
+	})
 
 	args, err := cf.ParseArgs(ptArgs)
 	if err != nil {
 		return nil, log.Errorf("Unable to parse client args: %v", err)
 	}
-	return cf.Dial("tcp", p.addr, netx.Dial, args)
+	// obfs4 doesn't negotiate the iat-mode, each side obfuscates its own
+	// traffic according to its own setting. So the effective mode from our
+	// perspective is the one that made it through argument parsing.
+	iatMode, _ := ptArgs.Get("iat-mode")
+	p.mx.Lock()
+	p.obfs4IATMode = iatMode
+	p.mx.Unlock()
+	return cf.Dial("tcp", p.addr, func(network, addr string) (net.Conn, error) {
+		return p.dialTCP(ctx, network, addr)
+	}, args)
+}
+
+// ptArg returns the transport-specific parameter key for the protocol we're
+// using, or fallback if it's not configured in PTArgs.
+func (p *proxy) ptArg(key string, fallback string) string {
+	if value, found := p.PTArgs[p.protocol][key]; found {
+		return value
+	}
+	return fallback
+}
+
+// ptArgs builds pluggable transport arguments for the protocol we're using
+// from PTArgs, filling in the given defaults.
+func (p *proxy) ptArgs(defaults map[string]string) *pt.Args {
+	merged := make(map[string]string, len(defaults))
+	for key, value := range defaults {
+		merged[key] = value
+	}
+	for key, value := range p.PTArgs[p.protocol] {
+		merged[key] = value
+	}
+	keys := make([]string, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := &pt.Args{}
+	for _, key := range keys {
+		args.Add(key, merged[key])
+	}
+	return args
+}
+
+func (p *proxy) dialShadowsocks(ctx context.Context) (net.Conn, error) {
+	cipherName := p.ptArg("cipher", p.ShadowsocksCipher)
+	cipher, err := core.PickCipher(cipherName, nil, p.ptArg("password", p.ShadowsocksPassword))
+	if err != nil {
+		return nil, log.Errorf("Unable to create shadowsocks cipher %v: %v", cipherName, err)
+	}
+	conn, err := p.dialTCP(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.StreamConn(conn), nil
+}
+
+func (p *proxy) dialLampshade(ctx context.Context) (net.Conn, error) {
+	publicKey, err := lampshadePublicKey(p.ptArg("cert", p.LampshadeCert))
+	if err != nil {
+		return nil, log.Errorf("Unable to load lampshade public key for %v: %v", p.addr, err)
+	}
+	// Each request gets its own dialer, and hence its own session, so that
+	// we always measure the cost of establishing one.
+	dialer := lampshade.NewDialer(&lampshade.DialerOpts{
+		WindowSize:      lampshadeWindowSize,
+		MaxPadding:      lampshadeMaxPadding,
+		Pool:            lampshadeBuffers,
+		Cipher:          lampshade.AES128GCM,
+		ServerPublicKey: publicKey,
+	})
+	return dialer.DialContext(ctx, func() (net.Conn, error) {
+		return p.dialTCP(ctx, "tcp", p.addr)
+	})
 }
 
-func (opts *Opts) fetchUpdate() *Opts {
+// lampshadePublicKey extracts the RSA public key from a PEM-encoded
+// certificate.
+func lampshadePublicKey(cert string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(cert))
+	if block == nil {
+		return nil, fmt.Errorf("No PEM-encoded certificate found")
+	}
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse certificate: %v", err)
+	}
+	publicKey, ok := parsed.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Expected RSA public key, got %T", parsed.PublicKey)
+	}
+	return publicKey, nil
+}
+
+func (p *proxy) dialMeek(ctx context.Context) (net.Conn, error) {
+	tr := meeklite.Transport{}
+	cf, err := tr.ClientFactory("")
+	if err != nil {
+		return nil, log.Errorf("Unable to create meek client factory: %v", err)
+	}
+
+	defaults := map[string]string{"url": p.MeekURL}
+	if p.FrontDomain != "" {
+		defaults["front"] = p.FrontDomain
+	}
+	ptArgs := p.ptArgs(defaults)
+
+	args, err := cf.ParseArgs(ptArgs)
+	if err != nil {
+		return nil, log.Errorf("Unable to parse client args: %v", err)
+	}
+	return cf.Dial("tcp", p.addr, func(network, addr string) (net.Conn, error) {
+		return p.dialTCP(ctx, network, addr)
+	}, args)
+}
+
+// FetchUpdate fetches updated Opts from the UpdateURL, verifying their
+// signature if there's an UpdatePublicKey, and returns them with defaults
+// applied and local settings carried over. If there's no UpdateURL, it
+// returns opts itself.
+func (opts *Opts) FetchUpdate(ctx context.Context) (*Opts, error) {
 	if opts.UpdateURL == "" {
 		log.Debug("Not fetching updated options")
-		return opts
+		return opts, nil
+	}
+	body, validators, err := opts.fetch(ctx, opts.UpdateURL, opts.updateValidators, maxUpdateSize)
+	if err == errNotModified {
+		log.Debug("Updated options are unchanged")
+		return opts, nil
 	}
-	resp, err := http.Get(opts.UpdateURL)
 	if err != nil {
-		log.Errorf("Unable to fetch updated Opts from %v: %v", opts.UpdateURL, err)
-		return opts
+		return opts, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		log.Errorf("Unexpected response status fetching updated Opts from %v: %v", opts.UpdateURL, resp.Status)
-		return opts
+	if len(opts.UpdatePublicKey) > 0 {
+		if err := opts.verifyUpdate(ctx, body); err != nil {
+			return opts, err
+		}
 	}
 	newOpts := &Opts{}
-	err = json.NewDecoder(resp.Body).Decode(newOpts)
+	err = json.Unmarshal(body, newOpts)
 	if err != nil {
-		log.Errorf("Error decoding JSON for updated Opts from %v: %v", opts.UpdateURL, err)
-		return opts
+		return opts, fmt.Errorf("Error decoding JSON for updated Opts from %v: %v", opts.UpdateURL, err)
 	}
+	// Local settings may affect the defaults
+	newOpts.copyLocalSettings(opts)
 	newOpts.applyDefaults()
-	log.Debug("Applying updated options")
-	return newOpts
+	newOpts.newProxies = addedProxies(opts.Proxies, newOpts.Proxies)
+	newOpts.updateValidators = validators
+	return newOpts, nil
+}
+
+// updateValidators are the validators of a fetched response.
+type updateValidators struct {
+	etag         string
+	lastModified string
+}
+
+// errNotModified is returned by fetch when the response hasn't changed since
+// it was fetched with the given validators.
+var errNotModified = errors.New("Not modified")
+
+// fetch fetches the body at the given URL for updating Opts using the
+// UpdateClient and UpdateHeader, falling back to the BootstrapProxy and then to
+// the configured Proxies if fetching directly fails. If validators from a
+// previous fetch are given, the request is conditional and errNotModified is
+// returned if the response hasn't changed. Otherwise, the new validators are
+// returned along with the body. Bodies larger than maxSize are rejected.
+func (opts *Opts) fetch(ctx context.Context, u string, validators updateValidators, maxSize int64) ([]byte, updateValidators, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, validators, fmt.Errorf("Unable to build request for updated Opts from %v: %v", u, err)
+	}
+	for key, values := range opts.UpdateHeader {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	if validators.etag != "" {
+		req.Header.Set("If-None-Match", validators.etag)
+	}
+	if validators.lastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.lastModified)
+	}
+	client := opts.UpdateClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil && opts.BootstrapProxy != nil && ctx.Err() == nil {
+		log.Debugf("Unable to fetch updated Opts directly, trying bootstrap proxy: %v", err)
+		resp, err = opts.fetchViaBootstrapProxy(req.WithContext(ctx))
+	}
+	if err != nil && len(opts.Proxies) > 0 && ctx.Err() == nil {
+		log.Debugf("Unable to fetch updated Opts, trying configured proxies: %v", err)
+		resp, err = opts.fetchViaProxies(req.WithContext(ctx))
+	}
+	if err != nil {
+		return nil, validators, fmt.Errorf("Unable to fetch updated Opts from %v: %v", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && validators != (updateValidators{}) {
+		return nil, validators, errNotModified
+	}
+	if resp.StatusCode != 200 {
+		return nil, validators, fmt.Errorf("Unexpected response status fetching updated Opts from %v: %v", u, resp.Status)
+	}
+	// Read one byte more than allowed to tell whether the body is too large
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, validators, fmt.Errorf("Unable to read updated Opts from %v: %v", u, err)
+	}
+	if int64(len(body)) > maxSize {
+		return nil, validators, fmt.Errorf("Response from %v is larger than %d bytes", u, maxSize)
+	}
+	return body, updateValidators{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// fetchViaBootstrapProxy makes the given request for the UpdateURL through
+// the BootstrapProxy using obfs4.
+func (opts *Opts) fetchViaBootstrapProxy(req *http.Request) (*http.Response, error) {
+	proxy := opts.BootstrapProxy.withProtocol("obfs4")
+	if proxy.addr == "" {
+		return nil, fmt.Errorf("Bootstrap proxy has no obfs4 address")
+	}
+	return fetchViaProxy(req, proxy)
+}
+
+// fetchViaProxies makes the given request for the UpdateURL through up to
+// maxUpdateProxyAttempts of the configured Proxies, picked at random, until
+// one of them succeeds.
+func (opts *Opts) fetchViaProxies(req *http.Request) (*http.Response, error) {
+	err := fmt.Errorf("No proxies through which to fetch")
+	attempts := 0
+	for _, i := range rand.Perm(len(opts.Proxies)) {
+		if attempts == maxUpdateProxyAttempts || req.Context().Err() != nil {
+			break
+		}
+		proxy := opts.Proxies[i].withRandomProtocol()
+		if proxy.protocol == protocolSystem || proxy.addr == "" {
+			// The system proxy is already used when fetching directly
+			continue
+		}
+		attempts++
+		var resp *http.Response
+		resp, err = fetchViaProxy(req, proxy)
+		if err == nil {
+			return resp, nil
+		}
+		log.Debugf("Unable to fetch updated Opts via %v: %v", proxy.addr, err)
+	}
+	return nil, err
+}
+
+// fetchViaProxy makes the given request for the UpdateURL through the given
+// proxy.
+func fetchViaProxy(req *http.Request, proxy *proxy) (*http.Response, error) {
+	// Use empty Opts so that settings like SimulatedBandwidth that only apply
+	// to benchmarks don't affect fetching config.
+	l, err := setupLocalProxy(req.Context(), &Opts{}, proxy)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to set up local proxy for %v: %v", proxy.addr, err)
+	}
+	defer l.Close()
+	client := &http.Client{
+		Timeout: 1 * time.Minute,
+		Transport: &http.Transport{
+			Proxy:              http.ProxyURL(proxy.localProxyURL(l.Addr().String())),
+			ProxyConnectHeader: proxy.proxyHeader(),
+			DisableKeepAlives:  true,
+		},
+	}
+	return client.Do(req)
+}
+
+// requestTimeout returns opts.RequestTimeout, or the default if it isn't set.
+func (opts *Opts) requestTimeout() time.Duration {
+	if opts.RequestTimeout > 0 {
+		return opts.RequestTimeout
+	}
+	return defaultRequestTimeout
+}
+
+// MarshalEffective serializes the Opts to JSON as they're actually applied,
+// with parsed durations rendered back into their string forms.
+func (opts *Opts) MarshalEffective() ([]byte, error) {
+	effective := *opts
+	effective.PeriodString = opts.Period.String()
+	if opts.UpdatePeriod > 0 {
+		effective.UpdatePeriodString = opts.UpdatePeriod.String()
+	}
+	if opts.PerOriginDelay > 0 {
+		effective.PerOriginDelayString = opts.PerOriginDelay.String()
+	}
+	if opts.MinRequestInterval > 0 {
+		effective.MinRequestIntervalString = opts.MinRequestInterval.String()
+	}
+	effective.RequestTimeoutString = opts.RequestTimeout.String()
+	if opts.StatsHalfLife > 0 {
+		effective.StatsHalfLifeString = opts.StatsHalfLife.String()
+	}
+	if opts.SlowThreshold > 0 {
+		effective.SlowThresholdString = opts.SlowThreshold.String()
+	}
+	return json.Marshal(&effective)
+}
+
+// hash returns a hash of the Opts' configuration, for detecting changes.
+func (opts *Opts) hash() []byte {
+	b, err := json.Marshal(opts)
+	if err != nil {
+		log.Errorf("Unable to marshal Opts for hashing: %v", err)
+		return nil
+	}
+	sum := sha256.Sum256(b)
+	return sum[:]
+}
+
+// copyLocalSettings copies settings that can't be configured remotely from the
+// Opts that are being replaced.
+func (opts *Opts) copyLocalSettings(from *Opts) {
+	opts.StatsFile = from.StatsFile
+	opts.BeforeRequest = from.BeforeRequest
+	opts.BootstrapProxy = from.BootstrapProxy
+	opts.Reporters = from.Reporters
+	opts.StatusAddr = from.StatusAddr
+	opts.StatusDashboard = from.StatusDashboard
+	opts.UpdatePublicKey = from.UpdatePublicKey
+	opts.UpdateClient = from.UpdateClient
+	opts.UpdateHeader = from.UpdateHeader
+	opts.DefaultSampleRate = from.DefaultSampleRate
+}
+
+// addedProxies returns the proxies in next that aren't in prev. If prev is
+// empty, nothing is considered new, since that's just the initial config.
+func addedProxies(prev []*Proxy, next []*Proxy) []*Proxy {
+	if len(prev) == 0 {
+		return nil
+	}
+	known := make(map[string]bool, len(prev))
+	for _, p := range prev {
+		known[p.key()] = true
+	}
+	var added []*Proxy
+	for _, p := range next {
+		if !known[p.key()] {
+			added = append(added, p)
+		}
+	}
+	return added
 }
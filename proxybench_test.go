@@ -1,14 +1,26 @@
 package proxybench
 
 import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/http/httputil"
+	"os"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/getlantern/tlsdefaults"
+	"github.com/shadowsocks/go-shadowsocks2/core"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -36,17 +48,23 @@ func TestRoundTrip(t *testing.T) {
 	var timing time.Duration
 	var ctx map[string]interface{}
 	var mx sync.RWMutex
-	var wg sync.WaitGroup
-	wg.Add(1)
+	var once sync.Once
+	succeeded := make(chan struct{})
 
 	Start(&Opts{}, func(_timing time.Duration, _ctx map[string]interface{}) {
-		mx.Lock()
-		timing = _timing
-		ctx = _ctx
-		mx.Unlock()
-		wg.Done()
+		if _ctx["proxybench_success"] != true {
+			// Failures and summaries like proxy_fully_down are reported too
+			return
+		}
+		once.Do(func() {
+			mx.Lock()
+			timing = _timing
+			ctx = _ctx
+			mx.Unlock()
+			close(succeeded)
+		})
 	})
-	wg.Wait()
+	<-succeeded
 
 	mx.RLock()
 	defer mx.RUnlock()
@@ -62,4 +80,903 @@ func TestRoundTrip(t *testing.T) {
 	assert.Equal(t, port, ctx["proxy_port"])
 	assert.Equal(t, "i.ytimg.com", ctx["origin"])
 	assert.Equal(t, "i.ytimg.com", ctx["origin_host"])
+	relayAddr, _ := ctx["local_relay_addr"].(string)
+	_, relayPort, _ := net.SplitHostPort(relayAddr)
+	assert.NotEmpty(t, relayPort)
+	assert.NotEqual(t, "0", relayPort, "should report actual bound port")
+}
+
+func TestRefreshConfig(t *testing.T) {
+	var mx sync.Mutex
+	period := "1h"
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		if period == "" {
+			resp.Write([]byte("not json"))
+			return
+		}
+		fmt.Fprintf(resp, `{"period": %q, "updateURL": %q}`, period, srv.URL)
+	}))
+	defer srv.Close()
+
+	r := &Runner{ctx: context.Background(), stats: newStats(), opts: &Opts{UpdateURL: srv.URL}}
+	changed, err := r.RefreshConfig()
+	assert.NoError(t, err)
+	assert.True(t, changed, "first refresh should change config")
+	assert.Equal(t, 1*time.Hour, r.currentOpts().Period)
+
+	changed, err = r.RefreshConfig()
+	assert.NoError(t, err)
+	assert.False(t, changed, "unchanged config should not be reported as changed")
+
+	mx.Lock()
+	period = "2h"
+	mx.Unlock()
+	changed, err = r.RefreshConfig()
+	assert.NoError(t, err)
+	assert.True(t, changed, "modified config should be reported as changed")
+	assert.Equal(t, 2*time.Hour, r.currentOpts().Period)
+
+	mx.Lock()
+	period = ""
+	mx.Unlock()
+	changed, err = r.RefreshConfig()
+	assert.Error(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, 2*time.Hour, r.currentOpts().Period, "invalid config should not be applied")
+}
+
+func TestRefreshConfigConditional(t *testing.T) {
+	var mx sync.Mutex
+	etag := `"v1"`
+	var fetches, notModified int
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		fetches++
+		if req.Header.Get("If-None-Match") == etag {
+			notModified++
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		resp.Header().Set("ETag", etag)
+		fmt.Fprintf(resp, `{"period": %q, "updateURL": %q}`, etag[2:3]+"h", srv.URL)
+	}))
+	defer srv.Close()
+
+	r := &Runner{ctx: context.Background(), stats: newStats(), opts: &Opts{UpdateURL: srv.URL}}
+	changed, err := r.RefreshConfig()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, 1*time.Hour, r.currentOpts().Period)
+
+	for i := 0; i < 2; i++ {
+		changed, err = r.RefreshConfig()
+		assert.NoError(t, err)
+		assert.False(t, changed, "not modified config should not be reported as changed")
+	}
+	mx.Lock()
+	assert.Equal(t, 3, fetches)
+	assert.Equal(t, 2, notModified, "subsequent fetches should be conditional")
+	etag = `"v2"`
+	mx.Unlock()
+
+	changed, err = r.RefreshConfig()
+	assert.NoError(t, err)
+	assert.True(t, changed, "modified config should be reported as changed")
+	assert.Equal(t, 2*time.Hour, r.currentOpts().Period)
+	assert.Equal(t, `"v2"`, r.currentOpts().updateValidators.etag)
+}
+
+func TestFetchUpdateClientAndHeader(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(resp, `{"period": "2h", "updateURL": %q}`, srv.URL)
+	}))
+	defer srv.Close()
+
+	opts := &Opts{UpdateURL: srv.URL}
+	_, err := opts.FetchUpdate(context.Background())
+	assert.Error(t, err, "default client shouldn't trust the test server")
+
+	opts.UpdateClient = srv.Client()
+	_, err = opts.FetchUpdate(context.Background())
+	assert.Error(t, err, "fetching without Authorization should fail")
+
+	opts.UpdateHeader = http.Header{"Authorization": []string{"Bearer secret"}}
+	newOpts, err := opts.FetchUpdate(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 2*time.Hour, newOpts.Period)
+	assert.Equal(t, opts.UpdateClient, newOpts.UpdateClient, "client should be carried over")
+	assert.Equal(t, opts.UpdateHeader, newOpts.UpdateHeader, "header should be carried over")
+}
+
+func TestFetchUpdateDefaultSampleRate(t *testing.T) {
+	// Testing mode overrides the sample rate
+	defer func(orig string) {
+		testingProxy = orig
+	}(testingProxy)
+	testingProxy = ""
+
+	sampleRate := ""
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(resp, `{"period": "2h", "updateURL": %q%v}`, srv.URL, sampleRate)
+	}))
+	defer srv.Close()
+
+	opts := &Opts{UpdateURL: srv.URL, DefaultSampleRate: 1}
+	opts.applyDefaults()
+	assert.Equal(t, 1.0, opts.SampleRate)
+	newOpts, err := opts.FetchUpdate(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1.0, newOpts.SampleRate, "default sample rate should be carried over")
+
+	sampleRate = `, "sampleRate": 0.2`
+	newOpts, err = newOpts.FetchUpdate(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 0.2, newOpts.SampleRate, "configured sample rate should take precedence")
+}
+
+func TestFetchUpdateViaBootstrapProxy(t *testing.T) {
+	configSrv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(resp, `{"period": "2h", "updateURL": "http://config.invalid/opts.json"}`)
+	}))
+	defer configSrv.Close()
+
+	// Stands in for an obfs4 proxy that can reach the blocked UpdateURL
+	proxied := make(chan string, 1)
+	proxySrv := httptest.NewServer(&httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			proxied <- req.URL.String()
+			req.URL.Host = configSrv.Listener.Addr().String()
+		},
+	})
+	defer proxySrv.Close()
+	RegisterProtocol("obfs4", func(addr string, args map[string]string) (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	})
+	defer func() {
+		customProtocolsMx.Lock()
+		delete(customProtocols, "obfs4")
+		customProtocolsMx.Unlock()
+	}()
+
+	opts := &Opts{
+		UpdateURL:      "http://config.invalid/opts.json",
+		BootstrapProxy: &Proxy{Addrs: map[string]string{"obfs4": proxySrv.Listener.Addr().String()}},
+	}
+	newOpts, err := opts.FetchUpdate(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 2*time.Hour, newOpts.Period)
+	assert.Equal(t, "http://config.invalid/opts.json", <-proxied)
+	assert.Equal(t, opts.BootstrapProxy, newOpts.BootstrapProxy, "bootstrap proxy should be carried over")
+}
+
+func TestFetchUpdateViaProxies(t *testing.T) {
+	configSrv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(resp, `{"period": "2h", "updateURL": "http://config.invalid/opts.json"}`)
+	}))
+	defer configSrv.Close()
+
+	// Stands in for a proxy that can reach the blocked UpdateURL
+	proxied := make(chan string, 1)
+	proxySrv := httptest.NewServer(&httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			proxied <- req.URL.String()
+			req.URL.Host = configSrv.Listener.Addr().String()
+		},
+	})
+	defer proxySrv.Close()
+
+	opts := &Opts{
+		UpdateURL: "http://config.invalid/opts.json",
+		Proxies: []*Proxy{
+			{Addrs: map[string]string{"http": "127.0.0.1:1"}},
+			{Addrs: map[string]string{"http": proxySrv.Listener.Addr().String()}},
+		},
+	}
+	newOpts, err := opts.FetchUpdate(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 2*time.Hour, newOpts.Period)
+	assert.Equal(t, "http://config.invalid/opts.json", <-proxied)
+}
+
+func TestUpdatePeriod(t *testing.T) {
+	var mx sync.Mutex
+	fetches := 0
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mx.Lock()
+		fetches++
+		mx.Unlock()
+		fmt.Fprintf(resp, `{"period": "1h", "updatePeriod": "50ms", "updateURL": %q}`, srv.URL)
+	}))
+	defer srv.Close()
+
+	r := StartContext(context.Background(), &Opts{UpdateURL: srv.URL, Period: time.Hour}, nil)
+	time.Sleep(500 * time.Millisecond)
+	r.Stop()
+
+	assert.Equal(t, 50*time.Millisecond, r.currentOpts().UpdatePeriod)
+	mx.Lock()
+	defer mx.Unlock()
+	assert.True(t, fetches >= 3, "config should be polled more often than Period, got %d fetches", fetches)
+}
+
+func TestBenchNewProxies(t *testing.T) {
+	origTestingProxy := testingProxy
+	testingProxy = ""
+	defer func() {
+		testingProxy = origTestingProxy
+	}()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	newProxy := func() *httptest.Server {
+		return httptest.NewServer(&httputil.ReverseProxy{Director: func(req *http.Request) {}})
+	}
+	oldProxySrv, newProxySrv := newProxy(), newProxy()
+	defer oldProxySrv.Close()
+	defer newProxySrv.Close()
+
+	var mx sync.Mutex
+	proxies := fmt.Sprintf(`[{"addrs": {"http": %q}, "provider": "old"}]`, oldProxySrv.Listener.Addr())
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+		// Never sample regular runs, so that only new proxies are benchmarked
+		fmt.Fprintf(resp, `{"period": "1h", "updatePeriod": "50ms", "sampleRate": 0.000000001, "benchNewProxies": true, "updateURL": %q, "urls": [%q], "proxies": %v}`,
+			srv.URL, origin.URL, proxies)
+	}))
+	defer srv.Close()
+
+	reported := make(chan map[string]interface{}, 10)
+	r := StartContext(context.Background(), &Opts{UpdateURL: srv.URL}, func(_ time.Duration, ctx map[string]interface{}) {
+		if ctx["proxybench_success"] != nil {
+			select {
+			case reported <- ctx:
+			default:
+			}
+		}
+	})
+	defer r.Stop()
+	time.Sleep(200 * time.Millisecond)
+	mx.Lock()
+	proxies = fmt.Sprintf(`[{"addrs": {"http": %q}, "provider": "old"}, {"addrs": {"http": %q}, "provider": "new"}]`,
+		oldProxySrv.Listener.Addr(), newProxySrv.Listener.Addr())
+	mx.Unlock()
+
+	select {
+	case ctx := <-reported:
+		assert.Equal(t, "new", ctx["proxy_provider"], "only the newly added proxy should be benchmarked")
+		assert.Equal(t, true, ctx["newly_added"])
+		assert.Equal(t, true, ctx["proxybench_success"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("newly added proxy wasn't benchmarked")
+	}
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, reported, "nothing else should be benchmarked")
+}
+
+func TestBeforeRequest(t *testing.T) {
+	var mx sync.Mutex
+	var modified int
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Proxybench-Test") == "modified" {
+			mx.Lock()
+			modified++
+			mx.Unlock()
+		}
+		resp.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	proxySrv := httptest.NewServer(&httputil.ReverseProxy{Director: func(req *http.Request) {}})
+	defer proxySrv.Close()
+
+	var seen []string
+	opts := &Opts{
+		URLs:                []string{origin.URL + "/a", origin.URL + "/b"},
+		ConcurrencyPerGroup: 1,
+		BeforeRequest: func(req *http.Request, proxy *Proxy) {
+			mx.Lock()
+			seen = append(seen, proxy.Provider+" "+req.URL.Path)
+			mx.Unlock()
+			req.Header.Set("X-Proxybench-Test", "modified")
+		},
+	}
+	r := newRunner(context.Background(), &Opts{}, nil)
+	r.newRun(opts, false).bench([]*Proxy{
+		{Addrs: map[string]string{"http": proxySrv.Listener.Addr().String()}, Provider: "p1"},
+		{Addrs: map[string]string{"http": proxySrv.Listener.Addr().String()}, Provider: "p2"},
+	})
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.ElementsMatch(t, []string{"p1 /a", "p1 /b", "p2 /a", "p2 /b"}, seen, "hook should see every request")
+	assert.Equal(t, 4, modified, "hook should be able to modify every request")
+}
+
+func TestDialFailurePhase(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// Not a TLS server
+			conn.Close()
+		}
+	}()
+	p := &Proxy{Addrs: map[string]string{"https": l.Addr().String()}}
+	proxy := p.withProtocol("https")
+	_, err = proxy.dial(context.Background(), &Opts{})
+	assert.Error(t, err)
+	assert.Equal(t, failurePhaseHandshake, proxy.dialFailurePhase())
+
+	l.Close()
+	proxy = p.withProtocol("https")
+	_, err = proxy.dial(context.Background(), &Opts{})
+	assert.Error(t, err)
+	assert.Equal(t, failurePhaseTCPConnect, proxy.dialFailurePhase())
+}
+
+func TestFrontDomain(t *testing.T) {
+	sni := make(chan string, 1)
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni <- hello.ServerName
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	p := &Proxy{Addrs: map[string]string{"https": srv.Listener.Addr().String()}, FrontDomain: "front.example.com"}
+	conn, err := p.withProtocol("https").dial(context.Background(), &Opts{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Close()
+	assert.Equal(t, "front.example.com", <-sni)
+}
+
+func TestContentTypeMatches(t *testing.T) {
+	assert.True(t, contentTypeMatches("text/html", ""))
+	assert.True(t, contentTypeMatches("image/png", "image/png"))
+	assert.True(t, contentTypeMatches("Text/CSS; charset=utf-8", "text/css"))
+	assert.True(t, contentTypeMatches("image/webp", "image/*"))
+	assert.False(t, contentTypeMatches("text/html; charset=utf-8", "image/png"))
+	assert.False(t, contentTypeMatches("text/html", "image/*"))
+	assert.False(t, contentTypeMatches("", "image/png"))
+}
+
+func TestMarshalEffective(t *testing.T) {
+	opts := &Opts{PerOriginDelay: 2 * time.Second, Targets: []*Target{&Target{URL: "https://example.com", Critical: true}}}
+	opts.applyDefaults()
+	b, err := opts.MarshalEffective()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, string(b), `"period":"1h0m0s"`)
+	assert.Contains(t, string(b), `"perOriginDelay":"2s"`)
+
+	roundTripped := &Opts{}
+	if !assert.NoError(t, json.Unmarshal(b, roundTripped)) {
+		return
+	}
+	roundTripped.applyDefaults()
+	assert.Equal(t, opts.Period, roundTripped.Period)
+	assert.Equal(t, opts.PerOriginDelay, roundTripped.PerOriginDelay)
+	b2, err := roundTripped.MarshalEffective()
+	if assert.NoError(t, err) {
+		assert.Equal(t, string(b), string(b2))
+	}
+}
+
+func TestHTTPVersionMatches(t *testing.T) {
+	h2 := &http.Response{Proto: "HTTP/2.0", ProtoMajor: 2}
+	h11 := &http.Response{Proto: "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1}
+	assert.True(t, httpVersionMatches(h11, ""))
+	assert.True(t, httpVersionMatches(h2, "HTTP/2.0"))
+	assert.True(t, httpVersionMatches(h2, "2"))
+	assert.True(t, httpVersionMatches(h11, "http/1.1"))
+	assert.False(t, httpVersionMatches(h11, "HTTP/2"))
+	assert.False(t, httpVersionMatches(h2, "1.1"))
+	assert.False(t, httpVersionMatches(h2, "bogus"))
+}
+
+func TestRefreshConfigCancelled(t *testing.T) {
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		<-unblock
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Runner{ctx: ctx, stats: newStats(), opts: &Opts{UpdateURL: srv.URL}}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := r.RefreshConfig()
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "fetching config should be interrupted by cancellation")
+}
+
+func TestClockAnomaly(t *testing.T) {
+	_, anomalous := clockAnomaly(time.Now().Add(-time.Second), time.Second)
+	assert.False(t, anomalous, "consistent clocks")
+	_, anomalous = clockAnomaly(time.Now(), -time.Second)
+	assert.True(t, anomalous, "negative timing")
+	_, anomalous = clockAnomaly(time.Now().Add(-maxPlausibleTiming*2), maxPlausibleTiming*2)
+	assert.True(t, anomalous, "implausibly long timing")
+	// Strip the monotonic reading so that start only has the (jumped) wall
+	// clock, as if the wall clock had been set forward during the request.
+	drift, anomalous := clockAnomaly(time.Now().Add(-time.Hour).Round(0), time.Second)
+	assert.True(t, anomalous, "wall clock jump")
+	assert.InDelta(t, (time.Hour - time.Second).Seconds(), drift.Seconds(), 1)
+}
+
+func TestClockAnomalyReport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+	defer func() {
+		checkClock = clockAnomaly
+	}()
+	checkClock = func(start time.Time, delta time.Duration) (time.Duration, bool) {
+		return time.Hour, true
+	}
+
+	var reported map[string]interface{}
+	reportedTiming := time.Duration(-1)
+	report := func(timing time.Duration, ctx map[string]interface{}) {
+		reportedTiming = timing
+		reported = ctx
+	}
+	proxy := (&Proxy{Addrs: map[string]string{"https": "localhost:1"}}).withProtocol("https")
+	timing, err := doRequest(context.Background(), &Opts{}, report, srv.URL, proxy, http.DefaultTransport)
+	assert.NoError(t, err)
+	assert.Equal(t, discardedTiming, timing, "timing should be discarded")
+	if assert.NotNil(t, reported, "discarded sample should be reported") {
+		assert.Equal(t, time.Duration(0), reportedTiming)
+		assert.Equal(t, true, reported["clock_anomaly"])
+		assert.Equal(t, time.Hour.Seconds(), reported["clock_drift"])
+		_, isResult := reported["proxybench_success"]
+		assert.False(t, isResult, "discarded sample shouldn't count as a success or failure")
+	}
+
+	r := newRunner(context.Background(), &Opts{}, nil)
+	r.newRun(&Opts{}, false).record(srv.URL, proxy, timing, err)
+	assert.Empty(t, r.Stats(), "discarded sample shouldn't be recorded in stats")
+}
+
+func TestReportFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	var reported map[string]interface{}
+	var reportedTiming time.Duration
+	report := func(timing time.Duration, ctx map[string]interface{}) {
+		reportedTiming = timing
+		reported = ctx
+	}
+	proxy := (&Proxy{Addrs: map[string]string{"https": "localhost:1"}}).withProtocol("https")
+	_, err := doRequest(context.Background(), &Opts{}, report, srv.URL, proxy, http.DefaultTransport)
+	assert.Error(t, err)
+	if assert.NotNil(t, reported, "failure should be reported") {
+		assert.Equal(t, time.Duration(0), reportedTiming)
+		assert.Equal(t, false, reported["proxybench_success"])
+		assert.Equal(t, "status", reported["failure_reason"])
+		assert.Equal(t, http.StatusInternalServerError, reported["http_status"])
+		assert.Equal(t, srv.URL, reported["url"])
+		assert.NotNil(t, reported["failure_time"])
+		assert.NotEmpty(t, reported["failure_error"])
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	var reported map[string]interface{}
+	report := func(timing time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	}
+	opts := &Opts{RequestTimeout: 50 * time.Millisecond}
+	p := &Proxy{Addrs: map[string]string{"https": "localhost:1"}}
+	_, err := doRequest(context.Background(), opts, report, srv.URL, p.withProtocol("https"), http.DefaultTransport)
+	assert.Error(t, err)
+	assert.Equal(t, "timeout", reported["failure_reason"])
+	assert.Equal(t, true, reported["request_timeout_hit"])
+	assert.Equal(t, 0.05, reported["request_timeout"])
+
+	p.RequestTimeout = "5s"
+	_, err = doRequest(context.Background(), opts, report, srv.URL, p.withProtocol("https"), http.DefaultTransport)
+	assert.NoError(t, err, "proxy's own timeout should take precedence")
+	assert.Nil(t, reported["request_timeout_hit"])
+	assert.Equal(t, 5.0, reported["request_timeout"])
+}
+
+func TestTargetRequest(t *testing.T) {
+	type received struct {
+		method, host, header string
+		size                 int
+	}
+	requests := make(chan received, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests <- received{req.Method, req.Host, req.Header.Get("X-Test"), len(body)}
+	}))
+	defer srv.Close()
+
+	var reported map[string]interface{}
+	report := func(timing time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	}
+	opts := &Opts{Targets: []*Target{&Target{
+		URL:      srv.URL,
+		Method:   "PUT",
+		Headers:  map[string]string{"X-Test": "yes", "host": "example.com"},
+		BodySize: 1000,
+	}}}
+	proxy := (&Proxy{Addrs: map[string]string{"https": "localhost:1"}}).withProtocol("https")
+	_, err := doRequest(context.Background(), opts, report, srv.URL, proxy, http.DefaultTransport)
+	if assert.NoError(t, err) {
+		assert.Equal(t, received{"PUT", "example.com", "yes", 1000}, <-requests)
+		assert.Equal(t, "PUT", reported["request_method"])
+		assert.EqualValues(t, 1000, reported["request_bytes"])
+	}
+
+	opts.Targets[0].Body = "hello"
+	opts.Targets[0].Method = ""
+	_, err = doRequest(context.Background(), opts, report, srv.URL, proxy, http.DefaultTransport)
+	if assert.NoError(t, err) {
+		assert.Equal(t, received{"GET", "example.com", "yes", 5}, <-requests, "Body should take precedence over BodySize")
+	}
+}
+
+func TestTruncatedDownload(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/cut":
+			// Promise more than we send, then hang up
+			resp.Header().Set("Content-Length", "1000")
+			resp.Write(make([]byte, 100))
+			resp.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		default:
+			resp.Write(make([]byte, 100))
+		}
+	}))
+	defer srv.Close()
+
+	var reported map[string]interface{}
+	report := func(timing time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	}
+	proxy := (&Proxy{Addrs: map[string]string{"https": "localhost:1"}}).withProtocol("https")
+	opts := &Opts{Targets: []*Target{
+		&Target{URL: srv.URL + "/cut"},
+		&Target{URL: srv.URL + "/short", ExpectBytes: 1000},
+		&Target{URL: srv.URL + "/long", ExpectBytes: 10},
+		&Target{URL: srv.URL + "/exact", ExpectBytes: 100},
+	}}
+
+	_, err := doRequest(context.Background(), opts, report, srv.URL+"/cut", proxy, http.DefaultTransport)
+	assert.Error(t, err)
+	assert.Equal(t, "truncated", reported["failure_reason"])
+	assert.EqualValues(t, 100, reported["response_bytes"])
+	assert.EqualValues(t, 1000, reported["expected_bytes"])
+
+	_, err = doRequest(context.Background(), opts, report, srv.URL+"/short", proxy, http.DefaultTransport)
+	assert.Error(t, err)
+	assert.Equal(t, "truncated", reported["failure_reason"])
+	assert.Equal(t, true, reported["response_truncated"])
+
+	_, err = doRequest(context.Background(), opts, report, srv.URL+"/long", proxy, http.DefaultTransport)
+	assert.Error(t, err)
+	assert.Equal(t, "size", reported["failure_reason"])
+
+	_, err = doRequest(context.Background(), opts, report, srv.URL+"/exact", proxy, http.DefaultTransport)
+	assert.NoError(t, err)
+}
+
+func TestSOCKS5(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	l, err := net.Listen("tcp", "localhost:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	credentials := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, credentials)
+		}
+	}()
+
+	p := &Proxy{Addrs: map[string]string{"socks5": l.Addr().String()}, SOCKS5Username: "user", SOCKS5Password: "pass"}
+	proxy := p.withRandomProtocol()
+	assert.Equal(t, "socks5", proxy.protocol)
+	timing, err := request(context.Background(), &Opts{}, func(time.Duration, map[string]interface{}) {}, origin.URL, proxy)
+	if assert.NoError(t, err) {
+		assert.True(t, timing > 0)
+		assert.Equal(t, "user:pass", <-credentials)
+	}
+}
+
+// serveSOCKS5 is a minimal SOCKS5 server supporting username/password
+// authentication and CONNECT.
+func serveSOCKS5(conn net.Conn, credentials chan<- string) {
+	defer conn.Close()
+	buf := make([]byte, 512)
+	read := func(n int) []byte {
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return nil
+		}
+		return buf[:n]
+	}
+	// Greeting
+	if b := read(2); b == nil || b[0] != 5 || read(int(b[1])) == nil {
+		return
+	}
+	conn.Write([]byte{5, 2})
+	// Username/password authentication
+	b := read(2)
+	if b == nil {
+		return
+	}
+	user := string(read(int(b[1])))
+	b = read(1)
+	if b == nil {
+		return
+	}
+	pass := string(read(int(b[0])))
+	credentials <- user + ":" + pass
+	conn.Write([]byte{1, 0})
+	// CONNECT request
+	b = read(4)
+	if b == nil || b[1] != 1 {
+		return
+	}
+	var host string
+	switch b[3] {
+	case 1:
+		host = net.IP(append([]byte(nil), read(4)...)).String()
+	case 3:
+		host = string(read(int(read(1)[0])))
+	default:
+		return
+	}
+	portBytes := read(2)
+	port := int(portBytes[0])<<8 | int(portBytes[1])
+	out, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer out.Close()
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go io.Copy(out, conn)
+	io.Copy(conn, out)
+}
+
+func TestPlainHTTPProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	proxied := make(chan string, 1)
+	proxySrv := httptest.NewServer(&httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			proxied <- req.URL.String()
+		},
+	})
+	defer proxySrv.Close()
+
+	p := &Proxy{Addrs: map[string]string{"http": proxySrv.Listener.Addr().String()}}
+	proxy := p.withRandomProtocol()
+	assert.Equal(t, "http", proxy.protocol)
+	var reported map[string]interface{}
+	timing, err := request(context.Background(), &Opts{}, func(_ time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	}, origin.URL, proxy)
+	if assert.NoError(t, err) {
+		assert.True(t, timing > 0)
+		assert.Equal(t, origin.URL+"/", <-proxied)
+		assert.Equal(t, "http", reported["proxy_protocol"])
+	}
+}
+
+func TestShadowsocks(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	// The server shares the client's replay protection within this process,
+	// so it would reject the client's salts as repeated.
+	os.Setenv("SHADOWSOCKS_SF_CAPACITY", "-1")
+	cipher, err := core.PickCipher("chacha20-ietf-poly1305", nil, "password")
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := net.Listen("tcp", "localhost:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn = cipher.StreamConn(conn)
+				defer conn.Close()
+				target, err := socks.ReadAddr(conn)
+				if err != nil {
+					return
+				}
+				out, err := net.Dial("tcp", target.String())
+				if err != nil {
+					return
+				}
+				defer out.Close()
+				go io.Copy(out, conn)
+				io.Copy(conn, out)
+			}()
+		}
+	}()
+
+	p := &Proxy{
+		Addrs:               map[string]string{"shadowsocks": l.Addr().String()},
+		ShadowsocksCipher:   "chacha20-ietf-poly1305",
+		ShadowsocksPassword: "password",
+	}
+	proxy := p.withRandomProtocol()
+	assert.Equal(t, "shadowsocks", proxy.protocol)
+	timing, err := request(context.Background(), &Opts{}, func(time.Duration, map[string]interface{}) {}, origin.URL, proxy)
+	if assert.NoError(t, err) {
+		assert.True(t, timing > 0)
+	}
+
+	p.ShadowsocksPassword = "wrong"
+	_, err = request(context.Background(), &Opts{}, func(time.Duration, map[string]interface{}) {}, origin.URL, p.withProtocol("shadowsocks"))
+	assert.Error(t, err, "should fail with the wrong password")
+}
+
+func TestLampshadePublicKey(t *testing.T) {
+	tlsCert, err := selfSignedCert()
+	if !assert.NoError(t, err) {
+		return
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsCert.Certificate[0]})
+
+	publicKey, err := lampshadePublicKey(string(cert))
+	if assert.NoError(t, err) {
+		assert.Equal(t, tlsCert.PrivateKey.(*rsa.PrivateKey).PublicKey.N, publicKey.N)
+	}
+	_, err = lampshadePublicKey("not a certificate")
+	assert.Error(t, err)
+}
+
+func TestPTArgs(t *testing.T) {
+	p := &Proxy{
+		Addrs:             map[string]string{"obfs4": "localhost:1", "shadowsocks": "localhost:2"},
+		ShadowsocksCipher: "aes-128-gcm",
+		PTArgs: map[string]map[string]string{
+			"obfs4":       {"cert": "configured", "extra": "value"},
+			"shadowsocks": {"password": "configured"},
+		},
+	}
+	args := p.withProtocol("obfs4").ptArgs(map[string]string{"cert": defaultOBFS4Cert, "iat-mode": defaultOBFS4IATMode})
+	cert, _ := args.Get("cert")
+	assert.Equal(t, "configured", cert, "configured args should override defaults")
+	iatMode, _ := args.Get("iat-mode")
+	assert.Equal(t, defaultOBFS4IATMode, iatMode, "defaults should fill in the rest")
+	extra, _ := args.Get("extra")
+	assert.Equal(t, "value", extra, "unknown args should be passed through")
+
+	proxy := p.withProtocol("shadowsocks")
+	assert.Equal(t, "configured", proxy.ptArg("password", p.ShadowsocksPassword))
+	assert.Equal(t, "aes-128-gcm", proxy.ptArg("cipher", p.ShadowsocksCipher), "should fall back to dedicated field")
+}
+
+func TestAuthToken(t *testing.T) {
+	tokens := make(chan string, 1)
+	proxySrv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		tokens <- req.Header.Get("X-Lantern-Auth-Token")
+		if req.Method != http.MethodConnect {
+			resp.Write([]byte("hello"))
+			return
+		}
+		out, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			resp.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer out.Close()
+		resp.WriteHeader(http.StatusOK)
+		in, _, err := resp.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer in.Close()
+		go io.Copy(out, in)
+		io.Copy(in, out)
+	}))
+	defer proxySrv.Close()
+	origin := httptest.NewTLSServer(http.NotFoundHandler())
+	defer origin.Close()
+
+	p := &Proxy{Addrs: map[string]string{"http": proxySrv.Listener.Addr().String()}, AuthToken: "token"}
+	noop := func(time.Duration, map[string]interface{}) {}
+	_, err := request(context.Background(), &Opts{}, noop, "http://example.com", p.withProtocol("http"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "token", <-tokens, "token should be sent with plain requests")
+	}
+
+	// The origin's certificate isn't trusted, so this fails after the CONNECT
+	request(context.Background(), &Opts{}, noop, origin.URL, p.withProtocol("http"))
+	assert.Equal(t, "token", <-tokens, "token should be sent with CONNECT")
+}
+
+func TestProxyHeader(t *testing.T) {
+	p := &Proxy{Username: "user", Password: "pass", AuthToken: "token"}
+	header := p.withProtocol("https").proxyHeader()
+	assert.Equal(t, "token", header.Get("X-Lantern-Auth-Token"))
+	assert.Equal(t, "Basic dXNlcjpwYXNz", header.Get("Proxy-Authorization"))
+	assert.Nil(t, p.withProtocol("socks5").proxyHeader(), "SOCKS5 proxies don't speak HTTP")
+	assert.Equal(t, "user:pass", p.withProtocol("socks5").localProxyURL("localhost:1").User.String())
+	assert.Nil(t, (&Proxy{}).withProtocol("https").proxyHeader())
+}
+
+func TestBenchModes(t *testing.T) {
+	assert.Empty(t, (&Opts{SamplesPerTarget: 1, KeepAliveRequests: 1, HTTP2Streams: 1}).benchModes())
+	assert.Equal(t, []string{"samplesPerTarget"}, (&Opts{SamplesPerTarget: 5}).benchModes())
+	assert.Equal(t, []string{"compareProtocols", "http2Streams", "keepAliveRequests", "samplesPerTarget"},
+		(&Opts{CompareProtocols: true, HTTP2Streams: 2, KeepAliveRequests: 3, SamplesPerTarget: 5}).benchModes(),
+		"modes should be listed in order of precedence")
 }
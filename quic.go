@@ -0,0 +1,106 @@
+package proxybench
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/getlantern/ops"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// quicNextProto is negotiated with quic proxies that carry HTTP/1.1 proxy
+// traffic over a QUIC stream.
+const quicNextProto = "http/1.1"
+
+// dialQUICConn establishes a QUIC connection to the proxy, negotiating the
+// given protocol, and records how long the handshake took.
+func (p *proxy) dialQUICConn(ctx context.Context, nextProto string) (quic.EarlyConnection, error) {
+	start := time.Now()
+	conn, err := quic.DialAddrEarly(ctx, p.addr, &tls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: p.verifyPeerCertificate,
+		ServerName:            p.FrontDomain,
+		NextProtos:            []string{nextProto},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-conn.HandshakeComplete():
+	case <-conn.Context().Done():
+		return nil, context.Cause(conn.Context())
+	}
+	p.mx.Lock()
+	p.quicHandshake = time.Since(start)
+	p.mx.Unlock()
+	return conn, nil
+}
+
+// dialQUIC dials the proxy over QUIC and opens a stream over which to tunnel
+// the request.
+func (p *proxy) dialQUIC() (net.Conn, error) {
+	ctx := context.Background()
+	conn, err := p.dialQUICConn(ctx, quicNextProto)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return &quicStreamConn{Stream: stream, conn: conn}, nil
+}
+
+// quicStreamConn adapts a QUIC stream to a net.Conn. Closing it closes the
+// whole QUIC connection, since each connection carries only one stream.
+type quicStreamConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicStreamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *quicStreamConn) Close() error {
+	c.Stream.Close()
+	return c.conn.CloseWithError(0, "")
+}
+
+// usesHTTP3 determines whether to request origin from the proxy over HTTP/3.
+func (p *proxy) usesHTTP3(opts *Opts, origin string) bool {
+	return p.protocol == "quic" && opts.HTTP3 && strings.HasPrefix(origin, "https://")
+}
+
+// requestHTTP3 fetches origin by sending the request to the proxy over
+// HTTP/3.
+func requestHTTP3(ctx context.Context, opts *Opts, report ReportFN, origin string, proxy *proxy) (time.Duration, error) {
+	transport := &http3.Transport{
+		// Connect to the proxy regardless of the origin's address
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			return proxy.dialQUICConn(ctx, http3.NextProtoH3)
+		},
+	}
+	defer transport.Close()
+	return doRequest(ctx, opts, report, origin, proxy, transport)
+}
+
+// setQUICHandshake sets the duration of the QUIC handshake with the proxy on
+// op, if it happened.
+func (p *proxy) setQUICHandshake(op ops.Op) {
+	p.mx.Lock()
+	handshake := p.quicHandshake
+	p.mx.Unlock()
+	if handshake > 0 {
+		op.Set("quic_handshake_time", handshake.Seconds())
+	}
+}
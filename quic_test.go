@@ -0,0 +1,113 @@
+package proxybench
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQUIC(t *testing.T) {
+	cert, err := selfSignedCert()
+	if !assert.NoError(t, err) {
+		return
+	}
+	l, err := quic.ListenAddr("localhost:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{quicNextProto},
+	}, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				defer stream.Close()
+				// Act as the proxy and the origin at once
+				if _, err := http.ReadRequest(bufio.NewReader(stream)); err != nil {
+					return
+				}
+				stream.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+			}()
+		}
+	}()
+
+	p := &Proxy{Addrs: map[string]string{"quic": l.Addr().String()}}
+	proxy := p.withRandomProtocol()
+	assert.Equal(t, "quic", proxy.protocol)
+	var reported map[string]interface{}
+	timing, err := request(context.Background(), &Opts{}, func(_ time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	}, "http://example.com", proxy)
+	if assert.NoError(t, err) {
+		assert.True(t, timing > 0)
+		assert.Contains(t, reported, "quic_handshake_time")
+	}
+}
+
+func TestHTTP3(t *testing.T) {
+	cert, err := selfSignedCert()
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv := &http3.Server{
+		Addr:      "localhost:0",
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		Handler: http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			resp.Write([]byte("hello"))
+		}),
+	}
+	l, err := quic.ListenAddrEarly("localhost:0", srv.TLSConfig, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	go srv.ServeListener(l)
+	defer srv.Close()
+
+	p := &Proxy{Addrs: map[string]string{"quic": l.Addr().String()}}
+	var reported map[string]interface{}
+	timing, err := request(context.Background(), &Opts{HTTP3: true}, func(_ time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	}, "https://example.com", p.withProtocol("quic"))
+	if assert.NoError(t, err) {
+		assert.True(t, timing > 0)
+		assert.Equal(t, "HTTP/3.0", reported["http_proto"])
+		assert.Contains(t, reported, "quic_handshake_time")
+	}
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,111 @@
+package proxybench
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a simple token bucket rate limiter. Tokens accrue at rate
+// per second up to capacity.
+type tokenBucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+	mx       sync.Mutex
+}
+
+func newTokenBucket(rate float64, capacity float64) *tokenBucket {
+	return &tokenBucket{
+		rate:     rate,
+		capacity: capacity,
+		tokens:   capacity,
+		last:     time.Now(),
+	}
+}
+
+// take removes up to n tokens from the bucket, blocking until at least one
+// token is available, and returns the number of tokens taken.
+func (tb *tokenBucket) take(n int) int {
+	for {
+		tb.mx.Lock()
+		now := time.Now()
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.capacity {
+			tb.tokens = tb.capacity
+		}
+		tb.last = now
+		if tb.tokens >= 1 {
+			taken := n
+			if float64(taken) > tb.tokens {
+				taken = int(tb.tokens)
+			}
+			tb.tokens -= float64(taken)
+			tb.mx.Unlock()
+			return taken
+		}
+		wait := time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+		tb.mx.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// refund returns n unused tokens to the bucket.
+func (tb *tokenBucket) refund(n int) {
+	tb.mx.Lock()
+	tb.tokens += float64(n)
+	if tb.tokens > tb.capacity {
+		tb.tokens = tb.capacity
+	}
+	tb.mx.Unlock()
+}
+
+// wait blocks until n tokens have been taken from the bucket.
+func (tb *tokenBucket) wait(n int) {
+	for n > 0 {
+		n -= tb.take(n)
+	}
+}
+
+// throttledConn is a net.Conn whose reads and writes are each limited to a
+// fixed number of bytes per second.
+type throttledConn struct {
+	net.Conn
+	reads  *tokenBucket
+	writes *tokenBucket
+}
+
+func newThrottledConn(conn net.Conn, bytesPerSecond int) net.Conn {
+	rate := float64(bytesPerSecond)
+	return &throttledConn{
+		Conn:   conn,
+		reads:  newTokenBucket(rate, rate),
+		writes: newTokenBucket(rate, rate),
+	}
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return c.Conn.Read(b)
+	}
+	taken := c.reads.take(len(b))
+	n, err := c.Conn.Read(b[:taken])
+	if n < taken {
+		// Short reads are the norm, so only pay for the bytes that arrived
+		c.reads.refund(taken - n)
+	}
+	return n, err
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := c.Conn.Write(b[written : written+c.writes.take(len(b)-written)])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,52 @@
+package proxybench
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(100000, 100000)
+	start := time.Now()
+	// The first 100000 tokens are available immediately, the remaining 50000
+	// accrue over half a second.
+	tb.wait(150000)
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 400*time.Millisecond, "waited only %v", elapsed)
+	assert.True(t, elapsed < 2*time.Second, "waited too long: %v", elapsed)
+}
+
+// shortReadConn returns at most 100 bytes per read, like a TCP connection
+// returning whatever has arrived so far.
+type shortReadConn struct {
+	net.Conn
+}
+
+func (c *shortReadConn) Read(b []byte) (int, error) {
+	if len(b) > 100 {
+		b = b[:100]
+	}
+	return len(b), nil
+}
+
+func TestThrottledConnShortReads(t *testing.T) {
+	conn := newThrottledConn(&shortReadConn{}, 10000)
+	b := make([]byte, 10000)
+	start := time.Now()
+	// The first 10000 bytes can be read immediately, the remaining 5000 take
+	// half a second. Charging for the whole buffer on each short read would
+	// take three times as long.
+	for read := 0; read < 15000; {
+		n, err := conn.Read(b)
+		if !assert.NoError(t, err) {
+			return
+		}
+		read += n
+	}
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 400*time.Millisecond, "waited only %v", elapsed)
+	assert.True(t, elapsed < 1200*time.Millisecond, "short reads were throttled too much: %v", elapsed)
+}
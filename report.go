@@ -0,0 +1,138 @@
+package proxybench
+
+// knownReportFields are the fields that proxybench itself may include in the
+// context passed to a ReportFN.
+var knownReportFields = map[string]bool{
+	"url":                          true,
+	"origin":                       true,
+	"origin_host":                  true,
+	"proxy_type":                   true,
+	"proxy_protocol":               true,
+	"proxy_provider":               true,
+	"proxy_datacenter":             true,
+	"proxy_host":                   true,
+	"proxy_port":                   true,
+	"proxybench_success":           true,
+	"newly_added":                  true,
+	"clock_anomaly":                true,
+	"clock_drift":                  true,
+	"simulated_bandwidth_bps":      true,
+	"tcp_rtt_us":                   true,
+	"tcp_retransmits":              true,
+	"proxy_fully_down":             true,
+	"proxy_protocols_tried":        true,
+	"proxy_errors":                 true,
+	"protocol_comparison":          true,
+	"https_latency":                true,
+	"obfs4_latency":                true,
+	"latency_delta":                true,
+	"latency_ratio":                true,
+	"baseline_intercepted":         true,
+	"baseline_interception_reason": true,
+	"obfs4_iat_mode":               true,
+	"queue_wait_time":              true,
+	"request_type":                 true,
+	"ws_upgrade_success":           true,
+	"ws_upgrade_status":            true,
+	"ws_upgrade_time":              true,
+	"ws_ping_rtt":                  true,
+	"run_id":                       true,
+	"run_verdict":                  true,
+	"run_healthy":                  true,
+	"critical_targets":             true,
+	"critical_failures":            true,
+	"system_proxy_direct":          true,
+	"run_cancelled":                true,
+	"endpoints_completed":          true,
+	"endpoints_skipped":            true,
+	"alpn":                         true,
+	"failure_phase":                true,
+	"front_domain":                 true,
+	"retry_budget_exhausted":       true,
+	"doh_query_name":               true,
+	"doh_resolve_time":             true,
+	"doh_answers":                  true,
+	"local_relay_addr":             true,
+	"content_type":                 true,
+	"content_type_mismatch":        true,
+	"failure_reason":               true,
+	"captive_portal_detected":      true,
+	"captive_portal_status":        true,
+	"http_proto":                   true,
+	"http_version_mismatch":        true,
+	"slow":                         true,
+	"attempted_ips":                true,
+	"connected_ip":                 true,
+	"cross_run_reuse":              true,
+	"stats_snapshot":               true,
+	"stats_proxy":                  true,
+	"stats_successes":              true,
+	"stats_failures":               true,
+	"stats_latency_ema":            true,
+	"stats_failure_ema":            true,
+	"http_status":                  true,
+	"failure_time":                 true,
+	"failure_error":                true,
+	"dns_time":                     true,
+	"connect_time":                 true,
+	"tls_handshake_time":           true,
+	"ttfb":                         true,
+	"transfer_time":                true,
+	"response_bytes":               true,
+	"throughput_bps":               true,
+	"quic_handshake_time":          true,
+	"snowflake_rendezvous_time":    true,
+	"cert_verification_failed":     true,
+	"tls_fingerprint":              true,
+	"tls_full_handshake_time":      true,
+	"tls_resumed_handshake_time":   true,
+	"tls_session_resumed":          true,
+	"baseline_latency":             true,
+	"proxy_overhead":               true,
+	"sample_aggregate":             true,
+	"samples":                      true,
+	"samples_succeeded":            true,
+	"latency_min":                  true,
+	"latency_max":                  true,
+	"latency_mean":                 true,
+	"latency_p50":                  true,
+	"latency_p95":                  true,
+	"latency_p99":                  true,
+	"request_timeout":              true,
+	"request_timeout_hit":          true,
+	"request_method":               true,
+	"request_bytes":                true,
+	"expected_bytes":               true,
+	"response_truncated":           true,
+	"upload_bytes":                 true,
+	"upload_time":                  true,
+	"upload_throughput_bps":        true,
+	"keepalive_index":              true,
+	"conn_reused":                  true,
+	"keepalive_requests":           true,
+	"keepalive_first_latency":      true,
+	"keepalive_subsequent_latency": true,
+	"keepalive_setup_overhead":     true,
+	"h2_stream_index":              true,
+	"h2_streams":                   true,
+	"h2_streams_succeeded":         true,
+	"h2_total_time":                true,
+	"h2_stream_latency_mean":       true,
+	"h2_stream_latency_max":        true,
+	"h2_multiplexed":               true,
+	"anomaly":                      true,
+	"anomaly_value":                true,
+	"anomaly_baseline":             true,
+	"anomaly_stddev":               true,
+}
+
+// filterFields returns a copy of ctx containing only the given fields.
+func filterFields(ctx map[string]interface{}, fields []string) map[string]interface{} {
+	filtered := make(map[string]interface{}, len(fields))
+	for _, field := range fields {
+		if value, found := ctx[field]; found {
+			filtered[field] = value
+		}
+	}
+	return filtered
+}
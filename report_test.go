@@ -0,0 +1,26 @@
+package proxybench
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowThreshold(t *testing.T) {
+	var reported map[string]interface{}
+	r := &Runner{}
+	r.SetReporter(func(timing time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	})
+
+	report := r.reporter(&Opts{SlowThreshold: time.Second})
+	report(2*time.Second, map[string]interface{}{"url": "a"})
+	assert.Equal(t, true, reported["slow"])
+	report(500*time.Millisecond, map[string]interface{}{"url": "a"})
+	assert.Nil(t, reported["slow"])
+
+	report = r.reporter(&Opts{SlowThreshold: time.Second, ReportFields: []string{"url"}})
+	report(2*time.Second, map[string]interface{}{"url": "a"})
+	assert.Equal(t, map[string]interface{}{"url": "a"}, reported, "slow should be subject to field filtering")
+}
@@ -0,0 +1,229 @@
+package proxybench
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Reporter receives reports. Unlike a ReportFN, it gets a Result, which can
+// gain fields without breaking implementations, and it's flushed by
+// Runner.Flush and closed when the Runner is stopped.
+type Reporter interface {
+	// Report delivers a report. It's called concurrently from the goroutines
+	// running benchmarks, so it shouldn't block for long.
+	Report(result Result)
+
+	// Flush waits for reports buffered by the Reporter to be delivered.
+	Flush() error
+
+	// Close flushes and releases the Reporter's resources.
+	Close() error
+}
+
+// Result is the outcome of a benchmark request, as returned by RunOnce. It's
+// also what's delivered to a Reporter, which additionally receives summaries
+// like run verdicts and stats snapshots as Results that aren't requests.
+type Result struct {
+	// Time is when the result was reported.
+	Time time.Time
+
+	// Timing is the measured timing, 0 for failures, discarded timings and
+	// summaries.
+	Timing time.Duration
+
+	// IsRequest is true for the results of individual requests and false for
+	// summaries.
+	IsRequest bool
+
+	// Success is whether the request succeeded.
+	Success bool
+
+	URL string
+
+	// Proxy is the benchmarked proxy. It's only known to RunOnce, Reporters
+	// get the ProxyAddr.
+	Proxy *Proxy
+
+	ProxyAddr  string // host:port
+	Protocol   string
+	Provider   string
+	DataCenter string
+
+	// FailureReason categorizes why the request failed, like "dial" or
+	// "timeout".
+	FailureReason string
+
+	// Error is the error with which the request failed.
+	Error error
+
+	// ResponseBytes is the size of the response body.
+	ResponseBytes int64
+
+	// Phases of the request, 0 if not measured.
+	DNSTime          time.Duration
+	ConnectTime      time.Duration
+	TLSHandshakeTime time.Duration
+	TTFB             time.Duration
+	TransferTime     time.Duration
+
+	// Fields are all of the report's fields, as passed to a ReportFN. They're
+	// not set by RunOnce.
+	Fields map[string]interface{}
+}
+
+// Report implements Reporter by passing the result's Timing and Fields to
+// the ReportFN.
+func (fn ReportFN) Report(result Result) {
+	fn(result.Timing, result.Fields)
+}
+
+// Flush implements Reporter. A ReportFN doesn't buffer, so there's nothing to
+// flush.
+func (fn ReportFN) Flush() error {
+	return nil
+}
+
+// Close implements Reporter. A ReportFN has nothing to close.
+func (fn ReportFN) Close() error {
+	return nil
+}
+
+// NewResult builds a Result from the timing and context passed to a ReportFN.
+func NewResult(timing time.Duration, ctx map[string]interface{}) Result {
+	result := Result{
+		Time:             time.Now(),
+		Timing:           timing,
+		URL:              stringField(ctx, "url"),
+		Protocol:         stringField(ctx, "proxy_protocol"),
+		Provider:         stringField(ctx, "proxy_provider"),
+		DataCenter:       stringField(ctx, "proxy_datacenter"),
+		FailureReason:    stringField(ctx, "failure_reason"),
+		DNSTime:          secondsField(ctx, "dns_time"),
+		ConnectTime:      secondsField(ctx, "connect_time"),
+		TLSHandshakeTime: secondsField(ctx, "tls_handshake_time"),
+		TTFB:             secondsField(ctx, "ttfb"),
+		TransferTime:     secondsField(ctx, "transfer_time"),
+		Fields:           ctx,
+	}
+	result.Success, result.IsRequest = ctx["proxybench_success"].(bool)
+	if host := stringField(ctx, "proxy_host"); host != "" {
+		result.ProxyAddr = net.JoinHostPort(host, stringField(ctx, "proxy_port"))
+	}
+	if msg := stringField(ctx, "failure_error"); msg != "" {
+		result.Error = errors.New(msg)
+	}
+	switch size := ctx["response_bytes"].(type) {
+	case int:
+		result.ResponseBytes = int64(size)
+	case int64:
+		result.ResponseBytes = size
+	}
+	return result
+}
+
+func stringField(ctx map[string]interface{}, key string) string {
+	value, found := ctx[key]
+	if !found || value == nil {
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+func secondsField(ctx map[string]interface{}, key string) time.Duration {
+	seconds, _ := ctx[key].(float64)
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// reporterHolder allows storing different Reporter implementations in an
+// atomic.Value.
+type reporterHolder struct {
+	Reporter
+}
+
+// SetResultReporter changes the Reporter to which results are reported.
+// Requests that are already in flight continue to report to the previous
+// Reporter. The previous Reporter isn't closed.
+func (r *Runner) SetResultReporter(rep Reporter) {
+	if fn, isFN := rep.(ReportFN); rep == nil || (isFN && fn == nil) {
+		rep = ReportFN(func(time.Duration, map[string]interface{}) {})
+	}
+	r.report.Store(reporterHolder{rep})
+}
+
+// resultReporter returns the current Reporter, fanning out to
+// opts.Reporters if there are any.
+func (r *Runner) resultReporter(opts *Opts) Reporter {
+	rep := r.report.Load().(reporterHolder).Reporter
+	if len(opts.Reporters) == 0 {
+		return rep
+	}
+	return MultiReporter(append([]Reporter{rep}, opts.Reporters...)...)
+}
+
+// MultiReporter returns a Reporter that delivers every report to all of the
+// given reporters. Each gets its own copy of the report's Fields, and a
+// reporter that panics is logged and skipped without affecting the others.
+// Flush and Close are called on every reporter, returning an error if any of
+// them fail.
+func MultiReporter(reporters ...Reporter) Reporter {
+	return multiReporter(reporters)
+}
+
+type multiReporter []Reporter
+
+func (mr multiReporter) Report(result Result) {
+	for i, reporter := range mr {
+		own := result
+		if i < len(mr)-1 {
+			// The last reporter can have the original
+			own.Fields = copyFields(result.Fields)
+		}
+		isolate(reporter, "report", func() error {
+			reporter.Report(own)
+			return nil
+		})
+	}
+}
+
+func (mr multiReporter) Flush() error {
+	return mr.each("flush", Reporter.Flush)
+}
+
+func (mr multiReporter) Close() error {
+	return mr.each("close", Reporter.Close)
+}
+
+func (mr multiReporter) each(action string, fn func(Reporter) error) error {
+	var errs []string
+	for _, reporter := range mr {
+		reporter := reporter
+		if err := isolate(reporter, action, func() error { return fn(reporter) }); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Unable to %v %d of %d reporters: %v", action, len(errs), len(mr), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// isolate calls fn, turning a panic into an error.
+func isolate(reporter Reporter, action string, fn func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = log.Errorf("Reporter %T panicked on %v: %v", reporter, action, p)
+		}
+	}()
+	return fn()
+}
+
+func copyFields(fields map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		copied[key] = value
+	}
+	return copied
+}
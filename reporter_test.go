@@ -0,0 +1,187 @@
+package proxybench
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingReporter struct {
+	reports []Result
+	flushed int
+	closed  int
+	mx      sync.Mutex
+}
+
+func (rr *recordingReporter) Report(result Result) {
+	rr.mx.Lock()
+	rr.reports = append(rr.reports, result)
+	rr.mx.Unlock()
+}
+
+func (rr *recordingReporter) Flush() error {
+	rr.flushed++
+	return nil
+}
+
+func (rr *recordingReporter) Close() error {
+	rr.closed++
+	return nil
+}
+
+func TestReporter(t *testing.T) {
+	rr := &recordingReporter{}
+	r := &Runner{stats: newStats(), opts: &Opts{}}
+	r.SetResultReporter(rr)
+
+	report := r.reporter(&Opts{})
+	report(2*time.Second, map[string]interface{}{
+		"url":                "https://a.com",
+		"proxy_host":         "1.2.3.4",
+		"proxy_port":         "443",
+		"proxy_protocol":     "https",
+		"proxy_provider":     "do",
+		"proxy_datacenter":   "ams3",
+		"proxybench_success": true,
+		"response_bytes":     int64(100),
+		"ttfb":               0.5,
+	})
+	report(0, map[string]interface{}{
+		"proxybench_success": false,
+		"failure_reason":     "dial",
+		"failure_error":      "connection refused",
+	})
+	report(0, map[string]interface{}{"run_verdict": "healthy"})
+	assert.NoError(t, r.Flush())
+	assert.Equal(t, 1, rr.flushed)
+
+	if assert.Len(t, rr.reports, 3) {
+		rep := rr.reports[0]
+		assert.True(t, rep.IsRequest)
+		assert.True(t, rep.Success)
+		assert.Equal(t, 2*time.Second, rep.Timing)
+		assert.Equal(t, "https://a.com", rep.URL)
+		assert.Equal(t, "1.2.3.4:443", rep.ProxyAddr)
+		assert.Equal(t, "https", rep.Protocol)
+		assert.Equal(t, "do", rep.Provider)
+		assert.Equal(t, "ams3", rep.DataCenter)
+		assert.EqualValues(t, 100, rep.ResponseBytes)
+		assert.Equal(t, 500*time.Millisecond, rep.TTFB)
+		assert.Equal(t, "do", rep.Fields["proxy_provider"])
+		assert.False(t, rep.Time.IsZero())
+
+		rep = rr.reports[1]
+		assert.True(t, rep.IsRequest)
+		assert.False(t, rep.Success)
+		assert.Equal(t, "dial", rep.FailureReason)
+		assert.EqualError(t, rep.Error, "connection refused")
+
+		assert.False(t, rr.reports[2].IsRequest)
+	}
+}
+
+func TestReporterClosedOnStop(t *testing.T) {
+	rr := &recordingReporter{}
+	r := newRunner(context.Background(), &Opts{}, rr)
+	close(r.done)
+	r.Stop()
+	assert.Equal(t, 1, rr.closed)
+}
+
+func TestNilReporter(t *testing.T) {
+	r := &Runner{}
+	r.SetReporter(nil)
+	r.reporter(&Opts{})(0, map[string]interface{}{})
+	r.SetResultReporter(nil)
+	r.reporter(&Opts{})(0, map[string]interface{}{})
+}
+
+type panickingReporter struct{}
+
+func (panickingReporter) Report(result Result) {
+	result.Fields["tampered"] = true
+	panic("report")
+}
+
+func (panickingReporter) Flush() error {
+	return errors.New("unable to flush")
+}
+
+func (panickingReporter) Close() error {
+	panic("close")
+}
+
+func TestOptsReporters(t *testing.T) {
+	main := &recordingReporter{}
+	extra := &recordingReporter{}
+	opts := &Opts{Reporters: []Reporter{panickingReporter{}, extra}}
+	r := newRunner(context.Background(), opts, main)
+
+	r.reporter(opts)(time.Second, map[string]interface{}{"url": "https://a.com"})
+	for _, rr := range []*recordingReporter{main, extra} {
+		if assert.Len(t, rr.reports, 1) {
+			assert.Equal(t, "https://a.com", rr.reports[0].URL)
+			assert.Nil(t, rr.reports[0].Fields["tampered"], "reporters should get their own fields")
+		}
+	}
+
+	assert.Error(t, r.Flush())
+	assert.Equal(t, 1, main.flushed, "failing reporter shouldn't prevent others from flushing")
+	assert.Equal(t, 1, extra.flushed)
+
+	close(r.done)
+	r.Stop()
+	assert.Equal(t, 1, main.closed, "panicking reporter shouldn't prevent others from closing")
+	assert.Equal(t, 1, extra.closed)
+}
+
+func TestReportersCarriedOver(t *testing.T) {
+	from := &Opts{Reporters: []Reporter{&recordingReporter{}}}
+	opts := &Opts{}
+	opts.copyLocalSettings(from)
+	assert.Equal(t, from.Reporters, opts.Reporters)
+}
+
+func TestSetReporterWhileRunning(t *testing.T) {
+	// Find a port that nothing is listening on, so that requests fail fast
+	l, err := net.Listen("tcp", "localhost:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var mx sync.Mutex
+	var first, second int
+	p := &Proxy{Addrs: map[string]string{"https": addr}}
+	r := Monitor(&Opts{URLs: []string{"http://example.com"}}, p, 10*time.Millisecond, func(timing time.Duration, ctx map[string]interface{}) {
+		mx.Lock()
+		first++
+		mx.Unlock()
+	})
+	defer r.Stop()
+	time.Sleep(100 * time.Millisecond)
+
+	r.SetReporter(func(timing time.Duration, ctx map[string]interface{}) {
+		mx.Lock()
+		second++
+		mx.Unlock()
+	})
+	// Allow for a request that was already in flight
+	time.Sleep(50 * time.Millisecond)
+	mx.Lock()
+	firstBefore, secondBefore := first, second
+	mx.Unlock()
+	time.Sleep(100 * time.Millisecond)
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.True(t, firstBefore > 0, "should have reported to the original reporter")
+	assert.Equal(t, firstBefore, first, "shouldn't report to the original reporter once replaced")
+	assert.True(t, second > secondBefore, "should report to the new reporter")
+}
@@ -0,0 +1,140 @@
+package proxybench_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"github.com/getlantern/proxybench/binreport"
+	"github.com/getlantern/proxybench/bordareporter"
+	"github.com/getlantern/proxybench/csvreporter"
+	"github.com/getlantern/proxybench/grpcreporter"
+	"github.com/getlantern/proxybench/influxreporter"
+	"github.com/getlantern/proxybench/jsonlreporter"
+	"github.com/getlantern/proxybench/kafkareporter"
+	"github.com/getlantern/proxybench/otelreporter"
+	"github.com/getlantern/proxybench/promreporter"
+	"github.com/getlantern/proxybench/sqlitestore"
+	"github.com/getlantern/proxybench/statsdreporter"
+	"github.com/getlantern/proxybench/webhookreporter"
+	"github.com/stretchr/testify/assert"
+)
+
+// All of the built-in reporters are Reporters, so that they're flushed and
+// closed along with the Runner.
+var (
+	_ proxybench.Reporter = (*binreport.Reporter)(nil)
+	_ proxybench.Reporter = (*bordareporter.Reporter)(nil)
+	_ proxybench.Reporter = (*csvreporter.Reporter)(nil)
+	_ proxybench.Reporter = (*grpcreporter.Reporter)(nil)
+	_ proxybench.Reporter = (*influxreporter.Reporter)(nil)
+	_ proxybench.Reporter = (*jsonlreporter.Reporter)(nil)
+	_ proxybench.Reporter = (*kafkareporter.Reporter)(nil)
+	_ proxybench.Reporter = (*otelreporter.MetricsReporter)(nil)
+	_ proxybench.Reporter = (*otelreporter.TraceReporter)(nil)
+	_ proxybench.Reporter = (*promreporter.Reporter)(nil)
+	_ proxybench.Reporter = (*sqlitestore.Store)(nil)
+	_ proxybench.Reporter = (*statsdreporter.Reporter)(nil)
+	_ proxybench.Reporter = (*webhookreporter.Reporter)(nil)
+)
+
+func TestBinaryReportFields(t *testing.T) {
+	ids := make(map[string]bool, len(binreport.Fields))
+	for _, field := range binreport.Fields {
+		ids[field] = true
+	}
+	for field := range proxybench.KnownReportFields {
+		assert.True(t, ids[field], "%v should have a binary report field ID", field)
+	}
+}
+
+func TestReportersFlushedAndClosed(t *testing.T) {
+	var mx sync.Mutex
+	var posted []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var batch []map[string]interface{}
+		if assert.NoError(t, json.NewDecoder(req.Body).Decode(&batch)) {
+			mx.Lock()
+			posted = append(posted, batch...)
+			mx.Unlock()
+		}
+	}))
+	defer srv.Close()
+	webhook, err := webhookreporter.New(&webhookreporter.Opts{URL: srv.URL, FlushInterval: time.Hour})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "proxybench")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "results.jsonl")
+	jsonl, err := jsonlreporter.New(&jsonlreporter.Opts{Path: path})
+	if !assert.NoError(t, err) {
+		return
+	}
+	lines := func() int {
+		f, err := os.Open(path)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		defer f.Close()
+		n := 0
+		for scanner := bufio.NewScanner(f); scanner.Scan(); {
+			n++
+		}
+		return n
+	}
+
+	// Find a port that nothing is listening on, so that the request fails fast
+	l, err := net.Listen("tcp", "localhost:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	// Reporters are called in order, so once the last one has seen a report,
+	// so have the others
+	reported := make(chan bool, 100)
+	opts := &proxybench.Opts{
+		URLs: []string{"http://example.com"},
+		Reporters: []proxybench.Reporter{webhook, jsonl, proxybench.ReportFN(func(timing time.Duration, ctx map[string]interface{}) {
+			reported <- true
+		})},
+	}
+	p := &proxybench.Proxy{Addrs: map[string]string{"https": addr}}
+	r := proxybench.MonitorWithReporter(context.Background(), opts, p, time.Hour, nil)
+	select {
+	case <-reported:
+	case <-time.After(10 * time.Second):
+		t.Fatal("nothing reported")
+	}
+
+	if !assert.NoError(t, r.Flush()) {
+		return
+	}
+	mx.Lock()
+	numPosted := len(posted)
+	mx.Unlock()
+	assert.True(t, numPosted > 0, "flushing should have posted to the webhook")
+	assert.Equal(t, numPosted, lines(), "both reporters should have received every report")
+
+	r.Stop()
+	webhook.Report(proxybench.NewResult(0, map[string]interface{}{"url": "http://example.com"}))
+	assert.EqualValues(t, 1, webhook.Dropped(), "webhook reporter should have been closed")
+	jsonl.Report(proxybench.NewResult(0, map[string]interface{}{"url": "http://example.com"}))
+	assert.Equal(t, numPosted, lines(), "jsonl reporter should have been closed")
+}
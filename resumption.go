@@ -0,0 +1,127 @@
+package proxybench
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/getlantern/ops"
+)
+
+// sessionTicketWait is how long to wait for an https proxy to send a session
+// ticket after the initial handshake when benchmarking resumption.
+const sessionTicketWait = 5 * time.Second
+
+// benchTLSResumption performs two sequential TLS handshakes with the https
+// address of p, the second resuming the session established by the first,
+// and reports the latency of both. Handshakes always use Go's own
+// ClientHello, regardless of p.TLSFingerprint.
+func (rn *run) benchTLSResumption(p *Proxy, enqueued time.Time) {
+	rn.pacer.wait(rn.ctx, rn.opts, "")
+	report := rn.reporter()
+	cache := newTicketCache()
+	proxy := rn.attempt(p.withProtocol("https"), enqueued)
+	op := beginOp(rn.opts, "", proxy).Set("request_type", "tls_resumption")
+	defer op.End()
+
+	start := time.Now()
+	conn, full, err := proxy.timeTLSHandshake(rn, cache)
+	if err != nil {
+		rn.reportResumptionFailure(report, op, proxy, start, err)
+		return
+	}
+	// TLS 1.3 session tickets arrive after the handshake and are only
+	// processed while reading.
+	go io.Copy(ioutil.Discard, conn)
+	select {
+	case <-cache.received:
+	case <-time.After(sessionTicketWait):
+		log.Debugf("No session ticket received from %v", proxy.addr)
+	case <-rn.ctx.Done():
+	}
+	conn.Close()
+	if rn.ctx.Err() != nil {
+		return
+	}
+
+	start = time.Now()
+	proxy = rn.attempt(p.withProtocol("https"), enqueued)
+	conn, resumed, err := proxy.timeTLSHandshake(rn, cache)
+	if err != nil {
+		rn.reportResumptionFailure(report, op, proxy, start, err)
+		return
+	}
+	didResume := conn.ConnectionState().DidResume
+	conn.Close()
+	log.Debugf("TLS handshake with %v took %v, resumed in %v (resumed: %v)", proxy.addr, full, resumed, didResume)
+	op.Set("tls_full_handshake_time", full.Seconds()).
+		Set("tls_resumed_handshake_time", resumed.Seconds()).
+		Set("tls_session_resumed", didResume).
+		Set("proxybench_success", true)
+	report(resumed, ops.AsMap(op, true))
+}
+
+func (rn *run) reportResumptionFailure(report ReportFN, op ops.Op, proxy *proxy, start time.Time, err error) {
+	if rn.ctx.Err() != nil {
+		return
+	}
+	log.Debugf("Unable to benchmark TLS session resumption with %v: %v", proxy.addr, err)
+	if phase := proxy.dialFailurePhase(); phase != "" {
+		op.Set("failure_phase", phase)
+	}
+	if proxy.certVerificationFailed() {
+		op.Set("cert_verification_failed", true)
+	}
+	reportFailure(report, op, "dial", start, err)
+}
+
+// timeTLSHandshake connects to the proxy and returns the TLS connection along
+// with how long the handshake (excluding the TCP connect) took.
+func (p *proxy) timeTLSHandshake(rn *run, cache tls.ClientSessionCache) (*tls.Conn, time.Duration, error) {
+	conn, err := p.dialTCP(rn.ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: p.verifyPeerCertificate,
+		ServerName:            p.FrontDomain,
+		NextProtos:            []string{"http/1.1"},
+		ClientSessionCache:    cache,
+	})
+	start := time.Now()
+	if err := tlsConn.HandshakeContext(rn.ctx); err != nil {
+		conn.Close()
+		p.mx.Lock()
+		p.failurePhase = failurePhaseHandshake
+		p.mx.Unlock()
+		return nil, 0, err
+	}
+	return tlsConn, time.Since(start), nil
+}
+
+// ticketCache is a tls.ClientSessionCache that signals when the first session
+// ticket has been received.
+type ticketCache struct {
+	tls.ClientSessionCache
+	received chan struct{}
+	once     sync.Once
+}
+
+func newTicketCache() *ticketCache {
+	return &ticketCache{
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		received:           make(chan struct{}),
+	}
+}
+
+func (c *ticketCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.ClientSessionCache.Put(sessionKey, cs)
+	if cs != nil {
+		c.once.Do(func() {
+			close(c.received)
+		})
+	}
+}
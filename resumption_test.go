@@ -0,0 +1,30 @@
+package proxybench
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSResumption(t *testing.T) {
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	var reported map[string]interface{}
+	r := &Runner{ctx: context.Background(), stats: newStats()}
+	r.SetReporter(func(timing time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	})
+	rn := r.newRun(&Opts{BenchTLSResumption: true}, false)
+	rn.benchTLSResumption(&Proxy{Addrs: map[string]string{"https": srv.Listener.Addr().String()}}, time.Now())
+
+	assert.Equal(t, true, reported["proxybench_success"])
+	assert.Equal(t, true, reported["tls_session_resumed"])
+	assert.Equal(t, "tls_resumption", reported["request_type"])
+	assert.NotNil(t, reported["tls_full_handshake_time"])
+	assert.NotNil(t, reported["tls_resumed_handshake_time"])
+}
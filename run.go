@@ -0,0 +1,456 @@
+package proxybench
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/ops"
+)
+
+// run is the state of a single benchmarking pass.
+type run struct {
+	// retries is the number of retries taken from the retry budget, accessed
+	// atomically (and first for 64-bit alignment)
+	retries int64
+
+	*Runner
+	ctx        context.Context
+	opts       *Opts
+	id         string
+	newlyAdded bool
+	outcomes   *runOutcomes
+	started    time.Time
+
+	// baselines are the direct fetch timings of origins in this run
+	baselines   map[string]time.Duration
+	baselinesMx sync.Mutex
+}
+
+func (r *Runner) newRun(opts *Opts, newlyAdded bool) *run {
+	return &run{
+		Runner:     r,
+		ctx:        r.ctx,
+		opts:       opts,
+		id:         newRunID(),
+		newlyAdded: newlyAdded,
+		outcomes:   newRunOutcomes(),
+		started:    time.Now(),
+		baselines:  make(map[string]time.Duration),
+	}
+}
+
+func newRunID() string {
+	b := make([]byte, 8)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// reporter returns the current ReportFN, tagging every report with the id of
+// this run. Successful proxied requests to origins with a direct baseline in
+// this run are also tagged with the baseline and the overhead added by the
+// proxy.
+func (rn *run) reporter() ReportFN {
+	report := rn.Runner.reporter(rn.opts)
+	return func(timing time.Duration, ctx map[string]interface{}) {
+		ctx["run_id"] = rn.id
+		if origin, ok := ctx["url"].(string); ok && timing > 0 && ctx["proxy_type"] == "chained" {
+			if baseline, found := rn.baseline(origin); found {
+				ctx["baseline_latency"] = baseline.Seconds()
+				ctx["proxy_overhead"] = (timing - baseline).Seconds()
+			}
+		}
+		report(timing, ctx)
+	}
+}
+
+// recordBaseline records the direct fetch timing of origin.
+func (rn *run) recordBaseline(origin string, timing time.Duration) {
+	rn.baselinesMx.Lock()
+	rn.baselines[origin] = timing
+	rn.baselinesMx.Unlock()
+}
+
+// baseline returns the direct fetch timing of origin in this run, if any.
+func (rn *run) baseline(origin string) (time.Duration, bool) {
+	rn.baselinesMx.Lock()
+	defer rn.baselinesMx.Unlock()
+	timing, found := rn.baselines[origin]
+	return timing, found
+}
+
+func (r *Runner) bench(opts *Opts) {
+	if opts.WarmConnections {
+		r.warm.retain(opts.Proxies)
+	} else {
+		r.warm.close()
+	}
+	r.newRun(opts, false).bench(r.selectProxies(opts, opts.Proxies))
+}
+
+func (rn *run) bench(proxies []*Proxy) {
+	opts := rn.opts
+	if opts.CaptivePortalCheck && rn.detectCaptivePortal() {
+		log.Debug("Skipping run behind captive portal")
+		return
+	}
+	proxies = dedupeProxies(proxies)
+	targets := opts.targets()
+	if opts.ShuffleOrder {
+		targets, proxies = shuffled(targets, proxies)
+	}
+	var baselineTasks, tasks []*task
+	for _, target := range targets {
+		origin := target.URL
+		if opts.DirectBaseline {
+			baselineTasks = append(baselineTasks, &task{group: "direct", run: func(time.Time) {
+				timing, intercepted, err := rn.benchDirect(origin)
+				if err == nil && !intercepted {
+					rn.recordBaseline(origin, timing)
+				}
+			}})
+		}
+		for _, p := range proxies {
+			p := p
+			tasks = append(tasks, &task{group: opts.isolationGroup(p), run: func(enqueued time.Time) {
+				rn.benchProxy(origin, p, enqueued)
+			}})
+		}
+	}
+	for _, origin := range opts.WebSocketURLs {
+		origin := origin
+		for _, p := range proxies {
+			p := p
+			tasks = append(tasks, &task{group: opts.isolationGroup(p), run: func(enqueued time.Time) {
+				proxy := rn.attempt(p.withRandomProtocol(), enqueued)
+				timing, err := rn.benchWebSocket(origin, proxy)
+				rn.outcomes.record(proxy, origin, timing, err)
+			}})
+		}
+	}
+	if opts.BenchDoH {
+		for _, p := range proxies {
+			p := p
+			tasks = append(tasks, &task{group: opts.isolationGroup(p), run: func(enqueued time.Time) {
+				proxy := rn.attempt(p.withRandomProtocol(), enqueued)
+				timing, err := rn.benchDoH(proxy)
+				rn.outcomes.record(proxy, opts.DoHURL, timing, err)
+			}})
+		}
+	}
+	if opts.UploadURL != "" {
+		for _, p := range proxies {
+			p := p
+			tasks = append(tasks, &task{group: opts.isolationGroup(p), run: func(enqueued time.Time) {
+				proxy := rn.attempt(p.withRandomProtocol(), enqueued)
+				timing, err := rn.benchUpload(proxy)
+				rn.outcomes.record(proxy, opts.UploadURL, timing, err)
+			}})
+		}
+	}
+	if opts.BenchTLSResumption {
+		for _, p := range proxies {
+			if p.Addrs["https"] == "" {
+				continue
+			}
+			p := p
+			tasks = append(tasks, &task{group: opts.isolationGroup(p), run: func(enqueued time.Time) {
+				rn.benchTLSResumption(p, enqueued)
+			}})
+		}
+	}
+	// Baselines go first so that they're available when reporting proxied
+	// requests to the same origins.
+	completed := runTasks(rn.ctx, opts, baselineTasks)
+	completed += runTasks(rn.ctx, opts, tasks)
+	total := len(baselineTasks) + len(tasks)
+	rn.lastRun.Store(runInfo{
+		ID:        rn.id,
+		Started:   rn.started,
+		Finished:  time.Now(),
+		Cancelled: rn.ctx.Err() != nil,
+	})
+	report := rn.reporter()
+	if rn.ctx.Err() != nil {
+		// Outcomes are incomplete, so don't draw conclusions from them
+		rn.reportCancelled(report, completed, total-completed)
+		return
+	}
+	rn.outcomes.reportFullyDown(report)
+	rn.outcomes.reportVerdict(report, opts.targets())
+}
+
+// reportCancelled reports that the run was cut short, along with how many of
+// its endpoints were benchmarked before that happened. Results for completed
+// endpoints have already been reported individually.
+func (rn *run) reportCancelled(report ReportFN, completed int, skipped int) {
+	log.Debugf("Run cancelled after completing %d of %d endpoints: %v", completed, completed+skipped, rn.ctx.Err())
+	op := ops.Begin("proxybench").
+		Set("run_cancelled", true).
+		Set("endpoints_completed", completed).
+		Set("endpoints_skipped", skipped)
+	report(0, ops.AsMap(op, true))
+	op.End()
+}
+
+// shuffled returns randomly reordered copies of targets and proxies.
+func shuffled(targets []*Target, proxies []*Proxy) ([]*Target, []*Proxy) {
+	targets = append([]*Target(nil), targets...)
+	rand.Shuffle(len(targets), func(i, j int) {
+		targets[i], targets[j] = targets[j], targets[i]
+	})
+	proxies = append([]*Proxy(nil), proxies...)
+	rand.Shuffle(len(proxies), func(i, j int) {
+		proxies[i], proxies[j] = proxies[j], proxies[i]
+	})
+	return targets, proxies
+}
+
+// attempt prepares the given proxy for a request within this run.
+func (rn *run) attempt(proxy *proxy, enqueued time.Time) *proxy {
+	proxy.newlyAdded = rn.newlyAdded
+	proxy.enqueued = enqueued
+	return proxy
+}
+
+func (rn *run) benchProxy(origin string, p *Proxy, enqueued time.Time) {
+	if rn.opts.CompareProtocols {
+		rn.compareProtocols(origin, p, enqueued)
+		return
+	}
+	if rn.opts.HTTP2Streams > 1 && strings.HasPrefix(origin, "https:") {
+		rn.benchHTTP2(origin, p, enqueued)
+		return
+	}
+	if rn.opts.KeepAliveRequests > 1 {
+		rn.benchKeepAlive(origin, p, enqueued)
+		return
+	}
+	if rn.opts.SamplesPerTarget > 1 {
+		rn.sampleProxy(origin, p, enqueued)
+		return
+	}
+	proxy := rn.attempt(p.withRandomProtocol(), enqueued)
+	timing, err := rn.request(origin, proxy)
+	rn.outcomes.record(proxy, origin, timing, err)
+}
+
+// compareProtocols fetches origin through p using each of comparedProtocols in
+// turn and reports the latencies side by side.
+func (rn *run) compareProtocols(origin string, p *Proxy, enqueued time.Time) {
+	latencies := make([]time.Duration, 0, len(comparedProtocols))
+	for _, protocol := range comparedProtocols {
+		if p.Addrs[protocol] == "" {
+			log.Debugf("Not comparing protocols for %v, no %v address", p.key(), protocol)
+			return
+		}
+		proxy := rn.attempt(p.withProtocol(protocol), enqueued)
+		timing, err := rn.request(origin, proxy)
+		rn.outcomes.record(proxy, origin, timing, err)
+		if err != nil || timing <= 0 {
+			log.Debugf("Not comparing protocols for %v, %v failed", p.key(), protocol)
+			return
+		}
+		latencies = append(latencies, timing)
+	}
+
+	op := ops.Begin("proxybench").
+		Set("url", origin).
+		Set("proxy_type", "chained").
+		Set("proxy_provider", p.Provider).
+		Set("proxy_datacenter", p.DataCenter).
+		Set("protocol_comparison", true)
+	defer op.End()
+	for i, protocol := range comparedProtocols {
+		op.Set(protocol+"_latency", latencies[i].Seconds())
+	}
+	op.Set("latency_delta", (latencies[1]-latencies[0]).Seconds()).
+		Set("latency_ratio", float64(latencies[1])/float64(latencies[0]))
+	rn.reporter()(0, ops.AsMap(op, true))
+}
+
+// request fetches origin through the given proxy, retrying failures up to
+// opts.MaxRetries times within the run's retry budget, and records the result
+// in the aggregate stats.
+func (rn *run) request(origin string, proxy *proxy) (time.Duration, error) {
+	for attempt := 0; ; attempt++ {
+		rn.pacer.wait(rn.ctx, rn.opts, origin)
+		var timing time.Duration
+		var err error
+		if rn.opts.WarmConnections {
+			timing, err = rn.warmRequest(origin, proxy)
+		} else {
+			timing, err = request(rn.ctx, rn.opts, rn.reporter(), origin, proxy)
+		}
+		if err != nil && rn.ctx.Err() != nil {
+			// Interrupted, not the proxy's fault
+			return timing, err
+		}
+		if err == nil || attempt >= rn.opts.MaxRetries {
+			rn.record(origin, proxy, timing, err)
+			return timing, err
+		}
+		if !rn.takeRetry() {
+			log.Debugf("Retry budget exhausted, not retrying %v via %v", origin, proxy.addr)
+			rn.record(origin, proxy, timing, err)
+			op := beginOp(rn.opts, origin, proxy).Set("retry_budget_exhausted", true)
+			rn.reporter()(0, ops.AsMap(op, true))
+			op.End()
+			return timing, err
+		}
+		log.Debugf("Retrying %v via %v after error: %v", origin, proxy.addr, err)
+		proxy = rn.attempt(proxy.withProtocol(proxy.protocol), proxy.enqueued)
+	}
+}
+
+// record records the final result of a request in the aggregate stats (and
+// the latency history for the dashboard) and checks it for anomalies.
+func (rn *run) record(origin string, proxy *proxy, timing time.Duration, err error) {
+	if timing == discardedTiming {
+		// The timing was discarded because of a clock anomaly, so there's
+		// nothing to record
+		return
+	}
+	rn.stats.record(proxy, timing, err, rn.opts.StatsHalfLife)
+	if rn.opts.StatusDashboard {
+		rn.history.record(proxy, timing, err)
+	}
+	rn.detectAnomalies(origin, proxy, timing, err)
+}
+
+// takeRetry takes a retry from the run's retry budget, returning false if
+// the budget is exhausted.
+func (rn *run) takeRetry() bool {
+	if rn.opts.RetryBudget <= 0 {
+		return true
+	}
+	return atomic.AddInt64(&rn.retries, 1) <= int64(rn.opts.RetryBudget)
+}
+
+// runOutcomes correlates the results of individual requests within a single
+// run by proxy, so that we can tell when a proxy failed on every protocol we
+// tried, and by origin, so that we can tell whether an origin was reachable
+// through any proxy.
+type runOutcomes struct {
+	byProxy  map[*Proxy]*proxyOutcome
+	order    []*Proxy
+	byOrigin map[string]bool
+	results  []Result
+	mx       sync.Mutex
+}
+
+type proxyOutcome struct {
+	succeeded bool
+	errors    map[string]error
+}
+
+func newRunOutcomes() *runOutcomes {
+	return &runOutcomes{
+		byProxy:  make(map[*Proxy]*proxyOutcome),
+		byOrigin: make(map[string]bool),
+	}
+}
+
+func (ro *runOutcomes) record(proxy *proxy, origin string, timing time.Duration, err error) {
+	if timing == discardedTiming {
+		// Neither a success nor a failure
+		return
+	}
+	ro.mx.Lock()
+	defer ro.mx.Unlock()
+	ro.results = append(ro.results, Result{
+		Time:       time.Now(),
+		Timing:     timing,
+		IsRequest:  true,
+		Success:    err == nil,
+		URL:        origin,
+		Proxy:      proxy.Proxy,
+		ProxyAddr:  proxy.addr,
+		Protocol:   proxy.protocol,
+		Provider:   proxy.Provider,
+		DataCenter: proxy.DataCenter,
+		Error:      err,
+	})
+	outcome := ro.byProxy[proxy.Proxy]
+	if outcome == nil {
+		outcome = &proxyOutcome{errors: make(map[string]error)}
+		ro.byProxy[proxy.Proxy] = outcome
+		ro.order = append(ro.order, proxy.Proxy)
+	}
+	if err == nil {
+		outcome.succeeded = true
+		ro.byOrigin[origin] = true
+	} else {
+		outcome.errors[proxy.protocol] = err
+	}
+}
+
+// reportFullyDown reports every proxy for which every attempted request in
+// the run failed.
+func (ro *runOutcomes) reportFullyDown(report ReportFN) {
+	ro.mx.Lock()
+	defer ro.mx.Unlock()
+	for _, p := range ro.order {
+		outcome := ro.byProxy[p]
+		if outcome.succeeded {
+			continue
+		}
+		protocols := make([]string, 0, len(outcome.errors))
+		for protocol := range outcome.errors {
+			protocols = append(protocols, protocol)
+		}
+		sort.Strings(protocols)
+		errors := make([]string, 0, len(protocols))
+		for _, protocol := range protocols {
+			errors = append(errors, fmt.Sprintf("%v: %v", protocol, outcome.errors[protocol]))
+		}
+		log.Debugf("All protocols failed for %v: %v", p.key(), strings.Join(errors, "; "))
+		op := ops.Begin("proxybench").
+			Set("proxy_type", "chained").
+			Set("proxy_provider", p.Provider).
+			Set("proxy_datacenter", p.DataCenter).
+			Set("proxy_fully_down", true).
+			Set("proxy_protocols_tried", strings.Join(protocols, ",")).
+			Set("proxy_errors", strings.Join(errors, "; "))
+		report(0, ops.AsMap(op, true))
+		op.End()
+	}
+}
+
+// reportVerdict reports whether the run was healthy, meaning that every
+// critical target succeeded through at least one proxy. Nothing is reported
+// if there are no critical targets.
+func (ro *runOutcomes) reportVerdict(report ReportFN, targets []*Target) {
+	ro.mx.Lock()
+	defer ro.mx.Unlock()
+	var critical, failed []string
+	for _, target := range targets {
+		if !target.Critical {
+			continue
+		}
+		critical = append(critical, target.URL)
+		if !ro.byOrigin[target.URL] {
+			failed = append(failed, target.URL)
+		}
+	}
+	if len(critical) == 0 {
+		return
+	}
+	log.Debugf("%d of %d critical targets failed", len(failed), len(critical))
+	op := ops.Begin("proxybench").
+		Set("run_verdict", true).
+		Set("run_healthy", len(failed) == 0).
+		Set("critical_targets", len(critical))
+	if len(failed) > 0 {
+		op.Set("critical_failures", strings.Join(failed, ","))
+	}
+	report(0, ops.AsMap(op, true))
+	op.End()
+}
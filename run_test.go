@@ -0,0 +1,219 @@
+package proxybench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/tlsdefaults"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportVerdict(t *testing.T) {
+	p := &Proxy{Addrs: map[string]string{"https": "1.2.3.4:443"}}
+	targets := []*Target{
+		&Target{URL: "https://a.com", Critical: true},
+		&Target{URL: "https://b.com", Critical: true},
+		&Target{URL: "https://c.com"},
+	}
+
+	var reported map[string]interface{}
+	report := func(timing time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	}
+
+	ro := newRunOutcomes()
+	ro.record(p.withProtocol("https"), "https://a.com", 0, nil)
+	ro.record(p.withProtocol("https"), "https://b.com", 0, errors.New("failed"))
+	ro.record(p.withProtocol("https"), "https://c.com", 0, errors.New("failed"))
+	ro.reportVerdict(report, targets)
+	assert.Equal(t, false, reported["run_healthy"])
+	assert.Equal(t, "https://b.com", reported["critical_failures"])
+
+	ro.record(p.withProtocol("obfs4"), "https://b.com", 0, nil)
+	ro.reportVerdict(report, targets)
+	assert.Equal(t, true, reported["run_healthy"], "critical targets only need to succeed through one proxy")
+
+	ro = newRunOutcomes()
+	ro.record(p.withProtocol("https"), "https://c.com", discardedTiming, nil)
+	assert.Empty(t, ro.results, "discarded timings shouldn't be returned as results")
+	assert.Empty(t, ro.byProxy, "discarded timings shouldn't count towards fully_down")
+
+	reported = nil
+	newRunOutcomes().reportVerdict(report, targets[2:])
+	assert.Nil(t, reported, "no verdict without critical targets")
+}
+
+func TestVerdictIgnoresDiscardedTimings(t *testing.T) {
+	defer func(orig func(time.Time, time.Duration) (time.Duration, bool)) {
+		checkClock = orig
+	}(checkClock)
+	checkClock = func(start time.Time, delta time.Duration) (time.Duration, bool) {
+		return time.Hour, true
+	}
+
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	proxySrv := httptest.NewServer(&httputil.ReverseProxy{
+		Director: func(req *http.Request) {},
+	})
+	defer proxySrv.Close()
+
+	var mx sync.Mutex
+	var verdict map[string]interface{}
+	r := newRunner(context.Background(), &Opts{}, ReportFN(func(timing time.Duration, ctx map[string]interface{}) {
+		if ctx["run_verdict"] == true {
+			mx.Lock()
+			verdict = ctx
+			mx.Unlock()
+		}
+	}))
+	p := &Proxy{Addrs: map[string]string{"http": proxySrv.Listener.Addr().String()}}
+	opts := &Opts{Targets: []*Target{&Target{URL: origin.URL, Critical: true}}, ConcurrencyPerGroup: 1}
+	r.newRun(opts, false).bench([]*Proxy{p})
+
+	mx.Lock()
+	defer mx.Unlock()
+	if assert.NotNil(t, verdict) {
+		assert.Equal(t, false, verdict["run_healthy"], "a discarded timing shouldn't make a critical target up")
+		assert.Equal(t, origin.URL, verdict["critical_failures"])
+	}
+}
+
+func TestReportFullyDown(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	proxySrv := httptest.NewServer(&httputil.ReverseProxy{
+		Director: func(req *http.Request) {},
+	})
+	defer proxySrv.Close()
+
+	var mx sync.Mutex
+	var fullyDown []map[string]interface{}
+	r := newRunner(context.Background(), &Opts{}, ReportFN(func(timing time.Duration, ctx map[string]interface{}) {
+		if ctx["proxy_fully_down"] == true {
+			mx.Lock()
+			fullyDown = append(fullyDown, ctx)
+			mx.Unlock()
+		}
+	}))
+	up := &Proxy{Addrs: map[string]string{"http": proxySrv.Listener.Addr().String()}, Provider: "up"}
+	down := &Proxy{Addrs: map[string]string{"http": "127.0.0.1:1"}, Provider: "down"}
+	opts := &Opts{URLs: []string{origin.URL, origin.URL + "/other"}, ConcurrencyPerGroup: 1}
+	r.newRun(opts, false).bench([]*Proxy{up, down})
+
+	mx.Lock()
+	defer mx.Unlock()
+	if assert.Len(t, fullyDown, 1, "only the proxy that failed every request should be reported, once") {
+		assert.Equal(t, "down", fullyDown[0]["proxy_provider"])
+		assert.Equal(t, "http", fullyDown[0]["proxy_protocols_tried"])
+	}
+}
+
+func TestCompareProtocols(t *testing.T) {
+	origComparedProtocols := comparedProtocols
+	comparedProtocols = []string{"https", "http"}
+	defer func() {
+		comparedProtocols = origComparedProtocols
+	}()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	rp := &httputil.ReverseProxy{Director: func(req *http.Request) {}}
+	l, err := tlsdefaults.Listen("localhost:", "testkey.pem", "testcert.pem")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go http.Serve(l, rp)
+	plain := httptest.NewServer(rp)
+	defer plain.Close()
+
+	var mx sync.Mutex
+	var requests, comparisons []map[string]interface{}
+	r := newRunner(context.Background(), &Opts{}, ReportFN(func(timing time.Duration, ctx map[string]interface{}) {
+		mx.Lock()
+		defer mx.Unlock()
+		if ctx["protocol_comparison"] == true {
+			comparisons = append(comparisons, ctx)
+		} else if ctx["proxybench_success"] != nil {
+			requests = append(requests, ctx)
+		}
+	}))
+	p := &Proxy{Addrs: map[string]string{"https": l.Addr().String(), "http": plain.Listener.Addr().String()}, Provider: "provider"}
+	opts := &Opts{URLs: []string{origin.URL}, CompareProtocols: true, ConcurrencyPerGroup: 1}
+	r.newRun(opts, false).bench([]*Proxy{p})
+
+	mx.Lock()
+	defer mx.Unlock()
+	var protocols []interface{}
+	for _, ctx := range requests {
+		assert.Equal(t, true, ctx["proxybench_success"])
+		protocols = append(protocols, ctx["proxy_protocol"])
+	}
+	assert.Equal(t, []interface{}{"https", "http"}, protocols, "each protocol should be benchmarked in turn")
+	if assert.Len(t, comparisons, 1) {
+		assert.Equal(t, "provider", comparisons[0]["proxy_provider"])
+		assert.Contains(t, comparisons[0], "https_latency")
+		assert.Contains(t, comparisons[0], "http_latency")
+		assert.Contains(t, comparisons[0], "latency_delta")
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	rn := &run{opts: &Opts{RetryBudget: 2}}
+	assert.True(t, rn.takeRetry())
+	assert.True(t, rn.takeRetry())
+	assert.False(t, rn.takeRetry(), "budget should be exhausted")
+
+	rn = &run{opts: &Opts{}}
+	for i := 0; i < 10; i++ {
+		assert.True(t, rn.takeRetry(), "no budget means unlimited")
+	}
+}
+
+func TestShuffled(t *testing.T) {
+	var targets []*Target
+	var proxies []*Proxy
+	for i := 0; i < 20; i++ {
+		targets = append(targets, &Target{URL: fmt.Sprintf("https://%d.com", i)})
+		proxies = append(proxies, &Proxy{Provider: fmt.Sprint(i)})
+	}
+	shuffledTargets, shuffledProxies := shuffled(targets, proxies)
+	assert.ElementsMatch(t, targets, shuffledTargets)
+	assert.ElementsMatch(t, proxies, shuffledProxies)
+	assert.NotEqual(t, targets, shuffledTargets, "order should change (with overwhelming probability)")
+	assert.Equal(t, "https://0.com", targets[0].URL, "original should be unchanged")
+}
+
+func TestBaselineOverhead(t *testing.T) {
+	var reported map[string]interface{}
+	r := &Runner{}
+	r.SetReporter(func(timing time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	})
+	rn := r.newRun(&Opts{}, false)
+	rn.recordBaseline("https://a.com", 100*time.Millisecond)
+
+	rn.reporter()(250*time.Millisecond, map[string]interface{}{"url": "https://a.com", "proxy_type": "chained"})
+	assert.Equal(t, 0.1, reported["baseline_latency"])
+	assert.InDelta(t, 0.15, reported["proxy_overhead"], 0.0001)
+
+	rn.reporter()(0, map[string]interface{}{"url": "https://a.com", "proxy_type": "chained"})
+	assert.Nil(t, reported["proxy_overhead"], "failures have no overhead")
+
+	rn.reporter()(250*time.Millisecond, map[string]interface{}{"url": "https://b.com", "proxy_type": "chained"})
+	assert.Nil(t, reported["proxy_overhead"], "no baseline for origin")
+}
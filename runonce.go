@@ -0,0 +1,29 @@
+package proxybench
+
+import (
+	"context"
+	"fmt"
+)
+
+// RunOnce synchronously benchmarks every configured proxy once, without
+// sampling or fetching updated Opts, and returns the results.
+func RunOnce(opts *Opts) ([]Result, error) {
+	return RunOnceContext(context.Background(), opts)
+}
+
+// RunOnceContext is like RunOnce, but stops early once ctx is done, returning
+// the results gathered so far along with ctx's error.
+func RunOnceContext(ctx context.Context, opts *Opts) ([]Result, error) {
+	r := newRunner(ctx, opts, nil)
+	defer r.cancel()
+	defer r.warm.close()
+	if len(opts.Proxies) == 0 {
+		return nil, fmt.Errorf("No proxies to benchmark")
+	}
+
+	rn := r.newRun(opts, false)
+	rn.bench(opts.Proxies)
+	rn.outcomes.mx.Lock()
+	defer rn.outcomes.mx.Unlock()
+	return rn.outcomes.results, r.ctx.Err()
+}
@@ -0,0 +1,68 @@
+package proxybench
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunOnce(t *testing.T) {
+	// Testing mode overrides the configured proxies and URLs
+	defer func(orig string) {
+		testingProxy = orig
+	}(testingProxy)
+	testingProxy = ""
+
+	_, err := RunOnce(&Opts{Targets: []*Target{&Target{URL: "http://example.com"}}})
+	assert.Error(t, err, "should fail without proxies")
+
+	// Find a port that nothing is listening on
+	l, err := net.Listen("tcp", "localhost:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p := &Proxy{Addrs: map[string]string{"https": addr}}
+	results, err := RunOnce(&Opts{Proxies: []*Proxy{p}, Targets: []*Target{&Target{URL: "http://example.com"}}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, "http://example.com", results[0].URL)
+		assert.Equal(t, p, results[0].Proxy)
+		assert.NotEmpty(t, results[0].Protocol)
+		assert.Error(t, results[0].Error)
+	}
+}
+
+func TestRunOnceSkipsDiscardedTimings(t *testing.T) {
+	defer func(orig string) {
+		testingProxy = orig
+	}(testingProxy)
+	testingProxy = ""
+	defer func(orig func(time.Time, time.Duration) (time.Duration, bool)) {
+		checkClock = orig
+	}(checkClock)
+	checkClock = func(start time.Time, delta time.Duration) (time.Duration, bool) {
+		return time.Hour, true
+	}
+
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	proxySrv := httptest.NewServer(&httputil.ReverseProxy{Director: func(req *http.Request) {}})
+	defer proxySrv.Close()
+
+	p := &Proxy{Addrs: map[string]string{"http": proxySrv.Listener.Addr().String()}}
+	results, err := RunOnce(&Opts{Proxies: []*Proxy{p}, Targets: []*Target{&Target{URL: origin.URL}}})
+	assert.NoError(t, err)
+	assert.Empty(t, results, "a discarded timing is neither a success nor a failure")
+}
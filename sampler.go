@@ -0,0 +1,71 @@
+package proxybench
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Sampler decides, once per period, whether or not to run benchmarks.
+type Sampler interface {
+	ShouldSample() bool
+}
+
+// SamplerFunc adapts a function to a Sampler.
+type SamplerFunc func() bool
+
+// ShouldSample implements Sampler.
+func (fn SamplerFunc) ShouldSample() bool {
+	return fn()
+}
+
+// RateSampler samples with a fixed probability between 0 and 1. It's the
+// default Sampler, using the configured SampleRate.
+type RateSampler float64
+
+// ShouldSample implements Sampler.
+func (rate RateSampler) ShouldSample() bool {
+	return rand.Float64() < float64(rate)
+}
+
+// HourlySampler samples with a probability that depends on the hour of the
+// day, for example to benchmark less often during peak hours.
+type HourlySampler struct {
+	// Rates are the sample rates for each hour of the day, starting at
+	// midnight.
+	Rates [24]float64
+
+	// Location is the time zone in which hours are counted. Defaults to local
+	// time.
+	Location *time.Location
+}
+
+// ShouldSample implements Sampler.
+func (s *HourlySampler) ShouldSample() bool {
+	now := time.Now()
+	if s.Location != nil {
+		now = now.In(s.Location)
+	}
+	return RateSampler(s.Rates[now.Hour()]).ShouldSample()
+}
+
+// samplerHolder allows storing different Sampler implementations in an
+// atomic.Value.
+type samplerHolder struct {
+	Sampler
+}
+
+// SetSampler changes the Sampler that decides whether to run benchmarks each
+// period. A nil Sampler restores the default, which samples at the configured
+// SampleRate.
+func (r *Runner) SetSampler(sampler Sampler) {
+	r.sampler.Store(samplerHolder{sampler})
+}
+
+// shouldSample consults the current Sampler, falling back to opts.SampleRate.
+func (r *Runner) shouldSample(opts *Opts) bool {
+	holder, _ := r.sampler.Load().(samplerHolder)
+	if holder.Sampler == nil {
+		return RateSampler(opts.SampleRate).ShouldSample()
+	}
+	return holder.Sampler.ShouldSample()
+}
@@ -0,0 +1,26 @@
+package proxybench
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampler(t *testing.T) {
+	r := &Runner{}
+	assert.True(t, r.shouldSample(&Opts{SampleRate: 1}), "should default to SampleRate")
+	assert.False(t, r.shouldSample(&Opts{SampleRate: 0}), "should default to SampleRate")
+
+	r.SetSampler(SamplerFunc(func() bool { return true }))
+	assert.True(t, r.shouldSample(&Opts{SampleRate: 0}), "custom Sampler should override SampleRate")
+
+	r.SetSampler(nil)
+	assert.False(t, r.shouldSample(&Opts{SampleRate: 0}), "nil Sampler should restore default")
+
+	hourly := &HourlySampler{Location: time.UTC}
+	hourly.Rates[time.Now().In(time.UTC).Hour()] = 1
+	assert.True(t, hourly.ShouldSample())
+	hourly.Rates = [24]float64{}
+	assert.False(t, hourly.ShouldSample())
+}
@@ -0,0 +1,62 @@
+package proxybench
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/getlantern/ops"
+)
+
+// sampleProxy fetches origin through p opts.SamplesPerTarget times using the
+// same protocol and reports the distribution of latencies of the successful
+// samples, in addition to the individual requests.
+func (rn *run) sampleProxy(origin string, p *Proxy, enqueued time.Time) {
+	protocol := p.withRandomProtocol().protocol
+	samples := rn.opts.SamplesPerTarget
+	timings := make([]time.Duration, 0, samples)
+	for i := 0; i < samples; i++ {
+		proxy := rn.attempt(p.withProtocol(protocol), enqueued)
+		timing, err := rn.request(origin, proxy)
+		rn.outcomes.record(proxy, origin, timing, err)
+		if rn.ctx.Err() != nil {
+			return
+		}
+		if err == nil && timing > 0 {
+			timings = append(timings, timing)
+		}
+	}
+
+	op := beginOp(rn.opts, origin, p.withProtocol(protocol)).
+		Set("sample_aggregate", true).
+		Set("samples", samples).
+		Set("samples_succeeded", len(timings))
+	defer op.End()
+	if len(timings) > 0 {
+		sort.Slice(timings, func(i, j int) bool {
+			return timings[i] < timings[j]
+		})
+		var total time.Duration
+		for _, timing := range timings {
+			total += timing
+		}
+		op.Set("latency_min", timings[0].Seconds()).
+			Set("latency_max", timings[len(timings)-1].Seconds()).
+			Set("latency_mean", (total/time.Duration(len(timings))).Seconds()).
+			Set("latency_p50", percentile(timings, 50).Seconds()).
+			Set("latency_p95", percentile(timings, 95).Seconds()).
+			Set("latency_p99", percentile(timings, 99).Seconds())
+	}
+	// The individual samples have already been reported with their timings
+	rn.reporter()(0, ops.AsMap(op, true))
+}
+
+// percentile returns the pth percentile of the given sorted timings using the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -0,0 +1,20 @@
+package proxybench
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPercentile(t *testing.T) {
+	var timings []time.Duration
+	for i := 1; i <= 20; i++ {
+		timings = append(timings, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 10*time.Millisecond, percentile(timings, 50))
+	assert.Equal(t, 19*time.Millisecond, percentile(timings, 95))
+	assert.Equal(t, 20*time.Millisecond, percentile(timings, 99))
+	assert.Equal(t, 1*time.Millisecond, percentile(timings, 0))
+	assert.Equal(t, 5*time.Millisecond, percentile(timings[4:5], 99))
+}
@@ -0,0 +1,51 @@
+package proxybench
+
+import (
+	"math/rand"
+)
+
+// selectProxies chooses which of the given proxies to benchmark in a run.
+func (r *Runner) selectProxies(opts *Opts, proxies []*Proxy) []*Proxy {
+	if opts.FailureBias <= 0 {
+		return proxies
+	}
+	selected := make([]*Proxy, 0, len(proxies))
+	for _, p := range proxies {
+		if rand.Float64() < failureWeight(r.stats.failureRate(p.key()), opts.FailureBias) {
+			selected = append(selected, p)
+		}
+	}
+	log.Debugf("Selected %d of %d proxies, favoring recent failures", len(selected), len(proxies))
+	return selected
+}
+
+// failureWeight is the probability with which a proxy with the given recent
+// failure rate is selected.
+func failureWeight(failureRate float64, bias float64) float64 {
+	return (1 + bias*failureRate) / (1 + bias)
+}
+
+// dedupeKey identifies a proxy for the purposes of deduplication, by its
+// addresses and provider.
+func (p *Proxy) dedupeKey() string {
+	return p.key() + "|" + p.Provider
+}
+
+// dedupeProxies removes proxies that appear more than once, keeping the first
+// occurrence.
+func dedupeProxies(proxies []*Proxy) []*Proxy {
+	seen := make(map[string]bool, len(proxies))
+	deduped := make([]*Proxy, 0, len(proxies))
+	for _, p := range proxies {
+		key := p.dedupeKey()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		deduped = append(deduped, p)
+	}
+	if removed := len(proxies) - len(deduped); removed > 0 {
+		log.Debugf("Removed %d duplicate proxies", removed)
+	}
+	return deduped
+}
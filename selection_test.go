@@ -0,0 +1,18 @@
+package proxybench
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupeProxies(t *testing.T) {
+	a := &Proxy{Addrs: map[string]string{"https": "1.2.3.4:443", "obfs4": "1.2.3.4:80"}, Provider: "p1"}
+	aAgain := &Proxy{Addrs: map[string]string{"obfs4": "1.2.3.4:80", "https": "1.2.3.4:443"}, Provider: "p1", DataCenter: "dc"}
+	aOtherProvider := &Proxy{Addrs: map[string]string{"https": "1.2.3.4:443", "obfs4": "1.2.3.4:80"}, Provider: "p2"}
+	b := &Proxy{Addrs: map[string]string{"https": "5.6.7.8:443"}, Provider: "p1"}
+
+	assert.Equal(t, a.dedupeKey(), aAgain.dedupeKey(), "key shouldn't depend on map order or data center")
+	assert.NotEqual(t, a.dedupeKey(), aOtherProvider.dedupeKey())
+	assert.Equal(t, []*Proxy{a, b, aOtherProvider}, dedupeProxies([]*Proxy{a, b, aAgain, aOtherProvider}))
+}
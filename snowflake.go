@@ -0,0 +1,61 @@
+package proxybench
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	sf "git.torproject.org/pluggable-transports/snowflake.git/v2/client/lib"
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/event"
+	"github.com/getlantern/ops"
+)
+
+// dialSnowflake connects to the proxy through a Snowflake, recording how long
+// it took to rendezvous with one via the broker.
+func (p *proxy) dialSnowflake() (net.Conn, error) {
+	iceAddresses := p.SnowflakeSTUNServers
+	if ice := p.ptArg("ice", ""); ice != "" {
+		iceAddresses = strings.Split(ice, ",")
+	}
+	transport, err := sf.NewSnowflakeClient(sf.ClientConfig{
+		BrokerURL:    p.ptArg("url", p.SnowflakeBrokerURL),
+		FrontDomain:  p.ptArg("front", p.FrontDomain),
+		ICEAddresses: iceAddresses,
+		Max:          1,
+	})
+	if err != nil {
+		return nil, log.Errorf("Unable to create snowflake client: %v", err)
+	}
+	transport.AddSnowflakeEventListener(&rendezvousTimer{proxy: p, start: time.Now()})
+	return transport.Dial()
+}
+
+// rendezvousTimer records the time until the first successful rendezvous
+// with the broker.
+type rendezvousTimer struct {
+	proxy *proxy
+	start time.Time
+}
+
+func (rt *rendezvousTimer) OnNewSnowflakeEvent(e event.SnowflakeEvent) {
+	if _, ok := e.(event.EventOnBrokerRendezvous); !ok {
+		return
+	}
+	elapsed := time.Since(rt.start)
+	rt.proxy.mx.Lock()
+	if rt.proxy.snowflakeRendezvous == 0 {
+		rt.proxy.snowflakeRendezvous = elapsed
+	}
+	rt.proxy.mx.Unlock()
+}
+
+// setSnowflakeRendezvous sets how long the rendezvous with a Snowflake took
+// on op, if it happened.
+func (p *proxy) setSnowflakeRendezvous(op ops.Op) {
+	p.mx.Lock()
+	rendezvous := p.snowflakeRendezvous
+	p.mx.Unlock()
+	if rendezvous > 0 {
+		op.Set("snowflake_rendezvous_time", rendezvous.Seconds())
+	}
+}
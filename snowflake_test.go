@@ -0,0 +1,24 @@
+package proxybench
+
+import (
+	"testing"
+	"time"
+
+	"git.torproject.org/pluggable-transports/snowflake.git/v2/common/event"
+	"github.com/getlantern/ops"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRendezvousTimer(t *testing.T) {
+	p := (&Proxy{Addrs: map[string]string{"snowflake": "bridge"}}).withProtocol("snowflake")
+	op := ops.Begin("proxybench")
+	defer op.End()
+	p.setSnowflakeRendezvous(op)
+	assert.NotContains(t, ops.AsMap(op, true), "snowflake_rendezvous_time", "no rendezvous yet")
+
+	rt := &rendezvousTimer{proxy: p, start: time.Now().Add(-1 * time.Second)}
+	rt.OnNewSnowflakeEvent(event.EventOnBrokerRendezvous{})
+	p.setSnowflakeRendezvous(op)
+	rendezvous, _ := ops.AsMap(op, true)["snowflake_rendezvous_time"].(float64)
+	assert.True(t, rendezvous >= 1, "should time the rendezvous")
+}
@@ -0,0 +1,205 @@
+// Package sqlitestore keeps a history of proxybench results in a local SQLite
+// database and answers questions like which proxy is performing best right
+// now, without any external infrastructure.
+package sqlitestore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxybench"
+
+	// Registers the pure Go "sqlite" driver
+	_ "modernc.org/sqlite"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS results (
+	time INTEGER NOT NULL,
+	proxy TEXT NOT NULL,
+	protocol TEXT NOT NULL,
+	provider TEXT NOT NULL,
+	datacenter TEXT NOT NULL,
+	url TEXT NOT NULL,
+	success INTEGER NOT NULL,
+	timing INTEGER NOT NULL,
+	failure_reason TEXT NOT NULL,
+	error TEXT NOT NULL,
+	response_bytes INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS results_time ON results (time);
+CREATE INDEX IF NOT EXISTS results_proxy ON results (proxy, protocol, time);
+`
+
+var log = golog.LoggerFor("proxybench.sqlitestore")
+
+// Result is a single stored result.
+type Result struct {
+	Time          time.Time
+	Proxy         string
+	Protocol      string
+	Provider      string
+	DataCenter    string
+	URL           string
+	Success       bool
+	Timing        time.Duration
+	FailureReason string
+	Error         string
+	ResponseBytes int64
+}
+
+// Summary aggregates the results for a proxy and protocol over a period.
+type Summary struct {
+	Proxy      string
+	Protocol   string
+	Provider   string
+	DataCenter string
+
+	// Day is the start of the day (UTC) summarized, only set by Trend.
+	Day time.Time
+
+	Requests  int
+	Successes int
+
+	// MeanLatency is the mean timing of successful requests.
+	MeanLatency time.Duration
+}
+
+// SuccessRate returns the fraction of requests that succeeded.
+func (s *Summary) SuccessRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Successes) / float64(s.Requests)
+}
+
+// Store persists results to a SQLite database. It implements
+// proxybench.Reporter, storing every result and skipping summaries.
+type Store struct {
+	db *sql.DB
+}
+
+// Open opens (creating if necessary) the SQLite database at path.
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %v: %v", path, err)
+	}
+	// SQLite only supports a single writer anyway, and this avoids "database
+	// is locked" errors when reporting concurrently.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Unable to create schema in %v: %v", path, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Report stores a result.
+func (s *Store) Report(rep proxybench.Result) {
+	if !rep.IsRequest {
+		return
+	}
+	var errMsg string
+	if rep.Error != nil {
+		errMsg = rep.Error.Error()
+	}
+	_, err := s.db.Exec(`INSERT INTO results
+		(time, proxy, protocol, provider, datacenter, url, success, timing, failure_reason, error, response_bytes)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rep.Time.UnixNano(), rep.ProxyAddr, rep.Protocol, rep.Provider, rep.DataCenter, rep.URL,
+		rep.Success, int64(rep.Timing), rep.FailureReason, errMsg, rep.ResponseBytes)
+	if err != nil {
+		log.Errorf("Unable to store result: %v", err)
+	}
+}
+
+// Flush does nothing, since results are stored as they're reported.
+func (s *Store) Flush() error {
+	return nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// LatestPerProxy returns the most recent result for every proxy and protocol.
+func (s *Store) LatestPerProxy() ([]*Result, error) {
+	// SQLite takes the bare columns from the row with the MAX(time)
+	rows, err := s.db.Query(`SELECT MAX(time), proxy, protocol, provider, datacenter, url, success, timing, failure_reason, error, response_bytes
+		FROM results GROUP BY proxy, protocol ORDER BY proxy, protocol`)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query latest results: %v", err)
+	}
+	defer rows.Close()
+	var results []*Result
+	for rows.Next() {
+		var ts, timing int64
+		result := &Result{}
+		if err := rows.Scan(&ts, &result.Proxy, &result.Protocol, &result.Provider, &result.DataCenter, &result.URL,
+			&result.Success, &timing, &result.FailureReason, &result.Error, &result.ResponseBytes); err != nil {
+			return nil, fmt.Errorf("Unable to read latest results: %v", err)
+		}
+		result.Time = time.Unix(0, ts)
+		result.Timing = time.Duration(timing)
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// Best summarizes every proxy and protocol over the given window up to now,
+// ordered from best to worst: by success rate and then by mean latency.
+func (s *Store) Best(window time.Duration) ([]*Summary, error) {
+	return s.summarize(`SELECT proxy, protocol, provider, datacenter, 0,
+		COUNT(*) AS requests, SUM(success) AS successes, AVG(CASE WHEN success THEN timing END) AS latency
+		FROM results WHERE time >= ? GROUP BY proxy, protocol
+		ORDER BY CAST(successes AS REAL) / requests DESC, latency IS NULL, latency, proxy, protocol`,
+		time.Now().Add(-window).UnixNano())
+}
+
+// Trend summarizes every proxy and protocol per day (UTC) over the last days,
+// including today, ordered by proxy, protocol and day.
+func (s *Store) Trend(days int) ([]*Summary, error) {
+	dayNanos := int64(24 * time.Hour)
+	today := time.Now().UnixNano() / dayNanos * dayNanos
+	since := today - int64(days-1)*dayNanos
+	return s.summarize(`SELECT proxy, protocol, provider, datacenter, time / ? * ? AS day, COUNT(*), SUM(success), AVG(CASE WHEN success THEN timing END)
+		FROM results WHERE time >= ? GROUP BY proxy, protocol, day ORDER BY proxy, protocol, day`,
+		dayNanos, dayNanos, since)
+}
+
+func (s *Store) summarize(query string, args ...interface{}) ([]*Summary, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query summaries: %v", err)
+	}
+	defer rows.Close()
+	var summaries []*Summary
+	for rows.Next() {
+		var day int64
+		var latency sql.NullFloat64
+		summary := &Summary{}
+		if err := rows.Scan(&summary.Proxy, &summary.Protocol, &summary.Provider, &summary.DataCenter,
+			&day, &summary.Requests, &summary.Successes, &latency); err != nil {
+			return nil, fmt.Errorf("Unable to read summaries: %v", err)
+		}
+		if day != 0 {
+			summary.Day = time.Unix(0, day).UTC()
+		}
+		summary.MeanLatency = time.Duration(latency.Float64)
+		summaries = append(summaries, summary)
+	}
+	return summaries, rows.Err()
+}
+
+// Prune deletes results older than before, returning how many were deleted.
+func (s *Store) Prune(before time.Time) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM results WHERE time < ?`, before.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("Unable to prune results: %v", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,93 @@
+package sqlitestore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlitestore")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := Open(filepath.Join(dir, "results.db"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+
+	now := time.Now()
+	result := func(ago time.Duration, proxy string, success bool, timing time.Duration) proxybench.Result {
+		rep := proxybench.Result{
+			Time:      now.Add(-ago),
+			IsRequest: true,
+			Success:   success,
+			Timing:    timing,
+			ProxyAddr: proxy,
+			Protocol:  "https",
+			Provider:  "do",
+			URL:       "https://a.com",
+		}
+		if !success {
+			rep.FailureReason = "dial"
+			rep.Error = errors.New("connection refused")
+		}
+		return rep
+	}
+	s.Report(result(72*time.Hour, "1.1.1.1:443", true, 100*time.Millisecond))
+	s.Report(result(2*time.Hour, "1.1.1.1:443", true, 300*time.Millisecond))
+	s.Report(result(time.Hour, "1.1.1.1:443", true, 500*time.Millisecond))
+	s.Report(result(2*time.Hour, "2.2.2.2:443", true, 100*time.Millisecond))
+	s.Report(result(time.Hour, "2.2.2.2:443", false, 0))
+	s.Report(result(time.Hour, "3.3.3.3:443", true, 900*time.Millisecond))
+	s.Report(proxybench.Result{Time: now, Fields: map[string]interface{}{"run_verdict": "healthy"}})
+
+	latest, err := s.LatestPerProxy()
+	if assert.NoError(t, err) && assert.Len(t, latest, 3, "summaries shouldn't be stored") {
+		assert.Equal(t, "1.1.1.1:443", latest[0].Proxy)
+		assert.Equal(t, 500*time.Millisecond, latest[0].Timing)
+		assert.Equal(t, now.Add(-time.Hour).UnixNano(), latest[0].Time.UnixNano())
+		assert.Equal(t, "2.2.2.2:443", latest[1].Proxy)
+		assert.False(t, latest[1].Success)
+		assert.Equal(t, "connection refused", latest[1].Error)
+	}
+
+	best, err := s.Best(24 * time.Hour)
+	if assert.NoError(t, err) && assert.Len(t, best, 3) {
+		assert.Equal(t, "1.1.1.1:443", best[0].Proxy, "fully successful and fastest should be best")
+		assert.Equal(t, 2, best[0].Requests)
+		assert.Equal(t, 400*time.Millisecond, best[0].MeanLatency, "old results should be excluded")
+		assert.Equal(t, "3.3.3.3:443", best[1].Proxy)
+		assert.Equal(t, "2.2.2.2:443", best[2].Proxy)
+		assert.Equal(t, 0.5, best[2].SuccessRate())
+		assert.Equal(t, 100*time.Millisecond, best[2].MeanLatency, "failures shouldn't count towards latency")
+	}
+
+	trend, err := s.Trend(7)
+	if assert.NoError(t, err) {
+		var days []time.Time
+		for _, summary := range trend {
+			if summary.Proxy == "1.1.1.1:443" {
+				days = append(days, summary.Day)
+			}
+		}
+		assert.True(t, len(days) >= 2, "results from different days should be summarized separately")
+		for _, day := range days {
+			assert.Equal(t, day, day.Truncate(24*time.Hour))
+		}
+	}
+
+	pruned, err := s.Prune(now.Add(-48 * time.Hour))
+	if assert.NoError(t, err) {
+		assert.EqualValues(t, 1, pruned)
+	}
+}
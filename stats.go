@@ -0,0 +1,338 @@
+package proxybench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// emaAlpha is the weight given to the newest sample in the latency EMA
+	emaAlpha = 0.3
+
+	// maxStatsEntries bounds the number of proxy/protocol combinations that we
+	// track (and persist). The least recently updated entries are evicted first.
+	maxStatsEntries = 1000
+
+	// maxStatsFileSize is the largest stats file that we're willing to load
+	// (large enough for maxStatsEntries entries with full latency histograms)
+	maxStatsFileSize = 4 * 1024 * 1024
+
+	// The decayed latency histogram has latencyBuckets buckets whose bounds
+	// grow by latencyBucketFactor, starting at minBucketLatency (seconds). The
+	// last bucket extends to infinity.
+	latencyBuckets      = 32
+	latencyBucketFactor = math.Sqrt2
+	minBucketLatency    = 0.01
+)
+
+// StatsEntry summarizes the results of benchmarking a single proxy over a
+// single protocol.
+type StatsEntry struct {
+	Proxy       string    `json:"proxy"`
+	Protocol    string    `json:"protocol"`
+	Provider    string    `json:"provider"`
+	DataCenter  string    `json:"dataCenter"`
+	Successes   int64     `json:"successes"`
+	Failures    int64     `json:"failures"`
+	LatencyEMA  float64   `json:"latencyEMA"`  // seconds
+	FailureEMA  float64   `json:"failureEMA"`  // recent fraction of failures
+	LastLatency float64   `json:"lastLatency"` // seconds
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastFailure time.Time `json:"lastFailure"`
+	Updated     time.Time `json:"updated"`
+
+	// Time-decayed aggregates, only maintained when a half-life is configured
+	// (see Opts.StatsHalfLife). Each sample is weighted by how recently it was
+	// taken, halving in weight every half-life.
+	DecayedLatency     float64 `json:"decayedLatency"`     // seconds
+	DecayedFailureRate float64 `json:"decayedFailureRate"` // fraction of failures
+	LatencyWeight      float64 `json:"latencyWeight"`      // decayed number of latency samples
+	SampleWeight       float64 `json:"sampleWeight"`       // decayed number of samples
+	DecayedP50         float64 `json:"decayedP50"`         // seconds
+	DecayedP90         float64 `json:"decayedP90"`         // seconds
+	DecayedP99         float64 `json:"decayedP99"`         // seconds
+
+	// LatencyHistogram holds the decayed weight of latency samples in each
+	// bucket (see latencyBucketBounds), from which the percentiles are
+	// estimated.
+	LatencyHistogram []float64 `json:"latencyHistogram,omitempty"`
+}
+
+// stats aggregates benchmark results across runs.
+type stats struct {
+	entries map[string]*StatsEntry
+	mx      sync.RWMutex
+}
+
+func newStats() *stats {
+	return &stats{entries: make(map[string]*StatsEntry)}
+}
+
+func statsKey(proxy string, protocol string) string {
+	return proxy + "|" + protocol
+}
+
+// record records the result of a request. If halfLife is positive, the
+// time-decayed aggregates are updated too.
+func (s *stats) record(proxy *proxy, timing time.Duration, err error, halfLife time.Duration) {
+	s.recordAt(time.Now(), proxy, timing, err, halfLife)
+}
+
+func (s *stats) recordAt(now time.Time, proxy *proxy, timing time.Duration, err error, halfLife time.Duration) {
+	key := proxy.key()
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	entry := s.entries[statsKey(key, proxy.protocol)]
+	if entry == nil {
+		entry = &StatsEntry{
+			Proxy:      key,
+			Protocol:   proxy.protocol,
+			Provider:   proxy.Provider,
+			DataCenter: proxy.DataCenter,
+		}
+		s.entries[statsKey(key, proxy.protocol)] = entry
+		s.evictIfNecessary()
+	}
+	if halfLife > 0 {
+		entry.recordDecayed(now, timing, err, halfLife)
+	}
+	entry.Updated = now
+	if err != nil {
+		entry.Failures++
+		entry.LastFailure = now
+		entry.FailureEMA = emaAlpha + (1-emaAlpha)*entry.FailureEMA
+		return
+	}
+	entry.Successes++
+	entry.FailureEMA = (1 - emaAlpha) * entry.FailureEMA
+	entry.LastSuccess = now
+	if timing <= 0 {
+		// Timing was discarded, nothing to add to the EMA
+		return
+	}
+	latency := timing.Seconds()
+	entry.LastLatency = latency
+	if entry.LatencyEMA == 0 {
+		entry.LatencyEMA = latency
+	} else {
+		entry.LatencyEMA = emaAlpha*latency + (1-emaAlpha)*entry.LatencyEMA
+	}
+}
+
+// recordDecayed updates the time-decayed aggregates with a new sample. Must be
+// called before updating entry.Updated.
+func (entry *StatsEntry) recordDecayed(now time.Time, timing time.Duration, err error, halfLife time.Duration) {
+	decay := 1.0
+	if elapsed := now.Sub(entry.Updated); elapsed > 0 {
+		decay = math.Exp2(-float64(elapsed) / float64(halfLife))
+	}
+	entry.SampleWeight *= decay
+	entry.LatencyWeight *= decay
+	for i := range entry.LatencyHistogram {
+		entry.LatencyHistogram[i] *= decay
+	}
+
+	failure := 0.0
+	if err != nil {
+		failure = 1
+	}
+	entry.DecayedFailureRate = decayedMean(entry.DecayedFailureRate, entry.SampleWeight, failure)
+	entry.SampleWeight++
+	if err == nil && timing > 0 {
+		entry.DecayedLatency = decayedMean(entry.DecayedLatency, entry.LatencyWeight, timing.Seconds())
+		entry.LatencyWeight++
+		if len(entry.LatencyHistogram) != latencyBuckets {
+			entry.LatencyHistogram = make([]float64, latencyBuckets)
+		}
+		entry.LatencyHistogram[latencyBucket(timing.Seconds())]++
+		entry.DecayedP50 = entry.decayedPercentile(0.5)
+		entry.DecayedP90 = entry.decayedPercentile(0.9)
+		entry.DecayedP99 = entry.decayedPercentile(0.99)
+	}
+}
+
+// latencyBucket returns the index of the histogram bucket for the given
+// latency in seconds.
+func latencyBucket(latency float64) int {
+	if latency < minBucketLatency {
+		return 0
+	}
+	bucket := 1 + int(math.Log(latency/minBucketLatency)/math.Log(latencyBucketFactor))
+	if bucket >= latencyBuckets {
+		return latencyBuckets - 1
+	}
+	return bucket
+}
+
+// latencyBucketBounds returns the lower and upper bounds (in seconds) of the
+// given histogram bucket. The upper bound of the last bucket is infinite.
+func latencyBucketBounds(bucket int) (float64, float64) {
+	if bucket == 0 {
+		return 0, minBucketLatency
+	}
+	lower := minBucketLatency * math.Pow(latencyBucketFactor, float64(bucket-1))
+	if bucket == latencyBuckets-1 {
+		return lower, math.Inf(1)
+	}
+	return lower, lower * latencyBucketFactor
+}
+
+// decayedPercentile estimates the given percentile (0-1) of the decayed
+// latency distribution, interpolating linearly within the histogram bucket in
+// which it falls.
+func (entry *StatsEntry) decayedPercentile(p float64) float64 {
+	total := 0.0
+	for _, weight := range entry.LatencyHistogram {
+		total += weight
+	}
+	if total == 0 {
+		return 0
+	}
+	target := p * total
+	cumulative := 0.0
+	for bucket, weight := range entry.LatencyHistogram {
+		if weight == 0 || cumulative+weight < target {
+			cumulative += weight
+			continue
+		}
+		lower, upper := latencyBucketBounds(bucket)
+		if math.IsInf(upper, 1) {
+			return lower
+		}
+		return lower + (upper-lower)*(target-cumulative)/weight
+	}
+	lower, _ := latencyBucketBounds(latencyBuckets - 1)
+	return lower
+}
+
+// decayedMean adds a sample with weight 1 to a mean of samples with the given
+// (already decayed) total weight.
+func decayedMean(mean float64, weight float64, sample float64) float64 {
+	return (mean*weight + sample) / (weight + 1)
+}
+
+// failureRate returns the highest recent failure rate across all protocols for
+// the proxy with the given key, or 1 if we haven't measured it yet.
+func (s *stats) failureRate(proxyKey string) float64 {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	rate := -1.0
+	for _, entry := range s.entries {
+		if entry.Proxy != proxyKey {
+			continue
+		}
+		entryRate := entry.FailureEMA
+		if entry.SampleWeight > 0 {
+			// Prefer the time-decayed rate when available
+			entryRate = entry.DecayedFailureRate
+		}
+		if entryRate > rate {
+			rate = entryRate
+		}
+	}
+	if rate < 0 {
+		return 1
+	}
+	return rate
+}
+
+// evictIfNecessary drops the least recently updated entries once we're
+// tracking more than maxStatsEntries. Must be called with the lock held.
+func (s *stats) evictIfNecessary() {
+	if len(s.entries) <= maxStatsEntries {
+		return
+	}
+	keys := make([]string, 0, len(s.entries))
+	for key := range s.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return s.entries[keys[i]].Updated.Before(s.entries[keys[j]].Updated)
+	})
+	for _, key := range keys[:len(keys)-maxStatsEntries] {
+		delete(s.entries, key)
+	}
+}
+
+// snapshot returns a copy of all entries, sorted by proxy and protocol.
+func (s *stats) snapshot() []StatsEntry {
+	s.mx.RLock()
+	result := make([]StatsEntry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		copied := *entry
+		// Don't share the histogram, which is updated in place
+		copied.LatencyHistogram = append([]float64(nil), entry.LatencyHistogram...)
+		result = append(result, copied)
+	}
+	s.mx.RUnlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Proxy != result[j].Proxy {
+			return result[i].Proxy < result[j].Proxy
+		}
+		return result[i].Protocol < result[j].Protocol
+	})
+	return result
+}
+
+// save writes the stats to the given file, replacing it atomically.
+func (s *stats) save(filename string) error {
+	b, err := json.Marshal(s.snapshot())
+	if err != nil {
+		return fmt.Errorf("Unable to marshal stats: %v", err)
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename))
+	if err != nil {
+		return fmt.Errorf("Unable to create temp file for stats: %v", err)
+	}
+	_, err = tmpFile.Write(b)
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("Unable to write stats: %v", err)
+	}
+	return os.Rename(tmpFile.Name(), filename)
+}
+
+// loadStats loads stats previously saved to the given file. If the file is
+// missing, too large or corrupt, it returns empty stats.
+func loadStats(filename string) *stats {
+	s := newStats()
+	info, err := os.Stat(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("Unable to stat stats file %v, starting fresh: %v", filename, err)
+		}
+		return s
+	}
+	if info.Size() > maxStatsFileSize {
+		log.Errorf("Stats file %v is too large (%d bytes), starting fresh", filename, info.Size())
+		return s
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Errorf("Unable to read stats file %v, starting fresh: %v", filename, err)
+		return s
+	}
+	var entries []StatsEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		log.Errorf("Stats file %v is corrupt, starting fresh: %v", filename, err)
+		return s
+	}
+	for i := range entries {
+		entry := &entries[i]
+		s.entries[statsKey(entry.Proxy, entry.Protocol)] = entry
+	}
+	s.evictIfNecessary()
+	log.Debugf("Loaded %d stats entries from %v", len(s.entries), filename)
+	return s
+}
@@ -0,0 +1,202 @@
+package proxybench
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxybench")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "stats.json")
+
+	p := (&Proxy{Addrs: map[string]string{"https": "1.2.3.4:443"}, Provider: "provider"}).withProtocol("https")
+	s := newStats()
+	s.record(p, 2*time.Second, nil, 0)
+	s.record(p, 1*time.Second, nil, 0)
+	s.record(p, 0, errors.New("failed"), 0)
+	if !assert.NoError(t, s.save(filename)) {
+		return
+	}
+
+	loaded := loadStats(filename).snapshot()
+	if assert.Len(t, loaded, 1) {
+		entry := loaded[0]
+		assert.Equal(t, "https=1.2.3.4:443", entry.Proxy)
+		assert.Equal(t, "https", entry.Protocol)
+		assert.Equal(t, "provider", entry.Provider)
+		assert.EqualValues(t, 2, entry.Successes)
+		assert.EqualValues(t, 1, entry.Failures)
+		assert.InDelta(t, 1.7, entry.LatencyEMA, 0.0001)
+		assert.InDelta(t, 1, entry.LastLatency, 0.0001)
+	}
+
+	// Corrupt files are ignored
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("not json"), 0644))
+	assert.Empty(t, loadStats(filename).snapshot())
+}
+
+func TestStatsDecay(t *testing.T) {
+	p := (&Proxy{Addrs: map[string]string{"https": "1.2.3.4:443"}}).withProtocol("https")
+	s := newStats()
+	start := time.Now()
+	halfLife := time.Minute
+	s.recordAt(start, p, 4*time.Second, nil, halfLife)
+	s.recordAt(start.Add(halfLife), p, 1*time.Second, nil, halfLife)
+	entry := s.snapshot()[0]
+	// The first sample has half the weight of the second
+	assert.InDelta(t, 2, entry.DecayedLatency, 0.0001)
+	assert.InDelta(t, 1.5, entry.LatencyWeight, 0.0001)
+
+	s.recordAt(start.Add(100*halfLife), p, 0, errors.New("failed"), halfLife)
+	entry = s.snapshot()[0]
+	assert.InDelta(t, 1, entry.DecayedFailureRate, 0.0001, "old successes should barely count")
+	assert.InDelta(t, 2, entry.DecayedLatency, 0.0001, "failures shouldn't affect latency")
+	assert.InDelta(t, 1, s.failureRate(p.key()), 0.0001)
+}
+
+func TestStatsDecayedPercentiles(t *testing.T) {
+	p := (&Proxy{Addrs: map[string]string{"https": "1.2.3.4:443"}}).withProtocol("https")
+	s := newStats()
+	start := time.Now()
+	halfLife := time.Minute
+	for i := 0; i < 100; i++ {
+		s.recordAt(start, p, 5*time.Second, nil, halfLife)
+	}
+	entry := s.snapshot()[0]
+	assert.InDelta(t, 5, entry.DecayedP50, 5*(latencyBucketFactor-1))
+	assert.InDelta(t, 5, entry.DecayedP99, 5*(latencyBucketFactor-1))
+
+	// After many half-lives, recent fast samples dominate the percentiles
+	now := start.Add(10 * halfLife)
+	for i := 0; i < 9; i++ {
+		s.recordAt(now, p, 100*time.Millisecond, nil, halfLife)
+	}
+	s.recordAt(now, p, 2*time.Second, nil, halfLife)
+	entry = s.snapshot()[0]
+	assert.InDelta(t, 0.1, entry.DecayedP50, 0.1*(latencyBucketFactor-1))
+	assert.InDelta(t, 2, entry.DecayedP99, 2*(latencyBucketFactor-1))
+	assert.True(t, entry.DecayedP90 <= entry.DecayedP99)
+
+	// Percentiles survive a round trip through the stats file
+	dir, err := ioutil.TempDir("", "proxybench")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "stats.json")
+	if !assert.NoError(t, s.save(filename)) {
+		return
+	}
+	loaded := loadStats(filename)
+	loaded.recordAt(now, p, 100*time.Millisecond, nil, halfLife)
+	assert.InDelta(t, 2, loaded.snapshot()[0].DecayedP99, 2*(latencyBucketFactor-1))
+}
+
+func TestStatsWhileRecording(t *testing.T) {
+	r := newRunner(context.Background(), &Opts{}, nil)
+	close(r.done)
+	p := (&Proxy{Addrs: map[string]string{"https": "1.2.3.4:443"}}).withProtocol("https")
+	r.stats.record(p, 100*time.Millisecond, nil, time.Minute)
+	stop := make(chan struct{})
+	recorded := make(chan struct{})
+	go func() {
+		defer close(recorded)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				r.stats.record(p, 100*time.Millisecond, nil, time.Minute)
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		for _, entry := range r.Stats() {
+			// Read (and modify) the histogram, which the race detector
+			// flags if it's shared with the live entry
+			for j := range entry.LatencyHistogram {
+				entry.LatencyHistogram[j]++
+			}
+		}
+	}
+	close(stop)
+	<-recorded
+
+	entry := r.Stats()[0]
+	var total float64
+	for _, weight := range entry.LatencyHistogram {
+		total += weight
+	}
+	assert.InDelta(t, entry.LatencyWeight, total, 0.0001, "modifying a snapshot shouldn't affect the stats")
+}
+
+func TestLatencyBuckets(t *testing.T) {
+	assert.Equal(t, 0, latencyBucket(0.001))
+	assert.Equal(t, latencyBuckets-1, latencyBucket(1e6))
+	for _, latency := range []float64{0.01, 0.05, 0.3, 1, 7.5, 60} {
+		lower, upper := latencyBucketBounds(latencyBucket(latency))
+		assert.True(t, latency >= lower*0.9999 && latency < upper, "%v should be in [%v, %v)", latency, lower, upper)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxybench")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "stats.json")
+
+	var reported []map[string]interface{}
+	flushed := false
+	r := &Runner{stats: newStats(), opts: &Opts{StatsFile: filename}}
+	r.SetReporter(func(timing time.Duration, ctx map[string]interface{}) {
+		reported = append(reported, ctx)
+	})
+	r.SetReportFlusher(func() error {
+		flushed = true
+		return nil
+	})
+	p := (&Proxy{Addrs: map[string]string{"https": "1.2.3.4:443"}, Provider: "provider"}).withProtocol("https")
+	r.stats.record(p, time.Second, nil, 0)
+
+	assert.NoError(t, r.Flush())
+	assert.True(t, flushed)
+	if assert.Len(t, reported, 1) {
+		assert.Equal(t, true, reported[0]["stats_snapshot"])
+		assert.Equal(t, "https=1.2.3.4:443", reported[0]["stats_proxy"])
+		assert.EqualValues(t, 1, reported[0]["stats_successes"])
+	}
+	assert.Len(t, loadStats(filename).snapshot(), 1, "stats should have been saved")
+}
+
+func TestStopSavesStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxybench")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "stats.json")
+
+	r := newRunner(context.Background(), &Opts{StatsFile: filename, UpdateURL: "http://localhost:1"}, nil)
+	close(r.done)
+	p := (&Proxy{Addrs: map[string]string{"https": "1.2.3.4:443"}}).withProtocol("https")
+	r.stats.record(p, time.Second, nil, 0)
+	r.Stop()
+
+	loaded := loadStats(filename).snapshot()
+	if assert.Len(t, loaded, 1, "stats should have been saved on Stop") {
+		assert.EqualValues(t, 1, loaded[0].Successes)
+	}
+}
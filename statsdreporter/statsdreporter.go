@@ -0,0 +1,142 @@
+// Package statsdreporter emits metrics about proxybench reports to a statsd
+// or DogStatsD endpoint.
+package statsdreporter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxybench"
+)
+
+const defaultPrefix = "proxybench"
+
+var (
+	log = golog.LoggerFor("proxybench.statsdreporter")
+
+	// tags maps report fields to the tags with which metrics are emitted
+	tags = []struct{ field, tag string }{
+		{"proxy_host", "proxy"},
+		{"proxy_protocol", "protocol"},
+		{"proxy_provider", "provider"},
+		{"proxy_datacenter", "datacenter"},
+	}
+)
+
+// Opts configures a Reporter.
+type Opts struct {
+	// Addr is the host:port of the statsd endpoint, like "localhost:8125".
+	Addr string
+
+	// Prefix is prepended to metric names. Defaults to "proxybench".
+	Prefix string
+
+	// DogStatsD emits the proxy, protocol, provider and datacenter of each
+	// request as DogStatsD tags. With plain statsd, which doesn't support
+	// tags, they're appended to the metric names instead.
+	DogStatsD bool
+
+	// Tags are additional DogStatsD tags like "env:prod" to add to every
+	// metric.
+	Tags []string
+}
+
+// Reporter emits the following metrics about the outcome of each request
+// reported by proxybench:
+//
+//   - <prefix>.request.latency, the timing of successful requests
+//   - <prefix>.request.success and <prefix>.request.failure, counters of
+//     requests by result
+//
+// Reports that don't describe an individual request, like run summaries, are
+// ignored. Metrics are sent over UDP, so they're dropped rather than slowing
+// down benchmarks if the endpoint isn't keeping up.
+type Reporter struct {
+	opts *Opts
+	conn net.Conn
+}
+
+// New creates a Reporter that emits metrics as configured by opts.
+func New(opts *Opts) (*Reporter, error) {
+	if opts.Addr == "" {
+		return nil, fmt.Errorf("No statsd address configured")
+	}
+	conn, err := net.Dial("udp", opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to dial statsd at %v: %v", opts.Addr, err)
+	}
+	copied := *opts
+	if copied.Prefix == "" {
+		copied.Prefix = defaultPrefix
+	}
+	return &Reporter{opts: &copied, conn: conn}, nil
+}
+
+// Report emits metrics for a report. It implements proxybench.Reporter.
+func (r *Reporter) Report(result proxybench.Result) {
+	if !result.IsRequest {
+		return
+	}
+	ctx := result.Fields
+	if result.Success {
+		r.send("request.success", "1|c", ctx)
+		if result.Timing > 0 {
+			r.send("request.latency", fmt.Sprintf("%d|ms", result.Timing.Milliseconds()), ctx)
+		}
+	} else {
+		r.send("request.failure", "1|c", ctx)
+	}
+}
+
+// Flush implements proxybench.Reporter. Metrics are sent as they're reported,
+// so there's nothing to flush.
+func (r *Reporter) Flush() error {
+	return nil
+}
+
+// Close closes the connection to the statsd endpoint.
+func (r *Reporter) Close() error {
+	return r.conn.Close()
+}
+
+func (r *Reporter) send(name string, value string, ctx map[string]interface{}) {
+	if _, err := r.conn.Write([]byte(r.format(name, value, ctx))); err != nil {
+		log.Debugf("Unable to send %v to statsd: %v", name, err)
+	}
+}
+
+// format formats a metric in the statsd line protocol.
+func (r *Reporter) format(name string, value string, ctx map[string]interface{}) string {
+	name = r.opts.Prefix + "." + name
+	if !r.opts.DogStatsD {
+		for _, t := range tags {
+			name += "." + sanitize(ctx[t.field])
+		}
+		return name + ":" + value
+	}
+	metricTags := append([]string(nil), r.opts.Tags...)
+	for _, t := range tags {
+		metricTags = append(metricTags, t.tag+":"+sanitize(ctx[t.field]))
+	}
+	return name + ":" + value + "|#" + strings.Join(metricTags, ",")
+}
+
+// sanitize makes a report field safe for use in metric names and tags.
+func sanitize(value interface{}) string {
+	if value == nil {
+		return "unknown"
+	}
+	s := fmt.Sprint(value)
+	if s == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '#', ',', '@', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,55 @@
+package statsdreporter
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pc.Close()
+
+	ctx := map[string]interface{}{
+		"proxy_host":         "1.2.3.4",
+		"proxy_protocol":     "https",
+		"proxy_provider":     "do",
+		"proxy_datacenter":   "ams",
+		"proxybench_success": true,
+	}
+	receive := func() string {
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 1024)
+		n, _, err := pc.ReadFrom(b)
+		assert.NoError(t, err)
+		return string(b[:n])
+	}
+
+	r, err := New(&Opts{Addr: pc.LocalAddr().String(), DogStatsD: true, Tags: []string{"env:test"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer r.Close()
+	r.Report(proxybench.NewResult(250*time.Millisecond, ctx))
+	assert.Equal(t, "proxybench.request.success:1|c|#env:test,proxy:1_2_3_4,protocol:https,provider:do,datacenter:ams", receive())
+	assert.Equal(t, "proxybench.request.latency:250|ms|#env:test,proxy:1_2_3_4,protocol:https,provider:do,datacenter:ams", receive())
+
+	r.Report(proxybench.NewResult(0, map[string]interface{}{"proxy_fully_down": true}))
+	ctx["proxybench_success"] = false
+	r.Report(proxybench.NewResult(0, ctx))
+	assert.Equal(t, "proxybench.request.failure:1|c|#env:test,proxy:1_2_3_4,protocol:https,provider:do,datacenter:ams", receive(), "summaries should be skipped")
+
+	plain, err := New(&Opts{Addr: pc.LocalAddr().String(), Prefix: "bench"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer plain.Close()
+	plain.Report(proxybench.NewResult(0, ctx))
+	assert.Equal(t, "bench.request.failure.1_2_3_4.https.do.ams:1|c", receive())
+}
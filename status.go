@@ -0,0 +1,109 @@
+package proxybench
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// runInfo describes the most recently completed run.
+type runInfo struct {
+	ID        string
+	Started   time.Time
+	Finished  time.Time
+	Cancelled bool
+}
+
+// Status is a snapshot of the state of a Runner, as served on the
+// Opts.StatusAddr.
+type Status struct {
+	// LastRunID, LastRunStarted and LastRunFinished describe the most recently
+	// completed run, and are empty if there hasn't been one yet.
+	LastRunID        string     `json:"lastRunID,omitempty"`
+	LastRunStarted   *time.Time `json:"lastRunStarted,omitempty"`
+	LastRunFinished  *time.Time `json:"lastRunFinished,omitempty"`
+	LastRunCancelled bool       `json:"lastRunCancelled,omitempty"`
+
+	// Proxies are the aggregate stats for every proxy and protocol, including
+	// the latest latency and the success and failure counts.
+	Proxies []StatsEntry `json:"proxies"`
+}
+
+// Status returns a snapshot of the Runner's state.
+func (r *Runner) Status() *Status {
+	status := &Status{Proxies: r.Stats()}
+	if info, ok := r.lastRun.Load().(runInfo); ok {
+		status.LastRunID = info.ID
+		status.LastRunStarted = &info.Started
+		status.LastRunFinished = &info.Finished
+		status.LastRunCancelled = info.Cancelled
+	}
+	return status
+}
+
+// StatusHandler returns an http.Handler that serves the Runner's Status as
+// JSON at /proxybench/status.
+func (r *Runner) StatusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxybench/status", func(resp http.ResponseWriter, req *http.Request) {
+		b, err := json.MarshalIndent(r.Status(), "", "  ")
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(b)
+	})
+	return mux
+}
+
+// dashboardHandler returns an http.Handler that serves the StatusHandler
+// along with the dashboard at /proxybench/ and the latency history it uses at
+// /proxybench/history.
+func (r *Runner) dashboardHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/proxybench/status", r.StatusHandler())
+	mux.HandleFunc("/proxybench/history", func(resp http.ResponseWriter, req *http.Request) {
+		b, err := json.Marshal(r.history.snapshot())
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write(b)
+	})
+	mux.HandleFunc("/proxybench/", func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/proxybench/" {
+			http.NotFound(resp, req)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.Write([]byte(dashboardHTML))
+	})
+	return mux
+}
+
+// serveStatus starts serving the StatusHandler on opts.StatusAddr, if set.
+func (r *Runner) serveStatus(opts *Opts) {
+	if opts.StatusAddr == "" {
+		return
+	}
+	l, err := net.Listen("tcp", opts.StatusAddr)
+	if err != nil {
+		log.Errorf("Unable to listen for status requests at %v: %v", opts.StatusAddr, err)
+		return
+	}
+	log.Debugf("Serving status at http://%v/proxybench/status", l.Addr())
+	handler := r.StatusHandler()
+	if opts.StatusDashboard {
+		log.Debugf("Serving dashboard at http://%v/proxybench/", l.Addr())
+		handler = r.dashboardHandler()
+	}
+	r.status = &http.Server{Handler: handler}
+	go func() {
+		if err := r.status.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Error serving status: %v", err)
+		}
+	}()
+}
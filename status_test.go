@@ -0,0 +1,127 @@
+package proxybench
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusHandler(t *testing.T) {
+	r := newRunner(context.Background(), &Opts{}, nil)
+	srv := httptest.NewServer(r.StatusHandler())
+	defer srv.Close()
+
+	status := fetchStatus(t, srv.URL)
+	if assert.NotNil(t, status) {
+		assert.Empty(t, status.LastRunID, "there shouldn't be a last run yet")
+		assert.Empty(t, status.Proxies)
+	}
+
+	p := (&Proxy{Addrs: map[string]string{"https": "1.2.3.4:443"}, Provider: "do"}).withProtocol("https")
+	r.stats.record(p, 250*time.Millisecond, nil, 0)
+	r.stats.record(p, 0, context.DeadlineExceeded, 0)
+	rn := r.newRun(r.opts, false)
+	rn.bench(nil)
+
+	status = fetchStatus(t, srv.URL)
+	if assert.NotNil(t, status) {
+		assert.Equal(t, rn.id, status.LastRunID)
+		if assert.NotNil(t, status.LastRunFinished) {
+			assert.False(t, status.LastRunFinished.Before(*status.LastRunStarted))
+		}
+		if assert.Len(t, status.Proxies, 1) {
+			assert.Equal(t, "https", status.Proxies[0].Protocol)
+			assert.Equal(t, 0.25, status.Proxies[0].LastLatency)
+			assert.EqualValues(t, 1, status.Proxies[0].Successes)
+			assert.EqualValues(t, 1, status.Proxies[0].Failures)
+		}
+	}
+}
+
+func TestStatusAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	r := StartContext(context.Background(), &Opts{StatusAddr: addr, Period: time.Hour}, nil)
+	var status *Status
+	for i := 0; i < 50 && status == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status = fetchStatus(nil, "http://"+addr)
+	}
+	assert.NotNil(t, status, "status should be served on the StatusAddr")
+	r.Stop()
+	_, err = http.Get("http://" + addr + "/proxybench/status")
+	assert.Error(t, err, "status listener should be closed on stop")
+}
+
+func TestStatusIncludesLoadedStats(t *testing.T) {
+	// Testing mode would benchmark (and add stats for) the testing proxy
+	defer func(orig string) {
+		testingProxy = orig
+	}(testingProxy)
+	testingProxy = ""
+
+	dir, err := ioutil.TempDir("", "proxybench")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "stats.json")
+	saved := newStats()
+	saved.record((&Proxy{Addrs: map[string]string{"https": "1.2.3.4:443"}}).withProtocol("https"), time.Second, nil, 0)
+	if !assert.NoError(t, saved.save(filename)) {
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	r := StartContext(context.Background(), &Opts{StatusAddr: addr, StatsFile: filename, UpdateURL: "http://localhost:1", Period: time.Hour}, nil)
+	defer r.Stop()
+	var status *Status
+	for i := 0; i < 50 && status == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status = fetchStatus(nil, "http://"+addr)
+	}
+	if assert.NotNil(t, status) && assert.Len(t, status.Proxies, 1, "stats should be loaded before the status is served") {
+		assert.Equal(t, "https=1.2.3.4:443", status.Proxies[0].Proxy)
+	}
+}
+
+// fetchStatus fetches the status from the server at baseURL, failing the test
+// (if given) on error.
+func fetchStatus(t *testing.T, baseURL string) *Status {
+	resp, err := http.Get(baseURL + "/proxybench/status")
+	if err != nil {
+		if t != nil {
+			t.Error(err)
+		}
+		return nil
+	}
+	defer resp.Body.Close()
+	status := &Status{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err != nil {
+		if t != nil {
+			t.Error(err)
+		}
+		return nil
+	}
+	return status
+}
@@ -0,0 +1,108 @@
+package proxybench
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	isolateByProxy    = "proxy"
+	isolateByProvider = "provider"
+)
+
+// task is a unit of benchmarking work within a run. run is passed the time at
+// which the task was enqueued.
+type task struct {
+	group string
+	run   func(enqueued time.Time)
+}
+
+// isolationGroup returns the queue in which benchmarks for the given proxy
+// run, based on IsolateBy.
+func (opts *Opts) isolationGroup(p *Proxy) string {
+	switch opts.IsolateBy {
+	case isolateByProxy:
+		return "proxy:" + p.key()
+	case isolateByProvider:
+		return "provider:" + p.Provider
+	default:
+		return ""
+	}
+}
+
+// runTasks runs the given tasks and waits for them to finish. If isolation is
+// enabled, each group of tasks gets its own queue that's worked through by
+// opts.ConcurrencyPerGroup workers, otherwise all tasks share a single queue
+// that's worked through by opts.Concurrency workers, or sequentially in order
+// if that's not set. With isolation, opts.Concurrency additionally bounds the
+// number of tasks running at once across all queues. Once ctx is done,
+// remaining tasks are skipped. It returns the number of tasks that completed
+// before ctx was done.
+func runTasks(ctx context.Context, opts *Opts, tasks []*task) int {
+	enqueued := time.Now()
+	var completed int64
+	var limit chan struct{}
+	if opts.Concurrency > 0 {
+		limit = make(chan struct{}, opts.Concurrency)
+	}
+	runTask := func(t *task) {
+		if limit != nil {
+			select {
+			case limit <- struct{}{}:
+				defer func() { <-limit }()
+			case <-ctx.Done():
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		t.run(enqueued)
+		if ctx.Err() == nil {
+			atomic.AddInt64(&completed, 1)
+		}
+	}
+
+	if opts.IsolateBy == "" && opts.Concurrency <= 1 {
+		for _, t := range tasks {
+			runTask(t)
+		}
+		return int(completed)
+	}
+
+	workers := opts.ConcurrencyPerGroup
+	groupOf := func(t *task) string { return t.group }
+	if opts.IsolateBy == "" {
+		workers = opts.Concurrency
+		groupOf = func(*task) string { return "" }
+	}
+	queues := make(map[string]chan *task)
+	var groups []string
+	for _, t := range tasks {
+		group := groupOf(t)
+		if queues[group] == nil {
+			groups = append(groups, group)
+			queues[group] = make(chan *task, len(tasks))
+		}
+		queues[group] <- t
+	}
+
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		queue := queues[group]
+		close(queue)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for t := range queue {
+					runTask(t)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	return int(atomic.LoadInt64(&completed))
+}
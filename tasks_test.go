@@ -0,0 +1,77 @@
+package proxybench
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunTasksIsolation(t *testing.T) {
+	var mx sync.Mutex
+	var finished []string
+	finish := func(name string, delay time.Duration) func(time.Time) {
+		return func(time.Time) {
+			time.Sleep(delay)
+			mx.Lock()
+			finished = append(finished, name)
+			mx.Unlock()
+		}
+	}
+
+	tasks := []*task{
+		&task{group: "slow", run: finish("slow1", 100*time.Millisecond)},
+		&task{group: "slow", run: finish("slow2", 100*time.Millisecond)},
+		&task{group: "fast", run: finish("fast1", 0)},
+		&task{group: "fast", run: finish("fast2", 0)},
+	}
+	runTasks(context.Background(), &Opts{IsolateBy: isolateByProxy, ConcurrencyPerGroup: 1}, tasks)
+	assert.Equal(t, []string{"fast1", "fast2", "slow1", "slow2"}, finished)
+
+	finished = nil
+	runTasks(context.Background(), &Opts{}, tasks)
+	assert.Equal(t, []string{"slow1", "slow2", "fast1", "fast2"}, finished, "without isolation, tasks should run in order")
+}
+
+func TestRunTasksCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var ran int
+	tasks := []*task{
+		&task{run: func(time.Time) { ran++ }},
+		&task{run: func(time.Time) { ran++; cancel() }},
+		&task{run: func(time.Time) { ran++ }},
+	}
+	completed := runTasks(ctx, &Opts{}, tasks)
+	assert.Equal(t, 2, ran, "tasks after cancellation should be skipped")
+	assert.Equal(t, 1, completed, "task that was interrupted by cancellation shouldn't count as completed")
+}
+
+func TestRunTasksConcurrency(t *testing.T) {
+	var running, maxRunning int64
+	var mx sync.Mutex
+	var tasks []*task
+	for i := 0; i < 6; i++ {
+		tasks = append(tasks, &task{group: "proxy", run: func(time.Time) {
+			mx.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mx.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mx.Lock()
+			running--
+			mx.Unlock()
+		}})
+	}
+
+	completed := runTasks(context.Background(), &Opts{Concurrency: 2}, tasks)
+	assert.Equal(t, 6, completed)
+	assert.EqualValues(t, 2, maxRunning, "without isolation, Concurrency workers should share one queue")
+
+	maxRunning = 0
+	runTasks(context.Background(), &Opts{IsolateBy: isolateByProxy, ConcurrencyPerGroup: 4, Concurrency: 3}, tasks)
+	assert.EqualValues(t, 3, maxRunning, "with isolation, Concurrency should cap the total")
+}
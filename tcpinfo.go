@@ -0,0 +1,49 @@
+package proxybench
+
+import (
+	"errors"
+	"net"
+)
+
+// tcpInfoSnapshot is the TCP_INFO of the connection to a proxy as of the last
+// time data arrived from it.
+type tcpInfoSnapshot struct {
+	rttMicros   uint32
+	retransmits uint32
+	err         error
+}
+
+// tcpInfoConn wraps the local relay's connection to the proxy, snapshotting
+// TCP_INFO from the raw connection whenever data arrives and before passing
+// it on. By the time the whole response has been read, the snapshot covers
+// it, regardless of whether the relay has since closed the connection.
+type tcpInfoConn struct {
+	net.Conn
+	raw   net.Conn
+	proxy *proxy
+}
+
+func (c *tcpInfoConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		snapshot := &tcpInfoSnapshot{err: errors.New("No raw TCP connection to proxy")}
+		if c.raw != nil {
+			snapshot.rttMicros, snapshot.retransmits, snapshot.err = tcpInfo(c.raw)
+		}
+		c.proxy.mx.Lock()
+		c.proxy.tcpInfo = snapshot
+		c.proxy.mx.Unlock()
+	}
+	return n, err
+}
+
+// lastTCPInfo returns the latest TCP_INFO snapshot taken by the local relay.
+func (p *proxy) lastTCPInfo() (rttMicros uint32, retransmits uint32, err error) {
+	p.mx.Lock()
+	snapshot := p.tcpInfo
+	p.mx.Unlock()
+	if snapshot == nil {
+		return 0, 0, errors.New("No data received from proxy")
+	}
+	return snapshot.rttMicros, snapshot.retransmits, snapshot.err
+}
@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package proxybench
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// tcpInfo reads TCP_INFO from the given connection, returning the smoothed
+// RTT in microseconds and the total number of retransmits.
+func tcpInfo(conn net.Conn) (rttMicros uint32, retransmits uint32, err error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, 0, fmt.Errorf("Connection of type %T doesn't support TCP_INFO", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var info syscall.TCPInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		size := uint32(syscall.SizeofTCPInfo)
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_TCP, syscall.TCP_INFO, uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			sockErr = errno
+		}
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if sockErr != nil {
+		return 0, 0, sockErr
+	}
+	return info.Rtt, info.Total_retrans, nil
+}
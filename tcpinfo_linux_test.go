@@ -0,0 +1,38 @@
+//go:build linux
+// +build linux
+
+package proxybench
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportTCPInfo(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	proxySrv := httptest.NewServer(&httputil.ReverseProxy{
+		Director: func(req *http.Request) {},
+	})
+	defer proxySrv.Close()
+
+	p := &Proxy{Addrs: map[string]string{"http": proxySrv.Listener.Addr().String()}}
+	var reported map[string]interface{}
+	_, err := request(context.Background(), &Opts{ReportTCPInfo: true}, func(_ time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	}, origin.URL, p.withProtocol("http"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, true, reported["proxybench_success"])
+	assert.IsType(t, uint32(0), reported["tcp_rtt_us"], "TCP info should have been snapshotted by the relay")
+	assert.IsType(t, uint32(0), reported["tcp_retransmits"])
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package proxybench
+
+import (
+	"errors"
+	"net"
+)
+
+func tcpInfo(conn net.Conn) (rttMicros uint32, retransmits uint32, err error) {
+	return 0, 0, errors.New("TCP_INFO is only supported on Linux")
+}
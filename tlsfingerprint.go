@@ -0,0 +1,48 @@
+package proxybench
+
+import (
+	"fmt"
+	"net"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// tlsFingerprints are the supported values of Proxy.TLSFingerprint and the
+// ClientHellos they mimic.
+var tlsFingerprints = map[string]utls.ClientHelloID{
+	"chrome":     utls.HelloChrome_Auto,
+	"firefox":    utls.HelloFirefox_Auto,
+	"randomized": utls.HelloRandomizedALPN,
+}
+
+func tlsFingerprint(name string) (utls.ClientHelloID, error) {
+	helloID, found := tlsFingerprints[name]
+	if !found {
+		return utls.ClientHelloID{}, fmt.Errorf("Unknown TLS fingerprint %v", name)
+	}
+	return helloID, nil
+}
+
+// utlsClient wraps conn in a TLS client whose ClientHello mimics the given
+// one, except that it only offers config.NextProtos via ALPN, since the relay
+// can't speak whatever else a browser would offer.
+func utlsClient(conn net.Conn, config *utls.Config, helloID utls.ClientHelloID) (*utls.UConn, error) {
+	if helloID == utls.HelloRandomizedALPN {
+		// Randomized ClientHellos already use config.NextProtos
+		return utls.UClient(conn, config, helloID), nil
+	}
+	spec, err := utls.UTLSIdToSpec(helloID)
+	if err != nil {
+		return nil, err
+	}
+	for _, ext := range spec.Extensions {
+		if alpn, ok := ext.(*utls.ALPNExtension); ok {
+			alpn.AlpnProtocols = config.NextProtos
+		}
+	}
+	uconn := utls.UClient(conn, config, utls.HelloCustom)
+	if err := uconn.ApplyPreset(&spec); err != nil {
+		return nil, err
+	}
+	return uconn, nil
+}
@@ -0,0 +1,38 @@
+package proxybench
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSFingerprint(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	// Would negotiate h2 if the fingerprint's own ALPN protocols were offered
+	srv.TLS = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	srv.StartTLS()
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	// Randomized ClientHellos aren't tested, since some of them are
+	// legitimately rejected by Go's TLS server
+	for _, fingerprint := range []string{"chrome", "firefox"} {
+		proxy := (&Proxy{Addrs: map[string]string{"https": addr}, TLSFingerprint: fingerprint}).withProtocol("https")
+		conn, err := proxy.dial(context.Background(), &Opts{})
+		if !assert.NoError(t, err, fingerprint) {
+			continue
+		}
+		conn.Close()
+		alpn, complete := proxy.negotiatedProtocol()
+		assert.True(t, complete, fingerprint)
+		assert.Equal(t, "http/1.1", alpn, fingerprint)
+	}
+
+	proxy := (&Proxy{Addrs: map[string]string{"https": addr}, TLSFingerprint: "netscape"}).withProtocol("https")
+	_, err := proxy.dial(context.Background(), &Opts{})
+	assert.Error(t, err, "unknown fingerprint should be rejected")
+}
@@ -0,0 +1,107 @@
+package proxybench
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/getlantern/ops"
+)
+
+// defaultUploadBytes is the size of the upload if Opts.UploadBytes isn't set
+const defaultUploadBytes = 1024 * 1024
+
+// benchUpload POSTs opts.UploadBytes random bytes to opts.UploadURL through
+// the given proxy, reporting (and returning) how long the upload took along
+// with the upstream throughput. The upload is timed from when the request
+// headers were written until the first byte of the response, which servers
+// only send once they've received the whole body.
+func (rn *run) benchUpload(proxy *proxy) (time.Duration, error) {
+	opts := rn.opts
+	rn.pacer.wait(rn.ctx, opts, opts.UploadURL)
+	report := rn.reporter()
+	proxyFN, done, err := proxyFunc(rn.ctx, opts, report, opts.UploadURL, proxy)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	size := opts.UploadBytes
+	if size <= 0 {
+		size = defaultUploadBytes
+	}
+	op := beginOp(opts, opts.UploadURL, proxy).
+		Set("request_type", "upload").
+		Set("upload_bytes", size)
+	defer op.End()
+
+	client := &http.Client{
+		Timeout: proxy.requestTimeout(opts),
+		Transport: &http.Transport{
+			Proxy:              proxyFN,
+			ProxyConnectHeader: proxy.proxyHeader(),
+			DisableKeepAlives:  true,
+		},
+	}
+	// Random so that nothing along the way can compress it
+	payload := make([]byte, size)
+	if _, err := rand.Read(payload); err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", opts.UploadURL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	var uploadStart, uploadEnd time.Time
+	var mx sync.Mutex
+	req = req.WithContext(httptrace.WithClientTrace(rn.ctx, &httptrace.ClientTrace{
+		WroteHeaders: func() {
+			mx.Lock()
+			uploadStart = time.Now()
+			mx.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			mx.Lock()
+			uploadEnd = time.Now()
+			mx.Unlock()
+		},
+	}))
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Debugf("Error uploading to %v through %v: %v", opts.UploadURL, proxy, err)
+		if rn.ctx.Err() == nil {
+			reportFailure(report, op, failureReason(err), start, err)
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Debugf("Unexpected status %v uploading to %v through %v", resp.Status, opts.UploadURL, proxy)
+		err := fmt.Errorf("Unexpected status %v", resp.Status)
+		op.Set("http_status", resp.StatusCode)
+		reportFailure(report, op, "status", start, err)
+		return 0, err
+	}
+	mx.Lock()
+	delta := uploadEnd.Sub(uploadStart)
+	mx.Unlock()
+	if delta <= 0 {
+		return 0, fmt.Errorf("Unable to time upload")
+	}
+	op.Set("upload_time", delta.Seconds()).
+		Set("upload_throughput_bps", float64(size)/delta.Seconds()).
+		Set("proxybench_success", true)
+	report(delta, ops.AsMap(op, true))
+	return delta, nil
+}
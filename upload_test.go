@@ -0,0 +1,38 @@
+package proxybench
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpload(t *testing.T) {
+	received := make(chan int64, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, req.Body)
+		received <- n
+	}))
+	defer srv.Close()
+
+	var reported map[string]interface{}
+	r := &Runner{ctx: context.Background(), stats: newStats()}
+	r.SetReporter(func(timing time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	})
+	rn := r.newRun(&Opts{UploadURL: srv.URL, UploadBytes: 100000}, false)
+	p := &Proxy{Addrs: map[string]string{protocolSystem: ""}}
+	timing, err := rn.benchUpload(rn.attempt(p.withRandomProtocol(), time.Now()))
+	if assert.NoError(t, err) {
+		assert.True(t, timing > 0)
+		assert.EqualValues(t, 100000, <-received)
+		assert.Equal(t, "upload", reported["request_type"])
+		assert.Equal(t, 100000, reported["upload_bytes"])
+		assert.NotNil(t, reported["upload_throughput_bps"])
+	}
+}
@@ -0,0 +1,120 @@
+package proxybench
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// warmRelayAddr is the nominal address of the relay that warm transports
+// connect through. It's never actually dialed, since each connection is
+// relayed in-process to the proxy of the request that needed it.
+const warmRelayAddr = "127.0.0.1:1"
+
+// warmPool holds connections to proxies open across runs when using
+// Opts.WarmConnections. Each proxy and protocol gets its own keep-alive
+// transport.
+type warmPool struct {
+	entries map[string]*warmEntry
+	mx      sync.Mutex
+}
+
+type warmEntry struct {
+	transport *http.Transport
+}
+
+type warmProxyKey struct{}
+
+// get returns the warm entry for the given proxy, creating it if necessary.
+func (wp *warmPool) get(opts *Opts, p *proxy) *warmEntry {
+	key := statsKey(p.key(), p.protocol)
+	wp.mx.Lock()
+	defer wp.mx.Unlock()
+	if entry := wp.entries[key]; entry != nil {
+		return entry
+	}
+
+	entry := &warmEntry{}
+	entry.transport = &http.Transport{
+		Proxy:              http.ProxyFromEnvironment,
+		ProxyConnectHeader: p.proxyHeader(),
+		ForceAttemptHTTP2:  opts.EnableHTTP2,
+		// Keep connections around long enough to be reused by the next run
+		IdleConnTimeout: 2 * opts.Period,
+	}
+	if p.protocol != protocolSystem {
+		entry.transport.Proxy = http.ProxyURL(p.localProxyURL(warmRelayAddr))
+		entry.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// Dial on behalf of the request that needs the connection, so
+			// that the dial details are reported with it.
+			requestProxy, ok := ctx.Value(warmProxyKey{}).(*proxy)
+			if !ok {
+				return nil, fmt.Errorf("No proxy to relay to %v", addr)
+			}
+			in, out := net.Pipe()
+			go doLocalProxy(ctx, opts, out, requestProxy)
+			return in, nil
+		}
+	}
+	if wp.entries == nil {
+		wp.entries = make(map[string]*warmEntry)
+	}
+	wp.entries[key] = entry
+	return entry
+}
+
+// retain closes the warm connections to any proxies and protocols that
+// aren't among the given proxies, such as ones removed from the config.
+func (wp *warmPool) retain(proxies []*Proxy) {
+	keep := make(map[string]bool)
+	for _, p := range proxies {
+		for protocol := range p.Addrs {
+			keep[statsKey(p.key(), protocol)] = true
+		}
+	}
+	wp.mx.Lock()
+	defer wp.mx.Unlock()
+	for key, entry := range wp.entries {
+		if !keep[key] {
+			entry.transport.CloseIdleConnections()
+			delete(wp.entries, key)
+		}
+	}
+}
+
+// close closes all warm connections.
+func (wp *warmPool) close() {
+	wp.retain(nil)
+}
+
+// warmRequest fetches origin through a warm connection to the given proxy,
+// reporting whether the connection was carried over from a previous run,
+// meaning that it had been sitting idle since before this run started.
+func (rn *run) warmRequest(origin string, proxy *proxy) (time.Duration, error) {
+	entry := rn.warm.get(rn.opts, proxy)
+	ctx := context.WithValue(rn.ctx, warmProxyKey{}, proxy)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused := info.Reused && info.WasIdle && time.Now().Add(-info.IdleTime).Before(rn.started)
+			proxy.mx.Lock()
+			proxy.crossRunReuse = &reused
+			proxy.mx.Unlock()
+		},
+	})
+	return doRequest(ctx, rn.opts, rn.reporter(), origin, proxy, entry.transport)
+}
+
+// crossRunReused returns whether the request reused a warm connection from a
+// previous run, and whether that's known at all.
+func (p *proxy) crossRunReused() (bool, bool) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if p.crossRunReuse == nil {
+		return false, false
+	}
+	return *p.crossRunReuse, true
+}
@@ -0,0 +1,87 @@
+package proxybench
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWarmConnections(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+
+	var reported map[string]interface{}
+	r := &Runner{ctx: context.Background(), stats: newStats()}
+	r.SetReporter(func(timing time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	})
+	defer r.warm.close()
+	opts := &Opts{WarmConnections: true, Period: time.Hour}
+	p := &Proxy{Addrs: map[string]string{protocolSystem: ""}}
+
+	for i, expected := range []bool{false, true, true} {
+		rn := r.newRun(opts, false)
+		_, err := rn.warmRequest(srv.URL, rn.attempt(p.withRandomProtocol(), time.Now()))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, expected, reported["cross_run_reuse"], "run %d", i)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWarmDialDetails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte("hello"))
+	}))
+	defer srv.Close()
+	proxySrv := httptest.NewServer(&httputil.ReverseProxy{Director: func(req *http.Request) {}})
+	defer proxySrv.Close()
+
+	var reported map[string]interface{}
+	r := &Runner{ctx: context.Background(), stats: newStats()}
+	r.SetReporter(func(timing time.Duration, ctx map[string]interface{}) {
+		reported = ctx
+	})
+	defer r.warm.close()
+	opts := &Opts{WarmConnections: true, Period: time.Hour}
+	p := &Proxy{Addrs: map[string]string{"http": proxySrv.Listener.Addr().String()}}
+
+	rn := r.newRun(opts, false)
+	_, err := rn.warmRequest(srv.URL, rn.attempt(p.withRandomProtocol(), time.Now()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "127.0.0.1", reported["connected_ip"], "dial should be reported with the request that made it")
+
+	rn = r.newRun(opts, false)
+	_, err = rn.warmRequest(srv.URL, rn.attempt(p.withRandomProtocol(), time.Now()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, true, reported["cross_run_reuse"])
+	assert.Nil(t, reported["attempted_ips"], "reused connection shouldn't report a dial")
+}
+
+func TestWarmRetain(t *testing.T) {
+	opts := &Opts{WarmConnections: true, Period: time.Hour}
+	kept := &Proxy{Addrs: map[string]string{"http": "127.0.0.1:1"}}
+	removed := &Proxy{Addrs: map[string]string{"http": "127.0.0.1:2"}}
+	var wp warmPool
+	entry := wp.get(opts, kept.withProtocol("http"))
+	wp.get(opts, removed.withProtocol("http"))
+	assert.Len(t, wp.entries, 2)
+
+	wp.retain([]*Proxy{kept})
+	assert.Len(t, wp.entries, 1)
+	assert.True(t, entry == wp.get(opts, kept.withProtocol("http")), "entry for configured proxy should be kept")
+	wp.close()
+	assert.Empty(t, wp.entries)
+}
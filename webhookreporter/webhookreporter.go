@@ -0,0 +1,269 @@
+// Package webhookreporter POSTs proxybench reports as JSON to a webhook.
+package webhookreporter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxybench"
+	"github.com/getlantern/proxybench/internal/reportqueue"
+)
+
+const (
+	// SignatureHeader is the header carrying the HMAC-SHA256 signature of the
+	// request body when a secret is configured, formatted as "sha256=<hex>".
+	SignatureHeader = "X-Proxybench-Signature"
+
+	minBackoff = 1 * time.Second
+	maxBackoff = 1 * time.Minute
+
+	// DefaultBatchSize is the maximum number of reports posted at once if no
+	// batch size is specified.
+	DefaultBatchSize = 1
+
+	// DefaultFlushInterval is how often partial batches are posted if no flush
+	// interval is specified.
+	DefaultFlushInterval = 10 * time.Second
+
+	// DefaultBufferSize is the number of reports buffered while the webhook is
+	// slow or unreachable if no buffer size is specified.
+	DefaultBufferSize = 1000
+
+	// DefaultMaxRetries is how many times a failed post is retried if no
+	// maximum is specified.
+	DefaultMaxRetries = 5
+)
+
+var (
+	log = golog.LoggerFor("proxybench.webhookreporter")
+
+	// closeTimeout is how long Close waits for buffered reports to be posted
+	// before abandoning them.
+	closeTimeout = 10 * time.Second
+)
+
+// Opts configures a Reporter.
+type Opts struct {
+	// URL is the webhook to post to.
+	URL string
+
+	// Headers are added to every request, for example for authentication.
+	Headers map[string]string
+
+	// Secret, if set, is used to sign request bodies with HMAC-SHA256. The
+	// signature is sent in the SignatureHeader.
+	Secret string
+
+	// BatchSize is the maximum number of reports posted at once.
+	BatchSize int
+
+	// FlushInterval is how often partial batches are posted.
+	FlushInterval time.Duration
+
+	// BufferSize is the number of reports buffered while the webhook is slow
+	// or unreachable. Reports beyond that are dropped.
+	BufferSize int
+
+	// MaxRetries is how many times a failed post is retried before the batch
+	// is dropped.
+	MaxRetries int
+}
+
+// Reporter posts reports to a webhook. The body of each post is a JSON array
+// of reports, each an object with the report's fields along with "timestamp"
+// (RFC 3339) and "timing" (in seconds). Reports are buffered and posted in the
+// background. If the webhook can't keep up and the buffer fills, new reports
+// are dropped rather than blocking the benchmarks. Posts that fail with a
+// network error, a 429 or a 5xx status are retried with exponential backoff,
+// up to MaxRetries times. Other failures drop the batch.
+type Reporter struct {
+	opts   Opts
+	client *http.Client
+	queue  *reportqueue.Queue
+}
+
+// New creates a Reporter that posts to the webhook configured by opts.
+func New(opts *Opts) (*Reporter, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("No webhook URL configured")
+	}
+	r := &Reporter{
+		opts:   *opts,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	if r.opts.BatchSize <= 0 {
+		r.opts.BatchSize = DefaultBatchSize
+	}
+	if r.opts.FlushInterval <= 0 {
+		r.opts.FlushInterval = DefaultFlushInterval
+	}
+	if r.opts.BufferSize <= 0 {
+		r.opts.BufferSize = DefaultBufferSize
+	}
+	if r.opts.MaxRetries <= 0 {
+		r.opts.MaxRetries = DefaultMaxRetries
+	}
+	r.queue = reportqueue.New(r.opts.BufferSize, closeTimeout)
+	r.queue.Start(r.run)
+	return r, nil
+}
+
+// Report queues a report for posting. It implements proxybench.Reporter.
+func (r *Reporter) Report(result proxybench.Result) {
+	entry := make(map[string]interface{}, len(result.Fields)+2)
+	for key, value := range result.Fields {
+		entry[key] = value
+	}
+	entry["timestamp"] = result.Time.UTC().Format(time.RFC3339Nano)
+	entry["timing"] = result.Timing.Seconds()
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("Unable to encode report: %v", err)
+		r.queue.Drop()
+		return
+	}
+	r.queue.Add(json.RawMessage(b))
+}
+
+// Dropped returns the number of reports dropped so far because the buffer was
+// full, the Reporter was closed or the webhook kept failing.
+func (r *Reporter) Dropped() int64 {
+	return r.queue.Dropped()
+}
+
+// Flush waits (for a limited time) until all reports queued so far have been
+// posted or dropped.
+func (r *Reporter) Flush() error {
+	return r.queue.Flush()
+}
+
+// Close stops accepting reports and waits (for a limited time) for buffered
+// reports to be posted. Reports that couldn't be posted in time are abandoned
+// and counted as dropped.
+func (r *Reporter) Close() error {
+	return r.queue.Close()
+}
+
+func (r *Reporter) run() {
+	ticker := time.NewTicker(r.opts.FlushInterval)
+	defer ticker.Stop()
+	backoff := minBackoff
+	retries := 0
+	var batch []json.RawMessage
+	for {
+		if len(batch) < r.opts.BatchSize {
+			select {
+			case report := <-r.queue.Items():
+				batch = append(batch, report.(json.RawMessage))
+				if len(batch) < r.opts.BatchSize {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					continue
+				}
+			case <-r.queue.Closing():
+				r.drain(batch)
+				return
+			}
+		}
+		retry, err := r.post(batch)
+		if err == nil || !retry || retries >= r.opts.MaxRetries {
+			if err != nil {
+				log.Errorf("Dropping %d reports after failing to post them to webhook: %v", len(batch), err)
+				r.queue.Discard(len(batch))
+			}
+			backoff = minBackoff
+			retries = 0
+			batch = nil
+			continue
+		}
+		log.Debugf("Error posting to webhook, will retry in %v: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-r.queue.Closing():
+			r.drain(batch)
+			return
+		}
+		retries++
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// drain makes a final attempt to post the given batch along with everything
+// that's still buffered.
+func (r *Reporter) drain(batch []json.RawMessage) {
+	for {
+		select {
+		case report := <-r.queue.Items():
+			batch = append(batch, report.(json.RawMessage))
+			if len(batch) >= r.opts.BatchSize {
+				r.postFinal(batch)
+				batch = nil
+			}
+		default:
+			if len(batch) > 0 {
+				r.postFinal(batch)
+			}
+			return
+		}
+	}
+}
+
+func (r *Reporter) postFinal(batch []json.RawMessage) {
+	if _, err := r.post(batch); err != nil {
+		log.Debugf("Error posting buffered reports to webhook: %v", err)
+	}
+}
+
+// post posts a batch, returning whether it's worth retrying if it fails.
+func (r *Reporter) post(batch []json.RawMessage) (bool, error) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", r.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(r.queue.Context())
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range r.opts.Headers {
+		req.Header.Set(key, value)
+	}
+	if r.opts.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(r.opts.Secret, body))
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, fmt.Errorf("Unexpected status %v", resp.Status)
+	}
+	r.queue.Sent(len(batch))
+	return false, nil
+}
+
+// Sign returns the signature of body using secret, as sent in the
+// SignatureHeader. Receivers can use it to verify requests.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
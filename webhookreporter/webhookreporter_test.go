@@ -0,0 +1,125 @@
+package webhookreporter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxybench"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReporter(t *testing.T) {
+	var mx sync.Mutex
+	var received []map[string]interface{}
+	var signatures []string
+	var posts int
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		mx.Lock()
+		defer mx.Unlock()
+		posts++
+		if posts == 1 {
+			// Fail the first post to make sure it's retried
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []map[string]interface{}
+		if err := json.Unmarshal(body, &batch); err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, batch...)
+		signatures = append(signatures, req.Header.Get(SignatureHeader))
+		assert.Equal(t, Sign("secret", body), req.Header.Get(SignatureHeader))
+		assert.Equal(t, "Bearer token", req.Header.Get("Authorization"))
+	}))
+	defer srv.Close()
+
+	r, err := New(&Opts{
+		URL:           srv.URL,
+		Headers:       map[string]string{"Authorization": "Bearer token"},
+		Secret:        "secret",
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	r.Report(proxybench.NewResult(1500*time.Millisecond, map[string]interface{}{"url": "https://a.com", "proxybench_success": true}))
+	r.Report(proxybench.NewResult(0, map[string]interface{}{"url": "https://b.com", "failure_reason": "dial"}))
+	assert.NoError(t, r.Flush(), "failed post should be retried")
+	r.Report(proxybench.NewResult(0, map[string]interface{}{"run_verdict": "healthy"}))
+	assert.NoError(t, r.Close(), "partial batch should be posted on close")
+	assert.EqualValues(t, 0, r.Dropped())
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, 3, posts)
+	assert.Len(t, signatures, 2)
+	if assert.Len(t, received, 3) {
+		assert.Equal(t, "https://a.com", received[0]["url"])
+		assert.Equal(t, 1.5, received[0]["timing"])
+		assert.Equal(t, true, received[0]["proxybench_success"])
+		assert.NotEmpty(t, received[0]["timestamp"])
+		assert.Equal(t, "dial", received[1]["failure_reason"])
+		assert.Equal(t, "healthy", received[2]["run_verdict"])
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	var mx sync.Mutex
+	var posts int
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		mx.Lock()
+		posts++
+		mx.Unlock()
+		resp.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	r, err := New(&Opts{URL: srv.URL})
+	if !assert.NoError(t, err) {
+		return
+	}
+	r.Report(proxybench.NewResult(time.Second, map[string]interface{}{"url": "https://a.com"}))
+	assert.NoError(t, r.Flush())
+	assert.NoError(t, r.Close())
+	assert.EqualValues(t, 1, r.Dropped())
+	mx.Lock()
+	assert.Equal(t, 1, posts)
+	mx.Unlock()
+}
+
+func TestCloseTimeout(t *testing.T) {
+	oldCloseTimeout := closeTimeout
+	closeTimeout = 50 * time.Millisecond
+	defer func() {
+		closeTimeout = oldCloseTimeout
+	}()
+	abandoned := make(chan bool, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		// Hang until the Reporter gives up
+		ioutil.ReadAll(req.Body)
+		<-req.Context().Done()
+		abandoned <- true
+	}))
+	defer srv.Close()
+
+	r, err := New(&Opts{URL: srv.URL, FlushInterval: time.Hour})
+	if !assert.NoError(t, err) {
+		return
+	}
+	r.Report(proxybench.NewResult(time.Second, map[string]interface{}{"url": "https://a.com"}))
+	assert.Error(t, r.Close())
+	select {
+	case <-abandoned:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Close should stop posting in the background")
+	}
+	assert.EqualValues(t, 1, r.Dropped(), "abandoned report should be dropped")
+}
@@ -0,0 +1,105 @@
+package proxybench
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/getlantern/ops"
+	"github.com/gorilla/websocket"
+)
+
+var errPongReceived = errors.New("pong received")
+
+// benchWebSocket upgrades to a WebSocket at origin through the given proxy,
+// reporting (and returning) how long the upgrade took, and optionally reporting
+// the round trip time of a ping over the established WebSocket.
+func (rn *run) benchWebSocket(origin string, proxy *proxy) (time.Duration, error) {
+	rn.pacer.wait(rn.ctx, rn.opts, origin)
+	report := rn.reporter()
+	proxyFN, done, err := proxyFunc(rn.ctx, rn.opts, report, origin, proxy)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	op := beginOp(rn.opts, origin, proxy).Set("request_type", "websocket")
+	defer op.End()
+
+	// Note - gorilla/websocket can't send custom headers with its CONNECT, so
+	// proxies requiring an AuthToken will reject the upgrade. It does send
+	// basic auth credentials from the proxy URL though.
+	dialer := &websocket.Dialer{
+		Proxy: func(req *http.Request) (*url.URL, error) {
+			u, err := proxyFN(req)
+			if u != nil && u.Scheme == "http" && proxy.Username != "" {
+				u.User = url.UserPassword(proxy.Username, proxy.Password)
+			}
+			return u, err
+		},
+		HandshakeTimeout: proxy.requestTimeout(rn.opts),
+	}
+	start := time.Now()
+	conn, resp, err := dialer.DialContext(rn.ctx, origin, nil)
+	if err != nil {
+		log.Debugf("Unable to upgrade to WebSocket at %v via %v: %v", origin, proxy, err)
+		op.Set("ws_upgrade_success", false)
+		if resp != nil {
+			op.Set("ws_upgrade_status", resp.StatusCode)
+		}
+		if phase := proxy.dialFailurePhase(); phase != "" {
+			op.Set("failure_phase", phase)
+		}
+		if proxy.certVerificationFailed() {
+			op.Set("cert_verification_failed", true)
+		}
+		proxy.setDialAttempts(op)
+		report(0, ops.AsMap(op, true))
+		return 0, err
+	}
+	defer conn.Close()
+	upgradeTime := time.Since(start)
+	op.Set("ws_upgrade_success", true).
+		Set("ws_upgrade_time", upgradeTime.Seconds()).
+		Set("proxybench_success", true)
+
+	if rn.opts.WebSocketPing {
+		rtt, err := pingWebSocket(conn)
+		if err != nil {
+			log.Debugf("Unable to ping WebSocket at %v via %v: %v", origin, proxy, err)
+		} else {
+			op.Set("ws_ping_rtt", rtt.Seconds())
+		}
+	}
+	proxy.setDialAttempts(op)
+	report(upgradeTime, ops.AsMap(op, true))
+	return upgradeTime, nil
+}
+
+// pingWebSocket sends a ping over conn and waits for the corresponding pong.
+func pingWebSocket(conn *websocket.Conn) (time.Duration, error) {
+	var rtt time.Duration
+	start := time.Now()
+	conn.SetPongHandler(func(string) error {
+		rtt = time.Since(start)
+		// Returning an error makes the pending read return immediately
+		return errPongReceived
+	})
+	deadline := start.Add(30 * time.Second)
+	if err := conn.WriteControl(websocket.PingMessage, []byte("proxybench"), deadline); err != nil {
+		return 0, err
+	}
+	conn.SetReadDeadline(deadline)
+	// Control frames are only processed while reading, so keep reading until
+	// we've seen the pong.
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == errPongReceived {
+			return rtt, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
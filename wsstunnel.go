@@ -0,0 +1,86 @@
+package proxybench
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialWSS dials a proxy reachable through a WebSocket tunnel, over which the
+// proxied stream is carried in binary messages.
+func (p *proxy) dialWSS(ctx context.Context) (net.Conn, error) {
+	host := p.FrontDomain
+	if host == "" {
+		host = p.addr
+	}
+	u := &url.URL{Scheme: "wss", Host: host, Path: p.WSSPath}
+	header := make(http.Header, len(p.WSSHeaders))
+	for key, value := range p.WSSHeaders {
+		header.Set(key, value)
+	}
+	dialer := &websocket.Dialer{
+		// Always connect to the configured address, even when fronted
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return p.dialTCP(ctx, network, p.addr)
+		},
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify:    true,
+			VerifyPeerCertificate: p.verifyPeerCertificate,
+		},
+		HandshakeTimeout: 1 * time.Minute,
+	}
+	conn, _, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		return nil, err
+	}
+	return &wsConn{Conn: conn}, nil
+}
+
+// wsConn adapts a WebSocket connection carrying a stream in binary messages to
+// a net.Conn.
+type wsConn struct {
+	*websocket.Conn
+	reader io.Reader
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			_, reader, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.reader = reader
+		}
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			// End of this message, move on to the next
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
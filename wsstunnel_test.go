@@ -0,0 +1,57 @@
+package proxybench
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWSSTunnel(t *testing.T) {
+	upgrader := &websocket.Upgrader{}
+	tokens := make(chan string, 1)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/tunnel" {
+			http.NotFound(resp, req)
+			return
+		}
+		tokens <- req.Header.Get("X-Token")
+		conn, err := upgrader.Upgrade(resp, req, nil)
+		if err != nil {
+			return
+		}
+		tunnel := &wsConn{Conn: conn}
+		defer tunnel.Close()
+		// Act as the proxy and the origin at once
+		if _, err := http.ReadRequest(bufio.NewReader(tunnel)); err != nil {
+			return
+		}
+		tunnel.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+		tunnel.Read(make([]byte, 1))
+	}))
+	defer srv.Close()
+
+	p := &Proxy{
+		Addrs:      map[string]string{"wss": srv.Listener.Addr().String()},
+		WSSPath:    "/tunnel",
+		WSSHeaders: map[string]string{"X-Token": "secret"},
+	}
+	proxy := p.withRandomProtocol()
+	assert.Equal(t, "wss", proxy.protocol)
+	timing, err := request(context.Background(), &Opts{}, func(time.Duration, map[string]interface{}) {}, "http://example.com", proxy)
+	if assert.NoError(t, err) {
+		assert.True(t, timing > 0)
+		assert.Equal(t, "secret", <-tokens)
+	}
+
+	p.WSSPath = "/wrong"
+	proxy = p.withProtocol("wss")
+	_, err = request(context.Background(), &Opts{}, func(time.Duration, map[string]interface{}) {}, "http://example.com", proxy)
+	assert.Error(t, err)
+	assert.Equal(t, failurePhaseHandshake, proxy.dialFailurePhase())
+}